@@ -13,14 +13,30 @@ const TLS_CERT = "tls.cert" // TLS cert file
 const TLS_KEY = "tls.key"   // TLS key file
 const AUTH = "auth"         // auth secret
 
-const SEGMENTS = "segments"      // number of parts & blocks
-const BUFFER_SIZE = "buffersize" // maximum length of a single message (including value)
-const SCAN_PERIOD = "scanperiod" // seconds between scanning for expired keys
+const SEGMENTS = "segments"          // number of parts & blocks
+const BUFFER_SIZE = "buffersize"     // maximum length of a single message (including value)
+const EXPIRY_PERIOD = "expiryperiod" // milliseconds between checking blocks for expired keys
+const WATCH_BUFFER = "watchbuffer"   // events buffered per watcher before it is dropped
+const ENGINE = "engine"              // storage engine of blocks
+const MAX_MEMORY = "maxmemory"       // bytes of keys & values before evicting, 0 is unlimited
+const EVICTION = "eviction"          // lru, lfu, volatile or random
+
+const REPL_NODES = "repl.nodes"   // addresses of followers to replicate to
+const REPL_AUTH = "repl.auth"     // auth secret of the followers
+const REPL_PERIOD = "repl.period" // milliseconds between syncing changed blocks to followers
 
 const PERSIST = "persist" // bool
 // if persist = true:
-const WRITE_PERIOD = "writeperiod" // seconds between writing changed blocks to file
-const DIR = "dir"                  // directory for blocks
+const WRITE_PERIOD = "writeperiod"      // seconds between writing changed blocks to file
+const DIR = "dir"                       // directory for blocks
+const WAL = "wal"                       // bool, log writes between block writes
+const WAL_SYNC = "walsync"              // always, periodic or never
+const WAL_SYNC_PERIOD = "walsyncperiod" // milliseconds between wal syncs, if walsync = periodic
+
+const LEGACY_NAMESPACES = "legacynamespaces" // namespaces of keys in block files of versions without full keys
+
+// Deprecated keys, read into the keys replacing them
+const SCAN_PERIOD = "scanperiod" // seconds, replaced by expiryperiod
 
 var configFile = flag.String("c", "", "must be a file path")
 
@@ -42,6 +58,21 @@ func InitConfig() {
 	if err != nil {
 		panic(fmt.Errorf("fatal error config file: %w", err))
 	}
+	applyDeprecated()
+}
+
+// applyDeprecated sets the keys replacing deprecated keys
+// from those, unless they are set in the config file too
+func applyDeprecated() {
+	if !viper.IsSet(SCAN_PERIOD) {
+		return
+	}
+	if viper.InConfig(EXPIRY_PERIOD) {
+		fmt.Printf("ignoring deprecated %s, as %s is set\r\n", SCAN_PERIOD, EXPIRY_PERIOD)
+		return
+	}
+	fmt.Printf("%s is deprecated, use %s in milliseconds\r\n", SCAN_PERIOD, EXPIRY_PERIOD)
+	viper.Set(EXPIRY_PERIOD, viper.GetInt(SCAN_PERIOD)*1000)
 }
 
 // Start with sensible defaults
@@ -51,8 +82,17 @@ func initDefaults() {
 
 	viper.SetDefault(BUFFER_SIZE, 2000000) // 2MB
 	viper.SetDefault(SEGMENTS, "16")       // 256 blocks
-	viper.SetDefault(SCAN_PERIOD, 10)
+	viper.SetDefault(EXPIRY_PERIOD, 100)
+	viper.SetDefault(WATCH_BUFFER, 1000)
+	viper.SetDefault(ENGINE, "memory")
+	viper.SetDefault(MAX_MEMORY, 0)
+	viper.SetDefault(EVICTION, "lru")
+
+	viper.SetDefault(REPL_PERIOD, 100)
 
 	viper.SetDefault(WRITE_PERIOD, 10)
 	viper.SetDefault(DIR, ".")
+	viper.SetDefault(WAL, true)
+	viper.SetDefault(WAL_SYNC, "periodic")
+	viper.SetDefault(WAL_SYNC_PERIOD, 100)
 }
@@ -0,0 +1,19 @@
+package cfg
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Tests that the deprecated scan period in seconds
+// is read as the expiry period in milliseconds
+func TestApplyDeprecatedScanPeriod(t *testing.T) {
+	initDefaults()
+	viper.Set(SCAN_PERIOD, 10)
+	defer viper.Set(SCAN_PERIOD, nil)
+	applyDeprecated()
+	if period := viper.GetInt(EXPIRY_PERIOD); period != 10000 {
+		t.Fatalf("expected expiry period of 10000ms, got %v", period)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/intob/rocketkv/protocol"
 )
@@ -11,20 +13,70 @@ import (
 const errEmptySecret = "secret is empty"
 const errNegativeExpiry = "expires should be 0 or positive"
 const errEmptyKey = "key must not be empty"
+const errConnClosed = "connection closed"
+const errUnexpectedResponse = "unexpected response"
+const errSnapshotFraming = "snapshots require length-prefixed framing"
+const errTtlVersion = "ttl requires protocol version 3, see Hello"
+const errNoExpiry = "expiry must not be 0, use Persist to clear it"
+
+// Maximum length of a received msg
+const MAX_MSG_LEN = 64 << 20
+
+// Set in request ids of blocking methods
+const syncReqIdBit uint32 = 1 << 31
+
+// Number of msgs buffered in Msgs chan
+const MSGS_BUFFER = 1000
 
 // Client provides connection & command helpers
 type Client struct {
-	conn net.Conn
-	Msgs chan protocol.Msg
+	conn      net.Conn
+	framing   protocol.Framing
+	hello     *protocol.Hello // negotiated, nil until Hello is called
+	reqId     uint32          // last request id, see NextReqId
+	syncReqId uint32          // last request id of a blocking method
+	mu        *sync.Mutex     // guards pending & closed
+	pending   map[uint32]*pending
+	closed    bool
+	Msgs      chan protocol.Msg
 }
 
 // NewClient returns a pointer to a new Client
+// using the default +END framing
 //
 // Messages can be receieved on Msgs chan.
+// Up to MSGS_BUFFER msgs are buffered. If more are
+// not read, the connection is closed.
 func NewClient(conn net.Conn) *Client {
+	return newClient(conn, protocol.FramingPlusEnd)
+}
+
+// NewClientWithFraming sends the preamble for the given
+// framing mode, and returns a pointer to a new Client
+//
+// Use protocol.FramingLenPrefix for values that may
+// contain the +END split marker.
+func NewClientWithFraming(conn net.Conn, framing protocol.Framing) (*Client, error) {
+	if !framing.Valid() {
+		return nil, errors.New(protocol.ErrFramingUnknown)
+	}
+	preamble := framing.Preamble()
+	if len(preamble) > 0 {
+		_, err := conn.Write(preamble)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newClient(conn, framing), nil
+}
+
+func newClient(conn net.Conn, framing protocol.Framing) *Client {
 	c := &Client{
-		conn: conn,
-		Msgs: make(chan protocol.Msg),
+		conn:    conn,
+		framing: framing,
+		mu:      new(sync.Mutex),
+		pending: make(map[uint32]*pending),
+		Msgs:    make(chan protocol.Msg, MSGS_BUFFER),
 	}
 	go c.pumpMsgs()
 	return c
@@ -32,26 +84,71 @@ func NewClient(conn net.Conn) *Client {
 
 // pumpMsgs reads from conn, decodes & writes
 // messages to Msgs chan
+//
+// Responses to pending requests are delivered
+// to the request instead of Msgs. Late responses
+// to abandoned requests of blocking methods are dropped.
+// Msgs is closed when the connection ends.
+// If a msg can't be decoded, or Msgs is full,
+// the connection is closed, & pending requests
+// fail with ErrConnClosed.
 func (c *Client) pumpMsgs() {
+	defer c.closePending()
+	defer close(c.Msgs)
 	scan := bufio.NewScanner(c.conn)
-	scan.Split(protocol.SplitPlusEnd)
+	scan.Buffer(nil, MAX_MSG_LEN)
+	scan.Split(c.framing.SplitFunc())
 	for scan.Scan() {
 		mBytes := scan.Bytes()
 		msg, err := protocol.DecodeMsg(mBytes)
 		if err != nil {
-			panic(err)
+			// the stream can't be trusted after a bad msg
+			c.conn.Close()
+			return
+		}
+		if msg.ReqId&syncReqIdBit != 0 {
+			c.deliver(msg)
+			continue
+		}
+		select {
+		case c.Msgs <- *msg:
+		default:
+			// don't stall the responses to blocking methods
+			c.conn.Close()
+			return
 		}
-		c.Msgs <- *msg
 	}
 }
 
+// NextReqId returns a new request id, never 0
+//
+// Set it as ReqId of a msg to match the msg
+// with its responses on Msgs.
+// The high bit is never set, as those ids
+// are reserved for the blocking methods.
+func (c *Client) NextReqId() uint32 {
+	for {
+		id := atomic.AddUint32(&c.reqId, 1) &^ syncReqIdBit
+		if id != 0 {
+			// 0 means no id
+			return id
+		}
+	}
+}
+
+// nextSyncReqId returns a new request id
+// with the high bit set
+func (c *Client) nextSyncReqId() uint32 {
+	return atomic.AddUint32(&c.syncReqId, 1) | syncReqIdBit
+}
+
 // Send encodes & publishes the given message
 func (c *Client) Send(msg *protocol.Msg) error {
 	msgEnc, err := protocol.EncodeMsg(msg)
 	if err != nil {
 		return err
 	}
-	_, err = c.conn.Write(msgEnc)
+	_, err = c.conn.Write(c.framing.Frame(msgEnc))
 	return err
 }
 
@@ -73,6 +170,73 @@ func (c *Client) Ping() error {
 	})
 }
 
+// Hello exchanges protocol version & capabilities
+// with the server, and waits for the response
+//
+// Must be called before any other message is sent,
+// as the response is read from Msgs.
+// Servers that don't support hello close the connection.
+func (c *Client) Hello(build string) (*protocol.Hello, error) {
+	own := &protocol.Hello{
+		Version: protocol.PROTOCOL_VERSION,
+		Caps:    protocol.CAPS,
+		Build:   build,
+	}
+	err := c.Send(protocol.EncodeHello(own, protocol.OpHello, 0))
+	if err != nil {
+		return nil, err
+	}
+	resp, ok := <-c.Msgs
+	if !ok {
+		return nil, errors.New(errConnClosed)
+	}
+	if resp.Op != protocol.OpHello || resp.Status != protocol.StatusOk {
+		return nil, errors.New(errUnexpectedResponse)
+	}
+	server, err := protocol.DecodeHello(&resp)
+	if err != nil {
+		return nil, err
+	}
+	c.hello = server
+	return server, nil
+}
+
+// Version returns the negotiated protocol version
+//
+// Returns 1 if Hello has not been called. From version 3,
+// expires times are in Unix milliseconds, before in seconds.
+func (c *Client) Version() uint16 {
+	if c.hello == nil {
+		return 1
+	}
+	return c.hello.Version
+}
+
+// Caps returns the negotiated capabilities
+//
+// Returns 0 if Hello has not been called.
+func (c *Client) Caps() uint64 {
+	if c.hello == nil {
+		return 0
+	}
+	return c.hello.Caps
+}
+
+// HasCap returns true if the server & client
+// both support the given capabilities
+func (c *Client) HasCap(cap uint64) bool {
+	return c.hello != nil && c.hello.HasCap(cap)
+}
+
+// MsgLenMax returns the length of the longest msg
+// the server reads, or 0 if not known
+func (c *Client) MsgLenMax() int {
+	if c.hello == nil {
+		return 0
+	}
+	return int(c.hello.MsgLenMax)
+}
+
 // Auth sends an auth message using the given secret
 //
 // A status message will follow
@@ -99,9 +263,10 @@ func (c *Client) Set(key string, value []byte, expires int64, ack bool) error {
 		return errors.New(errEmptyKey)
 	}
 	msg := &protocol.Msg{
-		Op:    protocol.OpSet,
-		Key:   key,
-		Value: value,
+		Op:      protocol.OpSet,
+		Key:     key,
+		Value:   value,
+		Expires: expires,
 	}
 	if ack {
 		msg.Op = protocol.OpSetAck
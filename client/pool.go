@@ -0,0 +1,476 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/util"
+)
+
+const errPoolSize = "pool size must be at least 1"
+const errNoReqId = "server does not support request ids"
+
+// Returned by the methods of a Pool after Close
+var ErrPoolClosed = errors.New("pool is closed")
+
+// Blocking request methods,
+// implemented by both Client & Pool
+type Requester interface {
+	PingAck(ctx context.Context) error
+	GetValue(ctx context.Context, key string) ([]byte, Meta, error)
+	SetAck(ctx context.Context, key string, value []byte, expires int64) error
+	SetAckTtl(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Cas(ctx context.Context, key string, value []byte, expires, expected int64) (int64, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	ExpireAt(ctx context.Context, key string, expires int64) (int64, error)
+	Persist(ctx context.Context, key string) (int64, error)
+	Ttl(ctx context.Context, key string) (time.Duration, error)
+	DelAck(ctx context.Context, key string) error
+	ListKeys(ctx context.Context, keyPrefix string) ([]string, error)
+	CountKeys(ctx context.Context, keyPrefix string) (uint64, error)
+	Incr(ctx context.Context, key string, delta, expires int64) (int64, error)
+	Decr(ctx context.Context, key string, delta, expires int64) (int64, error)
+	MGet(ctx context.Context, keys []string) ([]protocol.Entry, error)
+	MSet(ctx context.Context, entries []protocol.Entry) ([]int64, error)
+	MDel(ctx context.Context, keys []string) ([]bool, error)
+	Txn(ctx context.Context, entries []protocol.Entry) ([]protocol.Entry, error)
+	Watch(ctx context.Context, prefix string) (<-chan protocol.Msg, error)
+	WatchExpired(ctx context.Context, prefix string, withValue bool) (<-chan protocol.Msg, error)
+	Reshard(ctx context.Context, segments uint32) error
+	ReshardProgress(ctx context.Context) (*protocol.ReshardProgress, error)
+	Snapshot(ctx context.Context, w io.Writer) error
+	Stats(ctx context.Context) (*protocol.Stats, error)
+}
+
+var _ Requester = (*Client)(nil)
+var _ Requester = (*Pool)(nil)
+
+// Configures a Pool
+//
+// If CertFile is set, connections use TLS.
+// If AuthSecret is set, each connection is authenticated.
+type PoolConfig struct {
+	Network      string
+	Address      string
+	CertFile     string
+	KeyFile      string
+	AuthSecret   string
+	Size         int              // number of connections
+	Framing      protocol.Framing // default is +END
+	HealthPeriod time.Duration    // between pings, default 10s
+	Timeout      time.Duration    // for dial, hello, auth & ping, default 5s
+}
+
+// Pool keeps a number of authenticated connections,
+// and spreads requests across them
+//
+// Broken connections are re-dialed & re-authenticated,
+// either when next used, or by the periodic health check.
+// A request in flight when its connection breaks
+// returns an error, and is not retried.
+type Pool struct {
+	cfg      PoolConfig
+	conns    []*poolConn
+	next     uint32
+	stop     chan struct{} // closed by Close
+	stopOnce *sync.Once
+}
+
+// Holds the current client of a pool slot
+type poolConn struct {
+	mu     *sync.Mutex
+	client *Client
+}
+
+// NewPool dials & authenticates all connections
+// of the pool, and starts the health check
+func NewPool(cfg PoolConfig) (*Pool, error) {
+	if cfg.Size < 1 {
+		return nil, errors.New(errPoolSize)
+	}
+	if cfg.HealthPeriod == 0 {
+		cfg.HealthPeriod = 10 * time.Second
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	p := &Pool{
+		cfg:      cfg,
+		conns:    make([]*poolConn, cfg.Size),
+		stop:     make(chan struct{}),
+		stopOnce: new(sync.Once),
+	}
+	for i := range p.conns {
+		c, err := p.dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.conns[i] = &poolConn{
+			mu:     new(sync.Mutex),
+			client: c,
+		}
+	}
+	go p.checkHealth()
+	return p, nil
+}
+
+// dial returns a new client that is ready for requests
+func (p *Pool) dial() (*Client, error) {
+	var conn net.Conn
+	var err error
+	if p.cfg.CertFile != "" {
+		conn, err = util.GetConnWithTLS(p.cfg.Network, p.cfg.Address, p.cfg.CertFile, p.cfg.KeyFile)
+	} else {
+		conn, err = util.GetConn(p.cfg.Network, p.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClientWithFraming(conn, p.cfg.Framing)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(p.cfg.Timeout))
+	_, err = c.Hello("")
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !c.HasCap(protocol.CapReqId) {
+		c.Close()
+		return nil, errors.New(errNoReqId)
+	}
+	if p.cfg.AuthSecret != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+		defer cancel()
+		err = c.AuthAck(ctx, p.cfg.AuthSecret)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// get returns the client of the slot,
+// re-dialing if the connection has ended
+//
+// Returns ErrPoolClosed once the pool is closed.
+func (p *Pool) get(pc *poolConn) (*Client, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	select {
+	case <-p.stop:
+		return nil, ErrPoolClosed
+	default:
+	}
+	if pc.client != nil && !pc.client.isClosed() {
+		return pc.client, nil
+	}
+	c, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	pc.client = c
+	return c, nil
+}
+
+// discard closes the client of the slot,
+// if it is still the given client
+func (pc *poolConn) discard(c *Client) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.client == c {
+		c.Close()
+		pc.client = nil
+	}
+}
+
+// do runs fn with the next client, round robin
+func (p *Pool) do(fn func(c *Client) error) error {
+	i := atomic.AddUint32(&p.next, 1)
+	pc := p.conns[int(i)%len(p.conns)]
+	c, err := p.get(pc)
+	if err != nil {
+		return err
+	}
+	return fn(c)
+}
+
+// checkHealth periodically pings every connection,
+// and replaces those that don't respond
+func (p *Pool) checkHealth() {
+	ticker := time.NewTicker(p.cfg.HealthPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, pc := range p.conns {
+			c, err := p.get(pc)
+			if err != nil {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), p.cfg.Timeout)
+			err = c.PingAck(ctx)
+			cancel()
+			if err != nil {
+				pc.discard(c)
+				p.get(pc)
+			}
+		}
+	}
+}
+
+// Close stops the health check & closes all connections
+//
+// Calling Close again has no effect.
+func (p *Pool) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	for _, pc := range p.conns {
+		if pc == nil {
+			continue
+		}
+		pc.mu.Lock()
+		if pc.client != nil {
+			pc.client.Close()
+			pc.client = nil
+		}
+		pc.mu.Unlock()
+	}
+	return nil
+}
+
+// PingAck sends a ping on the next connection
+// & waits for the pong
+func (p *Pool) PingAck(ctx context.Context) error {
+	return p.do(func(c *Client) error {
+		return c.PingAck(ctx)
+	})
+}
+
+// GetValue returns the value & metadata of the key
+func (p *Pool) GetValue(ctx context.Context, key string) (value []byte, meta Meta, err error) {
+	err = p.do(func(c *Client) error {
+		value, meta, err = c.GetValue(ctx, key)
+		return err
+	})
+	return value, meta, err
+}
+
+// SetAck sets the value & expires properties of the key,
+// and waits for the server to acknowledge
+func (p *Pool) SetAck(ctx context.Context, key string, value []byte, expires int64) error {
+	return p.do(func(c *Client) error {
+		return c.SetAck(ctx, key, value, expires)
+	})
+}
+
+// SetAckTtl sets the value of the key, to expire after ttl,
+// and waits for the server to acknowledge
+func (p *Pool) SetAckTtl(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return p.do(func(c *Client) error {
+		return c.SetAckTtl(ctx, key, value, ttl)
+	})
+}
+
+// Cas sets the value & expires properties of the key,
+// only if its current version equals the expected version
+func (p *Pool) Cas(ctx context.Context, key string, value []byte, expires, expected int64) (version int64, err error) {
+	err = p.do(func(c *Client) error {
+		version, err = c.Cas(ctx, key, value, expires, expected)
+		return err
+	})
+	return version, err
+}
+
+// Expire sets the key to expire after ttl, keeping its value
+func (p *Pool) Expire(ctx context.Context, key string, ttl time.Duration) (version int64, err error) {
+	err = p.do(func(c *Client) error {
+		version, err = c.Expire(ctx, key, ttl)
+		return err
+	})
+	return version, err
+}
+
+// ExpireAt sets the expires time of the key, keeping its value
+func (p *Pool) ExpireAt(ctx context.Context, key string, expires int64) (version int64, err error) {
+	err = p.do(func(c *Client) error {
+		version, err = c.ExpireAt(ctx, key, expires)
+		return err
+	})
+	return version, err
+}
+
+// Persist clears the expiry of the key, keeping its value
+func (p *Pool) Persist(ctx context.Context, key string) (version int64, err error) {
+	err = p.do(func(c *Client) error {
+		version, err = c.Persist(ctx, key)
+		return err
+	})
+	return version, err
+}
+
+// Ttl returns the time until the key expires,
+// or NoExpiry if it doesn't expire
+func (p *Pool) Ttl(ctx context.Context, key string) (ttl time.Duration, err error) {
+	err = p.do(func(c *Client) error {
+		ttl, err = c.Ttl(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+// DelAck deletes the key,
+// and waits for the server to acknowledge
+func (p *Pool) DelAck(ctx context.Context, key string) error {
+	return p.do(func(c *Client) error {
+		return c.DelAck(ctx, key)
+	})
+}
+
+// ListKeys returns all keys with the given prefix
+func (p *Pool) ListKeys(ctx context.Context, keyPrefix string) (keys []string, err error) {
+	err = p.do(func(c *Client) error {
+		keys, err = c.ListKeys(ctx, keyPrefix)
+		return err
+	})
+	return keys, err
+}
+
+// CountKeys returns the number of keys with the given prefix
+func (p *Pool) CountKeys(ctx context.Context, keyPrefix string) (count uint64, err error) {
+	err = p.do(func(c *Client) error {
+		count, err = c.CountKeys(ctx, keyPrefix)
+		return err
+	})
+	return count, err
+}
+
+// Incr atomically adds delta to the int64 value of the key,
+// and returns the new value
+func (p *Pool) Incr(ctx context.Context, key string, delta, expires int64) (value int64, err error) {
+	err = p.do(func(c *Client) error {
+		value, err = c.Incr(ctx, key, delta, expires)
+		return err
+	})
+	return value, err
+}
+
+// Decr atomically subtracts delta from the int64 value of the key,
+// and returns the new value
+func (p *Pool) Decr(ctx context.Context, key string, delta, expires int64) (value int64, err error) {
+	err = p.do(func(c *Client) error {
+		value, err = c.Decr(ctx, key, delta, expires)
+		return err
+	})
+	return value, err
+}
+
+// MGet returns an entry for each key, in the same order
+func (p *Pool) MGet(ctx context.Context, keys []string) (entries []protocol.Entry, err error) {
+	err = p.do(func(c *Client) error {
+		entries, err = c.MGet(ctx, keys)
+		return err
+	})
+	return entries, err
+}
+
+// MSet sets the value & expires properties of each entry,
+// and returns the new version of each
+func (p *Pool) MSet(ctx context.Context, entries []protocol.Entry) (versions []int64, err error) {
+	err = p.do(func(c *Client) error {
+		versions, err = c.MSet(ctx, entries)
+		return err
+	})
+	return versions, err
+}
+
+// MDel deletes each key,
+// and returns whether it existed
+func (p *Pool) MDel(ctx context.Context, keys []string) (found []bool, err error) {
+	err = p.do(func(c *Client) error {
+		found, err = c.MDel(ctx, keys)
+		return err
+	})
+	return found, err
+}
+
+// Txn applies the entries atomically, and returns
+// a result entry for each, in the same order
+func (p *Pool) Txn(ctx context.Context, entries []protocol.Entry) (results []protocol.Entry, err error) {
+	err = p.do(func(c *Client) error {
+		results, err = c.Txn(ctx, entries)
+		return err
+	})
+	return results, err
+}
+
+// Watch subscribes to changes of keys with the prefix,
+// using the next connection
+func (p *Pool) Watch(ctx context.Context, prefix string) (events <-chan protocol.Msg, err error) {
+	err = p.do(func(c *Client) error {
+		events, err = c.Watch(ctx, prefix)
+		return err
+	})
+	return events, err
+}
+
+// WatchExpired subscribes to expiry of keys with the prefix,
+// using the next connection
+func (p *Pool) WatchExpired(ctx context.Context, prefix string, withValue bool) (events <-chan protocol.Msg, err error) {
+	err = p.do(func(c *Client) error {
+		events, err = c.WatchExpired(ctx, prefix, withValue)
+		return err
+	})
+	return events, err
+}
+
+// Reshard starts moving all keys to a new layout with
+// the given number of segments, without downtime
+func (p *Pool) Reshard(ctx context.Context, segments uint32) error {
+	return p.do(func(c *Client) error {
+		return c.Reshard(ctx, segments)
+	})
+}
+
+// ReshardProgress returns the progress of the current
+// or last resharding
+func (p *Pool) ReshardProgress(ctx context.Context) (progress *protocol.ReshardProgress, err error) {
+	err = p.do(func(c *Client) error {
+		progress, err = c.ReshardProgress(ctx)
+		return err
+	})
+	return progress, err
+}
+
+// Stats returns the counters of the store
+func (p *Pool) Stats(ctx context.Context) (stats *protocol.Stats, err error) {
+	err = p.do(func(c *Client) error {
+		stats, err = c.Stats(ctx)
+		return err
+	})
+	return stats, err
+}
+
+// Snapshot streams a consistent archive of the dataset to w
+//
+// Requires length-prefixed framing.
+func (p *Pool) Snapshot(ctx context.Context, w io.Writer) error {
+	return p.do(func(c *Client) error {
+		return c.Snapshot(ctx, w)
+	})
+}
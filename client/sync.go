@@ -0,0 +1,762 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+// Errors returned by the synchronous methods
+var (
+	ErrNotFound     = errors.New("key not found")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrServer       = errors.New("server error")
+	ErrConflict     = errors.New("version conflict")
+	ErrConnClosed   = errors.New(errConnClosed)
+	ErrOverflow     = errors.New("responses were not read fast enough")
+)
+
+// Returned by Ttl for keys that don't expire
+const NoExpiry time.Duration = -1
+
+// Number of events buffered per watch
+const watchBuffer = 1000
+
+// Number of msgs buffered per streamed response,
+// of ListKeys & Snapshot
+const streamBuffer = 1000
+
+// Metadata of a key's slot
+//
+// Modified is only sent by servers that negotiated
+// protocol version 2 or above, see Hello.
+// Expires is in the unit of the protocol version, see Version.
+type Meta struct {
+	Expires  int64
+	Modified int64
+}
+
+// A request waiting for responses
+//
+// Responses are buffered. If the buffer is full, the request
+// is dropped: msgs is closed & overflow is set.
+type pending struct {
+	msgs     chan protocol.Msg
+	overflow bool // guarded by Client.mu, read once msgs is closed
+}
+
+// deliver hands the msg to the pending request
+// with the same id, if any
+//
+// Never blocks, so that a slow reader of one request
+// doesn't stall the responses to all others.
+func (c *Client) deliver(msg *protocol.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pending[msg.ReqId]
+	if !ok {
+		return
+	}
+	select {
+	case p.msgs <- *msg:
+	default:
+		p.overflow = true
+		close(p.msgs)
+		delete(c.pending, msg.ReqId)
+	}
+}
+
+// closePending ends all pending requests,
+// called when the connection ends
+func (c *Client) closePending() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, p := range c.pending {
+		close(p.msgs)
+		delete(c.pending, id)
+	}
+}
+
+// isClosed returns true once the connection has ended
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// request sends the msg with a new request id,
+// and returns the pending request & a func to release it
+//
+// Up to bufferSize responses are buffered.
+func (c *Client) request(msg *protocol.Msg, bufferSize int) (*pending, func(), error) {
+	msg.ReqId = c.nextSyncReqId()
+	p := &pending{
+		msgs: make(chan protocol.Msg, bufferSize),
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, nil, ErrConnClosed
+	}
+	c.pending[msg.ReqId] = p
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		delete(c.pending, msg.ReqId)
+		c.mu.Unlock()
+	}
+	err := c.Send(msg)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return p, release, nil
+}
+
+// next waits for the next response to the pending request
+//
+// Returns ErrOverflow if the request was dropped
+// because its responses were not read fast enough.
+func (p *pending) next(ctx context.Context) (*protocol.Msg, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case resp, ok := <-p.msgs:
+		if !ok {
+			return nil, p.err()
+		}
+		return &resp, nil
+	}
+}
+
+// err returns the reason that msgs was closed
+func (p *pending) err() error {
+	if p.overflow {
+		return ErrOverflow
+	}
+	return ErrConnClosed
+}
+
+// roundTrip sends the msg & waits for a single response
+//
+// A response status other than OK is returned as an error.
+func (c *Client) roundTrip(ctx context.Context, msg *protocol.Msg) (*protocol.Msg, error) {
+	p, release, err := c.request(msg, 1)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	resp, err := p.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return resp, statusErr(resp.Status)
+}
+
+// statusErr translates a response status to an error
+func statusErr(status byte) error {
+	switch status {
+	case protocol.StatusOk, protocol.StatusStreamEnd:
+		return nil
+	case protocol.StatusNotFound:
+		return ErrNotFound
+	case protocol.StatusUnauthorized:
+		return ErrUnauthorized
+	case protocol.StatusConflict:
+		return ErrConflict
+	default:
+		return ErrServer
+	}
+}
+
+// PingAck sends a ping & waits for the pong
+func (c *Client) PingAck(ctx context.Context) error {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op: protocol.OpPing,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Op != protocol.OpPong {
+		return errors.New(errUnexpectedResponse)
+	}
+	return nil
+}
+
+// AuthAck authenticates using the given secret,
+// and waits for the result
+func (c *Client) AuthAck(ctx context.Context, secret string) error {
+	if secret == "" {
+		return errors.New(errEmptySecret)
+	}
+	_, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:  protocol.OpAuth,
+		Key: secret,
+	})
+	return err
+}
+
+// GetValue returns the value & metadata of the key
+//
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) GetValue(ctx context.Context, key string) ([]byte, Meta, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:  protocol.OpGet,
+		Key: key,
+	})
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return resp.Value, Meta{
+		Expires:  resp.Expires,
+		Modified: resp.Modified,
+	}, nil
+}
+
+// SetAck sets the value & expires properties of the key,
+// and waits for the server to acknowledge
+//
+// If expires is 0, the key will not expire
+func (c *Client) SetAck(ctx context.Context, key string, value []byte, expires int64) error {
+	if expires < 0 {
+		return errors.New(errNegativeExpiry)
+	}
+	if key == "" {
+		return errors.New(errEmptyKey)
+	}
+	_, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:      protocol.OpSetAck,
+		Key:     key,
+		Value:   value,
+		Expires: expires,
+	})
+	return err
+}
+
+// SetAckTtl sets the value of the key, to expire after ttl,
+// and waits for the server to acknowledge
+//
+// The ttl is rounded up to milliseconds, & is relative to
+// when the server receives the msg. If ttl is 0, the key will
+// not expire. Requires protocol version 3.
+func (c *Client) SetAckTtl(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New(errNegativeExpiry)
+	}
+	if key == "" {
+		return errors.New(errEmptyKey)
+	}
+	if c.Version() < 3 {
+		return errors.New(errTtlVersion)
+	}
+	_, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:    protocol.OpSetAck,
+		Key:   key,
+		Value: value,
+		Ttl:   (ttl + time.Millisecond - 1).Milliseconds(),
+	})
+	return err
+}
+
+// Cas sets the value & expires properties of the key,
+// only if its current version equals the expected version
+//
+// An expected version of 0 means the key must not exist.
+// Returns the new version, or ErrConflict & the current version.
+// Versions are only sent by servers that negotiated
+// protocol version 2 or above, see Hello.
+func (c *Client) Cas(ctx context.Context, key string, value []byte, expires, expected int64) (int64, error) {
+	if expires < 0 {
+		return 0, errors.New(errNegativeExpiry)
+	}
+	if key == "" {
+		return 0, errors.New(errEmptyKey)
+	}
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:       protocol.OpCas,
+		Key:      key,
+		Value:    value,
+		Expires:  expires,
+		Modified: expected,
+	})
+	if resp == nil {
+		return 0, err
+	}
+	return resp.Modified, err
+}
+
+// Expire sets the key to expire after ttl, keeping its value
+//
+// The ttl is rounded up to milliseconds. Returns the key's
+// version, or ErrNotFound. Requires protocol version 3.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	if ttl <= 0 {
+		return 0, errors.New(errNoExpiry)
+	}
+	if c.Version() < 3 {
+		return 0, errors.New(errTtlVersion)
+	}
+	return c.expire(ctx, &protocol.Msg{
+		Op:  protocol.OpExpire,
+		Key: key,
+		Ttl: (ttl + time.Millisecond - 1).Milliseconds(),
+	})
+}
+
+// ExpireAt sets the expires time of the key, keeping its value
+//
+// Expires is in the unit of the protocol version, see Version.
+// Returns the key's version, or ErrNotFound.
+func (c *Client) ExpireAt(ctx context.Context, key string, expires int64) (int64, error) {
+	if expires <= 0 {
+		return 0, errors.New(errNoExpiry)
+	}
+	return c.expire(ctx, &protocol.Msg{
+		Op:      protocol.OpExpire,
+		Key:     key,
+		Expires: expires,
+	})
+}
+
+// Persist clears the expiry of the key, keeping its value
+//
+// Returns the key's version, or ErrNotFound.
+func (c *Client) Persist(ctx context.Context, key string) (int64, error) {
+	return c.expire(ctx, &protocol.Msg{
+		Op:  protocol.OpPersist,
+		Key: key,
+	})
+}
+
+func (c *Client) expire(ctx context.Context, msg *protocol.Msg) (int64, error) {
+	if msg.Key == "" {
+		return 0, errors.New(errEmptyKey)
+	}
+	resp, err := c.roundTrip(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Modified, nil
+}
+
+// Ttl returns the time until the key expires, without
+// transferring its value, or NoExpiry if it doesn't expire
+//
+// Returns ErrNotFound if the key doesn't exist.
+func (c *Client) Ttl(ctx context.Context, key string) (time.Duration, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:  protocol.OpTtl,
+		Key: key,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Value) != 8 {
+		return 0, errors.New(errUnexpectedResponse)
+	}
+	ttl := int64(binary.BigEndian.Uint64(resp.Value))
+	if ttl < 0 {
+		return NoExpiry, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// DelAck deletes the key,
+// and waits for the server to acknowledge
+func (c *Client) DelAck(ctx context.Context, key string) error {
+	_, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:  protocol.OpDelAck,
+		Key: key,
+	})
+	return err
+}
+
+// ListKeys returns all keys with the given prefix
+func (c *Client) ListKeys(ctx context.Context, keyPrefix string) ([]string, error) {
+	p, release, err := c.request(&protocol.Msg{
+		Op:  protocol.OpList,
+		Key: keyPrefix,
+	}, streamBuffer)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	keys := make([]string, 0)
+	for {
+		resp, err := p.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status == protocol.StatusStreamEnd {
+			return keys, nil
+		}
+		// before protocol version 2, keys have no status
+		if resp.Status != 0 {
+			err = statusErr(resp.Status)
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, resp.Key)
+	}
+}
+
+// CountKeys returns the number of keys with the given prefix
+func (c *Client) CountKeys(ctx context.Context, keyPrefix string) (uint64, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:  protocol.OpCount,
+		Key: keyPrefix,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Value) < 8 {
+		return 0, errors.New(errUnexpectedResponse)
+	}
+	return binary.BigEndian.Uint64(resp.Value), nil
+}
+
+// Incr atomically adds delta to the int64 value of the key,
+// and returns the new value
+//
+// A missing key is created with a value of delta.
+// If expires is not 0, the key's expiry is set.
+// Returns ErrServer if the value is not a 64-bit integer,
+// or if the result would overflow.
+func (c *Client) Incr(ctx context.Context, key string, delta, expires int64) (int64, error) {
+	return c.incr(ctx, protocol.OpIncr, key, delta, expires)
+}
+
+// Decr atomically subtracts delta from the int64 value of the key,
+// and returns the new value
+//
+// See Incr.
+func (c *Client) Decr(ctx context.Context, key string, delta, expires int64) (int64, error) {
+	return c.incr(ctx, protocol.OpDecr, key, delta, expires)
+}
+
+func (c *Client) incr(ctx context.Context, op byte, key string, delta, expires int64) (int64, error) {
+	if expires < 0 {
+		return 0, errors.New(errNegativeExpiry)
+	}
+	if key == "" {
+		return 0, errors.New(errEmptyKey)
+	}
+	deltaBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(deltaBytes, uint64(delta))
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:      op,
+		Key:     key,
+		Value:   deltaBytes,
+		Expires: expires,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Value) < 8 {
+		return 0, errors.New(errUnexpectedResponse)
+	}
+	return int64(binary.BigEndian.Uint64(resp.Value)), nil
+}
+
+// MGet returns an entry for each key, in the same order
+//
+// Entries of found keys have status OK,
+// others have status NotFound.
+func (c *Client) MGet(ctx context.Context, keys []string) ([]protocol.Entry, error) {
+	entries := make([]protocol.Entry, len(keys))
+	for i, key := range keys {
+		entries[i].Key = key
+	}
+	return c.batch(ctx, protocol.OpMGet, entries)
+}
+
+// MSet sets the value & expires properties of each entry,
+// and returns the new version of each
+func (c *Client) MSet(ctx context.Context, entries []protocol.Entry) ([]int64, error) {
+	for _, e := range entries {
+		if e.Expires < 0 {
+			return nil, errors.New(errNegativeExpiry)
+		}
+		if e.Key == "" {
+			return nil, errors.New(errEmptyKey)
+		}
+	}
+	results, err := c.batch(ctx, protocol.OpMSet, entries)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int64, len(results))
+	for i, e := range results {
+		versions[i] = e.Modified
+	}
+	return versions, nil
+}
+
+// MDel deletes each key,
+// and returns whether it existed
+func (c *Client) MDel(ctx context.Context, keys []string) ([]bool, error) {
+	entries := make([]protocol.Entry, len(keys))
+	for i, key := range keys {
+		entries[i].Key = key
+	}
+	results, err := c.batch(ctx, protocol.OpMDel, entries)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]bool, len(results))
+	for i, e := range results {
+		found[i] = e.Status == protocol.StatusOk
+	}
+	return found, nil
+}
+
+// batch sends the entries in a single msg,
+// and returns the result entries
+func (c *Client) batch(ctx context.Context, op byte, entries []protocol.Entry) ([]protocol.Entry, error) {
+	value, err := protocol.EncodeBatch(entries)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:    op,
+		Value: value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	results, err := protocol.DecodeBatch(resp.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(entries) {
+		return nil, errors.New(errUnexpectedResponse)
+	}
+	return results, nil
+}
+
+// Txn applies the entries atomically, and returns
+// a result entry for each, in the same order
+//
+// The op of each entry is one of:
+//   - protocol.OpGet: check that the version equals Modified
+//   - protocol.OpSet: set value & expires
+//   - protocol.OpCas: check, then set
+//   - protocol.OpDel: delete
+//
+// A Modified of 0 means the key must not exist.
+// Checks see the state before the transaction.
+//
+// If any check fails, nothing is applied, and ErrConflict
+// is returned with the results. Failed entries have
+// status Conflict. Each result has the key's version.
+func (c *Client) Txn(ctx context.Context, entries []protocol.Entry) ([]protocol.Entry, error) {
+	value, err := protocol.EncodeBatch(entries)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op:    protocol.OpTxn,
+		Value: value,
+	})
+	if err != nil && err != ErrConflict {
+		return nil, err
+	}
+	results, decodeErr := protocol.DecodeBatch(resp.Value)
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+	return results, err
+}
+
+// Watch subscribes to changes of keys with the prefix
+//
+// Each change is received as a msg with op Set, Del or Expired,
+// the key, and for Set & Expired, the value & expires time.
+// The watch ends when ctx is done, or when the server ends it.
+// In the latter case, a final msg with op Watch is received,
+// with status Error if the server or client dropped events
+// because they were not read fast enough. The chan is then closed.
+func (c *Client) Watch(ctx context.Context, prefix string) (<-chan protocol.Msg, error) {
+	return c.watch(ctx, &protocol.Msg{
+		Op:  protocol.OpWatch,
+		Key: prefix,
+	})
+}
+
+// WatchExpired subscribes to expiry of keys with the prefix
+//
+// Each expired key is received as a msg with op Expired, the key,
+// expires time, & if withValue is true, the last value. Keys are
+// received once deleted, within the server's expiry period of
+// their expires time. Expiries while not watching are missed.
+// The watch ends as for Watch, with a final msg of op WatchExpired.
+func (c *Client) WatchExpired(ctx context.Context, prefix string, withValue bool) (<-chan protocol.Msg, error) {
+	msg := &protocol.Msg{
+		Op:  protocol.OpWatchExpired,
+		Key: prefix,
+	}
+	if withValue {
+		msg.Value = []byte{1}
+	}
+	return c.watch(ctx, msg)
+}
+
+// watch sends the watch msg, & forwards events until
+// ctx is done, or the final msg of the msg's op
+func (c *Client) watch(ctx context.Context, msg *protocol.Msg) (<-chan protocol.Msg, error) {
+	p, release, err := c.request(msg, watchBuffer)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.next(ctx)
+	if err == nil {
+		err = statusErr(resp.Status)
+	}
+	if err != nil {
+		release()
+		return nil, err
+	}
+	events := make(chan protocol.Msg)
+	go func() {
+		defer close(events)
+		defer release()
+		for {
+			select {
+			case <-ctx.Done():
+				c.unwatch(msg.ReqId)
+				return
+			case m, ok := <-p.msgs:
+				if !ok {
+					if p.err() == ErrOverflow {
+						c.unwatch(msg.ReqId)
+						m = protocol.Msg{
+							Op:     msg.Op,
+							Status: protocol.StatusError,
+							Key:    msg.Key,
+						}
+						select {
+						case events <- m:
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+				select {
+				case events <- m:
+				case <-ctx.Done():
+					c.unwatch(msg.ReqId)
+					return
+				}
+				if m.Op == msg.Op {
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// unwatch tells the server to end the watch,
+// without waiting for the response
+func (c *Client) unwatch(watchReqId uint32) error {
+	value := make([]byte, 4)
+	binary.BigEndian.PutUint32(value, watchReqId)
+	return c.Send(&protocol.Msg{
+		Op:    protocol.OpUnwatch,
+		ReqId: c.nextSyncReqId(),
+		Value: value,
+	})
+}
+
+// Reshard starts moving all keys to a new layout with
+// the given number of segments, without downtime
+//
+// Returns ErrConflict if resharding is in progress.
+func (c *Client) Reshard(ctx context.Context, segments uint32) error {
+	_, err := c.roundTrip(ctx, protocol.EncodeReshard(segments))
+	return err
+}
+
+// ReshardProgress returns the progress of the current
+// or last resharding, or ErrNotFound if there was none
+func (c *Client) ReshardProgress(ctx context.Context) (*protocol.ReshardProgress, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op: protocol.OpReshardStatus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeReshardProgress(resp.Value)
+}
+
+// Stats returns the counters of the store,
+// such as memory used & keys evicted
+func (c *Client) Stats(ctx context.Context) (*protocol.Stats, error) {
+	resp, err := c.roundTrip(ctx, &protocol.Msg{
+		Op: protocol.OpStats,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return protocol.DecodeStats(resp.Value)
+}
+
+// Replicate applies the entries as writes from a leader,
+// keeping their versions
+//
+// The op of each entry is protocol.OpSet or protocol.OpDel.
+// Modified is the version of the write or delete, and is
+// skipped by the server if the key's slot is newer.
+// Used by servers to replicate to followers.
+func (c *Client) Replicate(ctx context.Context, entries []protocol.Entry) error {
+	value, err := protocol.EncodeBatch(entries)
+	if err != nil {
+		return err
+	}
+	_, err = c.roundTrip(ctx, &protocol.Msg{
+		Op:    protocol.OpRepl,
+		Value: value,
+	})
+	return err
+}
+
+// Snapshot streams a consistent archive of the dataset to w,
+// as restored by store.Restore
+//
+// Requires length-prefixed framing.
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) error {
+	if c.framing != protocol.FramingLenPrefix {
+		return errors.New(errSnapshotFraming)
+	}
+	p, release, err := c.request(&protocol.Msg{
+		Op: protocol.OpSnapshot,
+	}, streamBuffer)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for {
+		resp, err := p.next(ctx)
+		if err != nil {
+			return err
+		}
+		if resp.Status == protocol.StatusStreamEnd {
+			return nil
+		}
+		err = statusErr(resp.Status)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(resp.Value)
+		if err != nil {
+			return err
+		}
+	}
+}
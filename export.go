@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/client"
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/store"
+	"github.com/spf13/viper"
+)
+
+// Number of records per MSet when importing to a server
+const importBatchSize = 100
+
+// runExport writes every key as JSON lines to a file,
+// from the configured dir, or from the running server
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fromServer := fs.Bool("server", false, "read from the running server, instead of dir")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.Arg(0) == "" {
+		return errors.New("usage: rocketkv export [-server] <file>")
+	}
+	f, err := os.Create(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var count int
+	if *fromServer {
+		count, err = exportServer(f)
+	} else {
+		count, err = store.ExportDir(viper.GetString(cfg.DIR), f)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported %v keys to %s\r\n", count, fs.Arg(0))
+	return f.Sync()
+}
+
+// exportServer lists all keys of the running server,
+// & writes each with its value & metadata to w
+//
+// Keys deleted after listing are skipped.
+func exportServer(w io.Writer) (int, error) {
+	c, err := dialServer()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	ctx := context.Background()
+	keys, err := c.ListKeys(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	count := 0
+	for _, key := range keys {
+		value, meta, err := c.GetValue(ctx, key)
+		if err == client.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		err = enc.Encode(&store.ExportRecord{
+			Key:      key,
+			Value:    value,
+			Expires:  meta.Expires,
+			Modified: meta.Modified,
+		})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// runImport reads JSON lines from a file into
+// the configured dir, or into the running server
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	toServer := fs.Bool("server", false, "write to the running server, instead of dir")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.Arg(0) == "" {
+		return errors.New("usage: rocketkv import [-server] <file>")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var count int
+	if *toServer {
+		count, err = importServer(f)
+	} else {
+		count, err = store.ImportDir(f, viper.GetString(cfg.DIR), viper.GetString(cfg.ENGINE), viper.GetInt(cfg.SEGMENTS))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %v keys from %s\r\n", count, fs.Arg(0))
+	return nil
+}
+
+// importServer sets each record of r on the running server,
+// in batches
+//
+// The server gives each key a new version.
+func importServer(r io.Reader) (int, error) {
+	c, err := dialServer()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if !c.HasCap(protocol.CapBatch) {
+		return 0, errors.New("server does not support batches")
+	}
+	ctx := context.Background()
+	dec := json.NewDecoder(bufio.NewReader(r))
+	batch := make([]protocol.Entry, 0, importBatchSize)
+	count := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := c.MSet(ctx, batch)
+		count += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	for {
+		rec := store.ExportRecord{}
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		batch = append(batch, protocol.Entry{
+			Op:      protocol.OpSet,
+			Key:     rec.Key,
+			Value:   rec.Value,
+			Expires: store.ExpiresMillis(rec.Expires),
+		})
+		if len(batch) == importBatchSize {
+			err = flush()
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, flush()
+}
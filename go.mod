@@ -1,6 +1,6 @@
 module github.com/intob/rocketkv
 
-go 1.17
+go 1.18
 
 require github.com/spf13/viper v1.10.1
 
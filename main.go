@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -13,17 +14,43 @@ import (
 	"github.com/spf13/viper"
 )
 
+// Set using ldflags, see Makefile
+var Version = "dev"
+var Build string
+
+// buildName identifies the build in a hello,
+// as the version & build time, if set
+func buildName() string {
+	if Build == "" {
+		return Version
+	}
+	return fmt.Sprintf("%s (%s)", Version, Build)
+}
+
 func main() {
 	cfg.InitConfig()
+	fmt.Printf("rocketkv %s, built %s\r\n", Version, Build)
+
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	st := store.NewStore()
+	st, err := store.NewStore(buildName())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	network := viper.GetString(cfg.NETWORK)
 	addr := viper.GetString(cfg.ADDRESS)
 	cert := viper.GetString(cfg.TLS_CERT)
 	key := viper.GetString(cfg.TLS_KEY)
 	var listener net.Listener
-	var err error
 	if cert != "" {
 		listener, err = util.GetListenerWithTLS(network, addr, cert, key)
 	} else {
@@ -49,13 +76,33 @@ func main() {
 	}
 }
 
+// runCommand runs the named subcommand, instead of the server
+func runCommand(name string, args []string) error {
+	var arg string
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	switch name {
+	case "snapshot":
+		return runSnapshot(arg)
+	case "restore":
+		return runRestore(arg)
+	case "export":
+		return runExport(args)
+	case "import":
+		return runImport(args)
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+}
+
 func waitForSigInt(listener net.Listener, st *store.Store, dir string) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	for range c {
 		fmt.Println("will exit cleanly")
 		listener.Close()
-		st.WriteAllBlocks(dir)
+		st.Checkpoint(dir)
 		os.Exit(0)
 	}
 }
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+const ErrBatchLen = "batch does not meet length requirements"
+
+// Fixed length of an encoded entry, excluding key & value
+const ENTRY_LEN_MIN = 24
+
+// A single key of a batch
+//
+// In a request, Status is ignored.
+// In a response, Status is the result for the key.
+// Op is only used by transactions & replication.
+type Entry struct {
+	Op       byte
+	Status   byte
+	Key      string
+	Value    []byte
+	Expires  int64
+	Modified int64
+}
+
+// Serializes the given entries,
+// to be sent as the value of a batch msg
+//
+// | OP | STATUS | KEY LEN UINT16 | EXPIRES INT64 | MODIFIED INT64 | VALUE LEN UINT32 | KEY | VALUE |
+// preceded by the entry count as UINT32.
+func EncodeBatch(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	head := make([]byte, ENTRY_LEN_MIN)
+	binary.BigEndian.PutUint32(head, uint32(len(entries)))
+	buf.Write(head[:4])
+	for _, e := range entries {
+		if len(e.Key) > KEY_LEN_MAX {
+			return nil, errors.New(ErrMsgKeyTooLong)
+		}
+		head[0] = e.Op
+		head[1] = e.Status
+		binary.BigEndian.PutUint16(head[2:], uint16(len(e.Key)))
+		binary.BigEndian.PutUint64(head[4:], uint64(e.Expires))
+		binary.BigEndian.PutUint64(head[12:], uint64(e.Modified))
+		binary.BigEndian.PutUint32(head[20:], uint32(len(e.Value)))
+		buf.Write(head)
+		buf.WriteString(e.Key)
+		buf.Write(e.Value)
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserializes the value of a batch msg
+//
+// Values are copied, so b may be reused.
+func DecodeBatch(b []byte) ([]Entry, error) {
+	if len(b) < 4 {
+		return nil, errors.New(ErrBatchLen)
+	}
+	count := int(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	// each entry needs at least ENTRY_LEN_MIN bytes,
+	// so don't trust count for allocation
+	if count > len(b)/ENTRY_LEN_MIN {
+		return nil, errors.New(ErrBatchLen)
+	}
+	entries := make([]Entry, count)
+	for i := range entries {
+		if len(b) < ENTRY_LEN_MIN {
+			return nil, errors.New(ErrBatchLen)
+		}
+		keyLen := int(binary.BigEndian.Uint16(b[2:]))
+		valueLen := int(binary.BigEndian.Uint32(b[20:]))
+		end := ENTRY_LEN_MIN + keyLen + valueLen
+		if valueLen > len(b) || end > len(b) {
+			return nil, errors.New(ErrBatchLen)
+		}
+		e := &entries[i]
+		e.Op = b[0]
+		e.Status = b[1]
+		e.Expires = int64(binary.BigEndian.Uint64(b[4:]))
+		e.Modified = int64(binary.BigEndian.Uint64(b[12:]))
+		e.Key = string(b[ENTRY_LEN_MIN : ENTRY_LEN_MIN+keyLen])
+		if valueLen > 0 {
+			e.Value = make([]byte, valueLen)
+			copy(e.Value, b[ENTRY_LEN_MIN+keyLen:end])
+		}
+		b = b[end:]
+	}
+	return entries, nil
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBatchEncodeDecode(t *testing.T) {
+	entries := []Entry{
+		{Key: "coffee", Value: []byte("beans"), Expires: 1646000000},
+		{Status: StatusNotFound, Key: "tea"},
+		{Op: OpCas, Status: StatusOk, Key: "ns/+END", Value: []byte("+END"), Modified: 42},
+	}
+	enc, err := EncodeBatch(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeBatch(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.FailNow()
+	}
+	for i, e := range entries {
+		g := got[i]
+		if g.Op != e.Op || g.Status != e.Status || g.Key != e.Key || !bytes.Equal(g.Value, e.Value) ||
+			g.Expires != e.Expires || g.Modified != e.Modified {
+			t.Fatalf("expected %+v, got %+v", e, g)
+		}
+	}
+
+	// truncated input must not decode
+	_, err = DecodeBatch(enc[:len(enc)-1])
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+func FuzzDecodeBatch(f *testing.F) {
+	enc, _ := EncodeBatch([]Entry{{Key: "a", Value: []byte("b")}})
+	f.Add(enc)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// must not panic
+		DecodeBatch(b)
+	})
+}
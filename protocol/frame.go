@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+)
+
+const ErrFramingUnknown = "unknown framing mode"
+
+// Sent by a client as the first byte of a connection
+// to request a framing mode other than +END.
+//
+// The next byte is the requested Framing.
+// No op code uses this value, so a server can
+// safely peek at the first byte of a connection.
+const FRAMING_PREAMBLE byte = 0xFF
+
+// Length of the big endian uint32 prefix
+const LEN_PREFIX_LEN = 4
+
+// Determines how messages are delimited on a connection
+type Framing byte
+
+const (
+	FramingPlusEnd   Framing = 0x00 // msg is followed by +END (default)
+	FramingLenPrefix Framing = 0x01 // msg is preceded by its uint32 length
+)
+
+// Valid returns true if the framing mode is known
+func (f Framing) Valid() bool {
+	return f == FramingPlusEnd || f == FramingLenPrefix
+}
+
+// SplitFunc returns the scanner split func for the framing mode
+func (f Framing) SplitFunc() bufio.SplitFunc {
+	if f == FramingLenPrefix {
+		return SplitLenPrefix
+	}
+	return SplitPlusEnd
+}
+
+// Frame delimits the given encoded msg
+func (f Framing) Frame(enc []byte) []byte {
+	if f == FramingLenPrefix {
+		framed := make([]byte, LEN_PREFIX_LEN+len(enc))
+		binary.BigEndian.PutUint32(framed, uint32(len(enc)))
+		copy(framed[LEN_PREFIX_LEN:], enc)
+		return framed
+	}
+	return append(enc, SPLIT_MARKER...)
+}
+
+// Preamble returns the bytes a client must send
+// before any msg to use this framing mode
+//
+// FramingPlusEnd has no preamble.
+func (f Framing) Preamble() []byte {
+	if f == FramingPlusEnd {
+		return nil
+	}
+	return []byte{FRAMING_PREAMBLE, byte(f)}
+}
+
+// ReadFraming reads the optional framing preamble
+// from the start of a connection
+//
+// If the first byte is not FRAMING_PREAMBLE,
+// nothing is consumed & FramingPlusEnd is returned.
+func ReadFraming(r *bufio.Reader) (Framing, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return FramingPlusEnd, err
+	}
+	if first[0] != FRAMING_PREAMBLE {
+		return FramingPlusEnd, nil
+	}
+	_, err = r.Discard(1)
+	if err != nil {
+		return FramingPlusEnd, err
+	}
+	mode, err := r.ReadByte()
+	if err != nil {
+		return FramingPlusEnd, err
+	}
+	f := Framing(mode)
+	if !f.Valid() {
+		return f, errors.New(ErrFramingUnknown)
+	}
+	return f, nil
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const ErrHelloLen = "hello value does not meet length requirements"
+
+// Version of the wire protocol implemented by this package
+//
+// Incremented when the msg format changes in a way
+// that peers must agree on.
+//
+// Version 2 adds header flags & the optional Modified field,
+// & gives the keys of a List status OK, instead of 0.
+// Version 3 gives Expires in milliseconds, & adds the optional Ttl field.
+const PROTOCOL_VERSION uint16 = 3
+
+const HELLO_LEN = 10
+const HELLO_LEN_MSG_LEN = 14 // with the optional MsgLenMax
+
+// Capability bits, exchanged in a hello
+const (
+	CapLenPrefix uint64 = 1 << 0  // length-prefixed framing
+	CapReqId     uint64 = 1 << 1  // request ids are echoed in responses
+	CapCas       uint64 = 1 << 2  // compare-and-swap op
+	CapCounters  uint64 = 1 << 3  // incr & decr ops
+	CapBatch     uint64 = 1 << 4  // mget, mset & mdel ops
+	CapTxn       uint64 = 1 << 5  // multi-key transactions
+	CapWatch     uint64 = 1 << 6  // key change events
+	CapReshard   uint64 = 1 << 7  // online resharding
+	CapSnapshot  uint64 = 1 << 8  // snapshot archives
+	CapStats     uint64 = 1 << 9  // stats op
+	CapExpire    uint64 = 1 << 10 // expire, persist & ttl ops
+	CapExpired   uint64 = 1 << 11 // expiry notifications
+	CapRepl      uint64 = 1 << 12 // replication from a leader
+)
+
+// All capabilities implemented by this package
+const CAPS = CapLenPrefix | CapReqId | CapCas | CapCounters | CapBatch | CapTxn |
+	CapWatch | CapReshard | CapSnapshot | CapStats | CapExpire | CapExpired | CapRepl
+
+// Hello describes a peer's protocol version & capabilities
+//
+// In a response, Version & Caps are the negotiated
+// values supported by both peers.
+//
+// MsgLenMax is the length of the longest msg the peer reads,
+// or 0 if not given. Peers of earlier builds don't send it.
+type Hello struct {
+	Version   uint16
+	Caps      uint64
+	Build     string
+	MsgLenMax uint32
+}
+
+// HasCap returns true if all of the given capability bits are set
+func (h *Hello) HasCap(cap uint64) bool {
+	return h.Caps&cap == cap
+}
+
+// Negotiate returns the hello that both peers support
+func (h *Hello) Negotiate(peer *Hello) *Hello {
+	version := h.Version
+	if peer.Version < version {
+		version = peer.Version
+	}
+	return &Hello{
+		Version:   version,
+		Caps:      h.Caps & peer.Caps,
+		Build:     h.Build,
+		MsgLenMax: h.MsgLenMax,
+	}
+}
+
+// EncodeHello returns a msg with the given op & status
+// that carries the hello
+//
+// The build is sent as the key, the version, caps
+// & MsgLenMax, if not 0, as the value.
+func EncodeHello(h *Hello, op, status byte) *Msg {
+	value := make([]byte, HELLO_LEN)
+	if h.MsgLenMax > 0 {
+		value = make([]byte, HELLO_LEN_MSG_LEN)
+		binary.BigEndian.PutUint32(value[HELLO_LEN:], h.MsgLenMax)
+	}
+	binary.BigEndian.PutUint16(value, h.Version)
+	binary.BigEndian.PutUint64(value[2:], h.Caps)
+	return &Msg{
+		Op:     op,
+		Status: status,
+		Key:    h.Build,
+		Value:  value,
+	}
+}
+
+// DecodeHello reads a hello from the given msg
+func DecodeHello(msg *Msg) (*Hello, error) {
+	if len(msg.Value) < HELLO_LEN {
+		return nil, errors.New(ErrHelloLen)
+	}
+	h := &Hello{
+		Version: binary.BigEndian.Uint16(msg.Value),
+		Caps:    binary.BigEndian.Uint64(msg.Value[2:]),
+		Build:   msg.Key,
+	}
+	if len(msg.Value) >= HELLO_LEN_MSG_LEN {
+		h.MsgLenMax = binary.BigEndian.Uint32(msg.Value[HELLO_LEN:])
+	}
+	return h, nil
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import "testing"
+
+func TestHelloEncodeDecode(t *testing.T) {
+	h := &Hello{
+		Version: PROTOCOL_VERSION,
+		Caps:    CAPS,
+		Build:   "v1.2.3",
+	}
+	msg := EncodeHello(h, OpHello, StatusOk)
+	got, err := DecodeHello(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *h {
+		t.Fatalf("expected %+v, got %+v", h, got)
+	}
+}
+
+func TestHelloNegotiate(t *testing.T) {
+	server := &Hello{Version: 3, Caps: 0b1011, Build: "server"}
+	client := &Hello{Version: 2, Caps: 0b0110}
+	got := server.Negotiate(client)
+	if got.Version != 2 || got.Caps != 0b0010 || got.Build != "server" {
+		t.Fatalf("unexpected negotiation result %+v", got)
+	}
+}
+
+// Tests that MsgLenMax is optional
+func TestHelloMsgLenMax(t *testing.T) {
+	h := &Hello{Version: PROTOCOL_VERSION, MsgLenMax: 512}
+	msg := EncodeHello(h, OpHello, StatusOk)
+	got, err := DecodeHello(msg)
+	if err != nil || got.MsgLenMax != 512 {
+		t.Fatalf("expected MsgLenMax 512, got %+v, %v", got, err)
+	}
+	msg.Value = msg.Value[:HELLO_LEN]
+	got, err = DecodeHello(msg)
+	if err != nil || got.MsgLenMax != 0 {
+		t.Fatalf("expected no MsgLenMax, got %+v, %v", got, err)
+	}
+}
@@ -8,21 +8,47 @@ import (
 
 const ErrMsgLen = "msg does not meet length requirements"
 const ErrMsgKeyLen = "msg key len field is greater than remaining msg len"
+const ErrMsgKeyTooLong = "msg key is longer than max key len"
 
 const MSG_LEN_MIN = 22
+const KEY_LEN_MAX = 0xFFFF
+
+// Header flags, indicating optional fields
+// that follow the fixed-length header
+const (
+	FlagModified uint16 = 1 << 0 // 8 byte Modified follows
+	FlagTtl      uint16 = 1 << 1 // 8 byte Ttl follows
+)
 
 // Msg body for normal ops
+//
+// ReqId is optional, if not 0 it is echoed
+// in every response to the msg.
+//
+// Modified is optional, it is only encoded if not 0.
+// Peers that negotiated a protocol version below 2
+// must not send it.
+//
+// Expires is in Unix milliseconds for peers that negotiated
+// protocol version 3 or above, otherwise in Unix seconds.
+// Ttl is optional, in milliseconds from receipt of the msg.
+// If not 0, it is sent instead of Expires.
 type Msg struct {
 	Op       byte
 	Status   byte
+	ReqId    uint32
 	Key      string
 	Value    []byte
 	Expires  int64
 	Modified int64
+	Ttl      int64
 }
 
 // Deserializes the given byte slice,
 // and returns a pointer to Msg or an error
+//
+// The framing (split marker or length prefix)
+// must already be stripped.
 func DecodeMsg(b []byte) (*Msg, error) {
 	msg := &Msg{}
 
@@ -33,25 +59,49 @@ func DecodeMsg(b []byte) (*Msg, error) {
 	msg.Op = b[0]
 	msg.Status = b[1]
 
-	msg.Expires = int64(binary.BigEndian.Uint64(b[2:18]))
+	msg.Expires = int64(binary.BigEndian.Uint64(b[2:10]))
+	msg.ReqId = binary.BigEndian.Uint32(b[10:14])
 
-	keyLen := int(binary.BigEndian.Uint16(b[18:22]))
-	keyEnd := 22 + keyLen
+	keyLen := int(binary.BigEndian.Uint16(b[18:20]))
+	flags := binary.BigEndian.Uint16(b[20:22])
+	keyStart := MSG_LEN_MIN
+
+	if flags&FlagModified != 0 {
+		if keyStart+8 > len(b) {
+			return nil, errors.New(ErrMsgLen)
+		}
+		msg.Modified = int64(binary.BigEndian.Uint64(b[keyStart:]))
+		keyStart += 8
+	}
+	if flags&FlagTtl != 0 {
+		if keyStart+8 > len(b) {
+			return nil, errors.New(ErrMsgLen)
+		}
+		msg.Ttl = int64(binary.BigEndian.Uint64(b[keyStart:]))
+		keyStart += 8
+	}
 
+	keyEnd := keyStart + keyLen
 	if keyLen > 0 {
 		if keyEnd > len(b) {
 			return nil, errors.New(ErrMsgKeyLen)
 		}
-		msg.Key = string(b[22:keyEnd])
+		msg.Key = string(b[keyStart:keyEnd])
 	}
 
-	// +END is already stripped by scanner split func
-	msg.Value = b[keyEnd:]
+	// copy, as b is usually a scanner's buffer
+	if keyEnd < len(b) {
+		msg.Value = make([]byte, len(b)-keyEnd)
+		copy(msg.Value, b[keyEnd:])
+	}
 
 	return msg, nil
 }
 
 // Serializes the given Msg
+//
+// The result is not framed, use Framing.Frame
+// before writing it to a connection.
 func EncodeMsg(msg *Msg) ([]byte, error) {
 	var buf bytes.Buffer
 
@@ -64,11 +114,12 @@ func EncodeMsg(msg *Msg) ([]byte, error) {
 		return nil, err
 	}
 
-	// Expires
+	// Expires, ReqId & 4 reserved bytes
 	expBytes := make([]byte, 16)
 	if msg.Expires > 0 {
 		binary.BigEndian.PutUint64(expBytes, uint64(msg.Expires))
 	}
+	binary.BigEndian.PutUint32(expBytes[8:], msg.ReqId)
 	_, err = buf.Write(expBytes)
 	if err != nil {
 		return nil, err
@@ -76,17 +127,44 @@ func EncodeMsg(msg *Msg) ([]byte, error) {
 
 	keyBytes := []byte(msg.Key)
 
-	// Key len
 	keyLen := len(keyBytes)
-	keyLenBytes := make([]byte, 4)
-	if keyLen > 0 {
-		binary.BigEndian.PutUint16(keyLenBytes, uint16(keyLen))
+	if keyLen > KEY_LEN_MAX {
+		return nil, errors.New(ErrMsgKeyTooLong)
 	}
+	// Key len & flags
+	var flags uint16
+	if msg.Modified != 0 {
+		flags |= FlagModified
+	}
+	if msg.Ttl != 0 {
+		flags |= FlagTtl
+	}
+	keyLenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint16(keyLenBytes, uint16(keyLen))
+	binary.BigEndian.PutUint16(keyLenBytes[2:], flags)
 	_, err = buf.Write(keyLenBytes)
 	if err != nil {
 		return nil, err
 	}
 
+	// Optional fields
+	if flags&FlagModified != 0 {
+		modBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(modBytes, uint64(msg.Modified))
+		_, err = buf.Write(modBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if flags&FlagTtl != 0 {
+		ttlBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(ttlBytes, uint64(msg.Ttl))
+		_, err = buf.Write(ttlBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Key
 	if keyLen > 0 {
 		_, err = buf.Write(keyBytes)
@@ -103,12 +181,5 @@ func EncodeMsg(msg *Msg) ([]byte, error) {
 		}
 	}
 
-	// Append split marker using same buffer
-	// This will be stripped by the split func
-	_, err = buf.Write([]byte{'+', 'E', 'N', 'D'})
-	if err != nil {
-		return nil, err
-	}
-
 	return buf.Bytes(), nil
 }
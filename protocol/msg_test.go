@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// Tests that any msg survives encoding, framing,
+// splitting & decoding, for both framing modes
+func FuzzEncodeDecodeMsg(f *testing.F) {
+	f.Add(OpSet, StatusOk, uint32(0), int64(0), int64(0), int64(0), "coffee", []byte("beans"))
+	f.Add(OpSet, StatusOk, uint32(1), int64(1646000000000), int64(3), int64(0), "a/b/c", []byte("+END"))
+	f.Add(OpSetAck, StatusOk, uint32(2), int64(0), int64(0), int64(1500), "session", []byte("token"))
+	f.Add(OpGet, StatusNotFound, uint32(0xFFFFFFFF), int64(-1), int64(-1), int64(-1), "+END", []byte{})
+	f.Add(OpList, StatusStreamEnd, uint32(7), int64(0), int64(0), int64(0), "", []byte{0, 0, 0, 0, '+', 'E', 'N'})
+	f.Fuzz(func(t *testing.T, op, status byte, reqId uint32, expires, modified, ttl int64, key string, value []byte) {
+		if len(key) > KEY_LEN_MAX {
+			t.Skip()
+		}
+		msg := &Msg{
+			Op:       op,
+			Status:   status,
+			ReqId:    reqId,
+			Key:      key,
+			Value:    value,
+			Expires:  expires,
+			Modified: modified,
+			Ttl:      ttl,
+		}
+		enc, err := EncodeMsg(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dec, err := DecodeMsg(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertMsgEqual(t, msg, dec)
+
+		// length prefix must split any bytes correctly
+		var buf bytes.Buffer
+		buf.Write(FramingLenPrefix.Frame(enc))
+		buf.Write(FramingLenPrefix.Frame(enc))
+		s := bufio.NewScanner(&buf)
+		s.Split(FramingLenPrefix.SplitFunc())
+		count := 0
+		for s.Scan() {
+			dec, err := DecodeMsg(s.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertMsgEqual(t, msg, dec)
+			count++
+		}
+		if s.Err() != nil || count != 2 {
+			t.Fatalf("expected 2 msgs, got %v, err: %v", count, s.Err())
+		}
+	})
+}
+
+func TestEncodeKeyTooLong(t *testing.T) {
+	_, err := EncodeMsg(&Msg{
+		Key: string(make([]byte, KEY_LEN_MAX+1)),
+	})
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+func assertMsgEqual(t *testing.T, exp, got *Msg) {
+	t.Helper()
+	expires := exp.Expires
+	if expires < 0 {
+		// negative expiry is not encoded
+		expires = 0
+	}
+	if got.Op != exp.Op || got.Status != exp.Status || got.ReqId != exp.ReqId ||
+		got.Key != exp.Key || got.Expires != expires || got.Modified != exp.Modified || got.Ttl != exp.Ttl ||
+		!bytes.Equal(got.Value, exp.Value) {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+}
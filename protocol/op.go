@@ -1,17 +1,38 @@
 package protocol
 
 const (
-	OpClose  byte = 0x01 // close connection
-	OpAuth   byte = 0x02 // authenticate
-	OpPing   byte = 0x10 // ping server, responds with pong
-	OpPong   byte = 0x11 // response to ping
-	OpGet    byte = 0x20 // get value for given key
-	OpSet    byte = 0x30 // set value of given key
-	OpSetAck byte = 0x31 // set with OK response
-	OpDel    byte = 0x40 // delete given key
-	OpDelAck byte = 0x41 // delete with OK response
-	OpList   byte = 0x50 // stream list of keys with prefix
-	OpCount  byte = 0x60 // count keys with prefix
+	OpClose         byte = 0x01 // close connection
+	OpAuth          byte = 0x02 // authenticate
+	OpHello         byte = 0x03 // exchange protocol version & capabilities
+	OpPing          byte = 0x10 // ping server, responds with pong
+	OpPong          byte = 0x11 // response to ping
+	OpGet           byte = 0x20 // get value for given key
+	OpMGet          byte = 0x21 // get values for a batch of keys
+	OpTtl           byte = 0x22 // get remaining ttl of given key, without the value
+	OpSet           byte = 0x30 // set value of given key
+	OpSetAck        byte = 0x31 // set with OK response
+	OpCas           byte = 0x32 // set if version matches, responds with status
+	OpMSet          byte = 0x33 // set a batch of keys, responds with versions
+	OpExpire        byte = 0x34 // set expiry of given key, keeping its value
+	OpPersist       byte = 0x35 // clear expiry of given key
+	OpDel           byte = 0x40 // delete given key
+	OpDelAck        byte = 0x41 // delete with OK response
+	OpMDel          byte = 0x42 // delete a batch of keys, responds with statuses
+	OpExpired       byte = 0x43 // key expired, only sent in events
+	OpEvicted       byte = 0x44 // key evicted to free memory, only sent in events
+	OpList          byte = 0x50 // stream list of keys with prefix
+	OpCount         byte = 0x60 // count keys with prefix
+	OpIncr          byte = 0x70 // add delta to int64 value, responds with result
+	OpDecr          byte = 0x71 // subtract delta from int64 value, responds with result
+	OpTxn           byte = 0x80 // apply a batch of checks & writes atomically
+	OpWatch         byte = 0x90 // stream events for keys with prefix
+	OpUnwatch       byte = 0x91 // end the watch with the req id given as value
+	OpWatchExpired  byte = 0x92 // stream expired keys with prefix, with last value if value is 1
+	OpReshard       byte = 0xA0 // start online resharding to the segments given as value
+	OpReshardStatus byte = 0xA1 // get progress of online resharding
+	OpSnapshot      byte = 0xA2 // stream a snapshot archive
+	OpStats         byte = 0xA3 // get counters of the store
+	OpRepl          byte = 0xB0 // apply a batch of replicated writes & deletes, keeping their versions
 )
 
 // Map of string labels for op codes
@@ -20,15 +41,37 @@ type Label map[byte]string
 // Maps op codes to string labels
 func MapOp() Label {
 	return Label{
-		OpClose:  "CLOSE",
-		OpAuth:   "AUTH",
-		OpPing:   "PING",
-		OpPong:   "PONG",
-		OpGet:    "GET",
-		OpSet:    "SET",
-		OpSetAck: "SET_ACK",
-		OpDel:    "DEL",
-		OpDelAck: "DEL_ACK",
-		OpList:   "LIST",
+		OpClose:         "CLOSE",
+		OpAuth:          "AUTH",
+		OpHello:         "HELLO",
+		OpPing:          "PING",
+		OpPong:          "PONG",
+		OpGet:           "GET",
+		OpMGet:          "MGET",
+		OpTtl:           "TTL",
+		OpSet:           "SET",
+		OpSetAck:        "SET_ACK",
+		OpCas:           "CAS",
+		OpMSet:          "MSET",
+		OpExpire:        "EXPIRE",
+		OpPersist:       "PERSIST",
+		OpDel:           "DEL",
+		OpDelAck:        "DEL_ACK",
+		OpMDel:          "MDEL",
+		OpExpired:       "EXPIRED",
+		OpEvicted:       "EVICTED",
+		OpList:          "LIST",
+		OpCount:         "COUNT",
+		OpIncr:          "INCR",
+		OpDecr:          "DECR",
+		OpTxn:           "TXN",
+		OpWatch:         "WATCH",
+		OpUnwatch:       "UNWATCH",
+		OpWatchExpired:  "WATCH_EXPIRED",
+		OpReshard:       "RESHARD",
+		OpReshardStatus: "RESHARD_STATUS",
+		OpSnapshot:      "SNAPSHOT",
+		OpStats:         "STATS",
+		OpRepl:          "REPL",
 	}
 }
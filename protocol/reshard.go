@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const ErrReshardLen = "reshard value does not meet length requirements"
+
+const RESHARD_LEN = 4
+const RESHARD_PROGRESS_LEN = 13
+
+// Progress of online resharding
+//
+// Migrated is the number of blocks of the previous layout
+// that have been moved to the new layout, out of Total.
+type ReshardProgress struct {
+	Segments uint32 // of the new layout
+	Migrated uint32
+	Total    uint32
+	Done     bool
+}
+
+// EncodeReshard returns a msg to start resharding
+// to the given number of segments
+func EncodeReshard(segments uint32) *Msg {
+	value := make([]byte, RESHARD_LEN)
+	binary.BigEndian.PutUint32(value, segments)
+	return &Msg{
+		Op:    OpReshard,
+		Value: value,
+	}
+}
+
+// DecodeReshard returns the number of segments
+// requested by a reshard msg
+func DecodeReshard(msg *Msg) (uint32, error) {
+	if len(msg.Value) != RESHARD_LEN {
+		return 0, errors.New(ErrReshardLen)
+	}
+	return binary.BigEndian.Uint32(msg.Value), nil
+}
+
+// EncodeReshardProgress serializes the progress
+//
+// | SEGMENTS UINT32 | MIGRATED UINT32 | TOTAL UINT32 | DONE |
+func EncodeReshardProgress(p *ReshardProgress) []byte {
+	b := make([]byte, RESHARD_PROGRESS_LEN)
+	binary.BigEndian.PutUint32(b, p.Segments)
+	binary.BigEndian.PutUint32(b[4:], p.Migrated)
+	binary.BigEndian.PutUint32(b[8:], p.Total)
+	if p.Done {
+		b[12] = 1
+	}
+	return b
+}
+
+// DecodeReshardProgress parses progress
+// serialized by EncodeReshardProgress
+func DecodeReshardProgress(b []byte) (*ReshardProgress, error) {
+	if len(b) != RESHARD_PROGRESS_LEN {
+		return nil, errors.New(ErrReshardLen)
+	}
+	return &ReshardProgress{
+		Segments: binary.BigEndian.Uint32(b),
+		Migrated: binary.BigEndian.Uint32(b[4:]),
+		Total:    binary.BigEndian.Uint32(b[8:]),
+		Done:     b[12] == 1,
+	}, nil
+}
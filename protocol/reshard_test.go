@@ -0,0 +1,30 @@
+package protocol
+
+import "testing"
+
+func TestEncodeDecodeReshardProgress(t *testing.T) {
+	p := &ReshardProgress{
+		Segments: 64,
+		Migrated: 100,
+		Total:    256,
+		Done:     true,
+	}
+	dec, err := DecodeReshardProgress(EncodeReshardProgress(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dec != *p {
+		t.Fatalf("expected %+v, got %+v", p, dec)
+	}
+	_, err = DecodeReshardProgress([]byte{0})
+	if err == nil {
+		t.Fatal("expected length error")
+	}
+}
+
+func TestEncodeDecodeReshard(t *testing.T) {
+	segments, err := DecodeReshard(EncodeReshard(64))
+	if err != nil || segments != 64 {
+		t.Fatalf("expected 64, got %v (%v)", segments, err)
+	}
+}
@@ -1,5 +1,10 @@
 package protocol
 
+import (
+	"encoding/binary"
+	"errors"
+)
+
 const SPLIT_MARKER = "+END"
 
 // Searches for +END
@@ -31,3 +36,24 @@ func SplitPlusEnd(data []byte, atEOF bool) (advance int, token []byte, err error
 	// Represents that you can't split up now, and requests more data from Reader
 	return 0, nil, nil
 }
+
+// Reads a big endian uint32 length prefix,
+// and returns the msg that follows it
+func SplitLenPrefix(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if len(data) >= LEN_PREFIX_LEN {
+		msgLen := int(binary.BigEndian.Uint32(data))
+		end := LEN_PREFIX_LEN + msgLen
+		if len(data) >= end {
+			return end, data[LEN_PREFIX_LEN:end], nil
+		}
+	}
+	// A partial msg at EOF can never be completed
+	if atEOF {
+		return 0, nil, errors.New(ErrMsgLen)
+	}
+	// Request more data from Reader
+	return 0, nil, nil
+}
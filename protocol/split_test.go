@@ -32,3 +32,37 @@ func TestSplit(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitLenPrefix(t *testing.T) {
+	var buf bytes.Buffer
+	tokens := []string{FIRST, SECOND + SPLIT_MARKER, "", THIRD}
+	for _, token := range tokens {
+		buf.Write(FramingLenPrefix.Frame([]byte(token)))
+	}
+	s := bufio.NewScanner(&buf)
+	s.Split(SplitLenPrefix)
+	got := make([]string, 0)
+	for s.Scan() {
+		got = append(got, s.Text())
+	}
+	if s.Err() != nil || len(got) != len(tokens) {
+		t.FailNow()
+	}
+	for i, token := range got {
+		if tokens[i] != token {
+			t.FailNow()
+		}
+	}
+}
+
+func TestSplitLenPrefixTruncated(t *testing.T) {
+	framed := FramingLenPrefix.Frame([]byte(FIRST))
+	s := bufio.NewScanner(bytes.NewReader(framed[:len(framed)-1]))
+	s.Split(SplitLenPrefix)
+	if s.Scan() {
+		t.FailNow()
+	}
+	if s.Err() == nil {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const ErrStatsLen = "stats value does not meet length requirements"
+
+const STATS_LEN = 32
+
+// Counters of a store
+//
+// Memory is the bytes held in memory by the store. MaxMemory is
+// the configured limit, or 0 if there is none.
+type Stats struct {
+	Keys      uint64
+	Memory    uint64
+	MaxMemory uint64
+	Evictions uint64 // since the server started
+}
+
+// EncodeStats serializes the stats
+//
+// | KEYS UINT64 | MEMORY UINT64 | MAX MEMORY UINT64 | EVICTIONS UINT64 |
+func EncodeStats(s *Stats) []byte {
+	b := make([]byte, STATS_LEN)
+	binary.BigEndian.PutUint64(b, s.Keys)
+	binary.BigEndian.PutUint64(b[8:], s.Memory)
+	binary.BigEndian.PutUint64(b[16:], s.MaxMemory)
+	binary.BigEndian.PutUint64(b[24:], s.Evictions)
+	return b
+}
+
+// DecodeStats parses stats serialized by EncodeStats
+//
+// Longer values are accepted, so that counters
+// can be appended without a new op.
+func DecodeStats(b []byte) (*Stats, error) {
+	if len(b) < STATS_LEN {
+		return nil, errors.New(ErrStatsLen)
+	}
+	return &Stats{
+		Keys:      binary.BigEndian.Uint64(b),
+		Memory:    binary.BigEndian.Uint64(b[8:]),
+		MaxMemory: binary.BigEndian.Uint64(b[16:]),
+		Evictions: binary.BigEndian.Uint64(b[24:]),
+	}, nil
+}
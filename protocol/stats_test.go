@@ -0,0 +1,23 @@
+package protocol
+
+import "testing"
+
+func TestEncodeDecodeStats(t *testing.T) {
+	s := &Stats{
+		Keys:      1000,
+		Memory:    64 << 20,
+		MaxMemory: 128 << 20,
+		Evictions: 42,
+	}
+	dec, err := DecodeStats(EncodeStats(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *dec != *s {
+		t.Fatalf("expected %+v, got %+v", s, dec)
+	}
+	_, err = DecodeStats([]byte{0})
+	if err == nil {
+		t.Fatal("expected length error")
+	}
+}
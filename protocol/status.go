@@ -6,6 +6,7 @@ const (
 	StatusNotFound     byte = '.'
 	StatusError        byte = '!'
 	StatusUnauthorized byte = '#'
+	StatusConflict     byte = '~'
 )
 
 func MapStatus() Label {
@@ -15,5 +16,6 @@ func MapStatus() Label {
 		StatusNotFound:     "NOT_FOUND",
 		StatusError:        "ERROR",
 		StatusUnauthorized: "UNATHORIZED",
+		StatusConflict:     "CONFLICT",
 	}
 }
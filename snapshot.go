@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/client"
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/store"
+	"github.com/intob/rocketkv/util"
+	"github.com/spf13/viper"
+)
+
+const errNoSnapshotCap = "server does not support snapshots"
+
+// dialServer connects & authenticates to the server
+// configured by network, address, tls & auth
+func dialServer() (*client.Client, error) {
+	network := viper.GetString(cfg.NETWORK)
+	addr := viper.GetString(cfg.ADDRESS)
+	cert := viper.GetString(cfg.TLS_CERT)
+	var conn net.Conn
+	var err error
+	if cert != "" {
+		conn, err = util.GetConnWithTLS(network, addr, cert, viper.GetString(cfg.TLS_KEY))
+	} else {
+		conn, err = util.GetConn(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewClientWithFraming(conn, protocol.FramingLenPrefix)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Hello(buildName())
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	auth := viper.GetString(cfg.AUTH)
+	if auth != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = c.AuthAck(ctx, auth)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// runSnapshot writes a snapshot of the running server to file
+func runSnapshot(file string) error {
+	if file == "" {
+		return errors.New("usage: rocketkv snapshot <file>")
+	}
+	c, err := dialServer()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !c.HasCap(protocol.CapSnapshot) {
+		return errors.New(errNoSnapshotCap)
+	}
+	// write to a temp file, so a failed snapshot leaves no archive
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = c.Snapshot(context.Background(), f)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote snapshot to %s\r\n", file)
+	return nil
+}
+
+// runRestore restores a snapshot file into the configured dir
+func runRestore(file string) error {
+	if file == "" {
+		return errors.New("usage: rocketkv restore <file>")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir := viper.GetString(cfg.DIR)
+	err = store.Restore(f, dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s into %s\r\n", file, dir)
+	return nil
+}
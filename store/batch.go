@@ -0,0 +1,96 @@
+package store
+
+import "github.com/intob/rocketkv/protocol"
+
+// groupByBlock maps each block to the indices
+// of the given keys that it holds
+//
+// The caller must hold the layout's read lock.
+func (s *Store) groupByBlock(keys []string) map[*Block][]int {
+	groups := make(map[*Block][]int)
+	for i, key := range keys {
+		block := s.locate(key)
+		groups[block] = append(groups[block], i)
+	}
+	return groups
+}
+
+// MGet returns the slot of each key,
+// and whether it was found
+//
+// Each block's lock is taken once.
+func (s *Store) MGet(keys []string) ([]Slot, []bool) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	slots := make([]Slot, len(keys))
+	found := make([]bool, len(keys))
+	groups := make(map[*Block][]int)
+	for i, key := range keys {
+		block, _ := s.locateBoth(key)
+		groups[block] = append(groups[block], i)
+	}
+	for block, indices := range groups {
+		block.Mutex.RLock()
+		if block.migrated {
+			// resharding, read from the next layout
+			block.Mutex.RUnlock()
+			for _, i := range indices {
+				b := s.locateRead(keys[i])
+				slots[i], found[i] = b.get(keys[i])
+				b.Mutex.RUnlock()
+			}
+			continue
+		}
+		for _, i := range indices {
+			slots[i], found[i] = block.get(keys[i])
+		}
+		block.Mutex.RUnlock()
+	}
+	return slots, found
+}
+
+// MSet sets the slot of each key,
+// and returns the new version of each
+//
+// Each block's lock is taken once.
+// If a key is given more than once, the last slot wins.
+func (s *Store) MSet(keys []string, slots []Slot) []int64 {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	versions := make([]int64, len(keys))
+	groups := s.groupByBlock(keys)
+	for block, indices := range groups {
+		block.Mutex.Lock()
+		for _, i := range indices {
+			slot := slots[i]
+			slot.Modified = block.put(keys[i], slot, false)
+			versions[i] = slot.Modified
+			s.commit(protocol.OpSet, keys[i], slot)
+		}
+		block.Mutex.Unlock()
+	}
+	return versions
+}
+
+// MDel deletes each key,
+// and returns whether it existed
+//
+// Each block's lock is taken once.
+func (s *Store) MDel(keys []string) []bool {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	found := make([]bool, len(keys))
+	groups := s.groupByBlock(keys)
+	for block, indices := range groups {
+		block.Mutex.Lock()
+		for _, i := range indices {
+			_, found[i] = block.get(keys[i])
+			if found[i] {
+				block.remove(keys[i])
+				s.commit(protocol.OpDel, keys[i], Slot{})
+			}
+		}
+		block.Mutex.Unlock()
+	}
+	return found
+}
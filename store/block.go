@@ -1,11 +1,9 @@
 package store
 
 import (
-	"encoding/gob"
 	"fmt"
-	"os"
-	"path"
 	"sync"
+	"sync/atomic"
 
 	"github.com/intob/rocketkv/util"
 )
@@ -14,78 +12,280 @@ import (
 //
 // Child of Part
 //
-// Contains the slots with values and metadata
+// Contains the slots with values and metadata,
+// held by a storage engine
 //
 // MustWrite flag is true if changes have been made since last disk-write.
 // MustSync flag is true for each node if changes have been made since last sync
+//
+// Version is the last version given to a slot in the block.
 type Block struct {
 	Id        []byte
 	Mutex     *sync.RWMutex
-	Slots     map[string]Slot
+	Version   int64
 	MustWrite bool
 	ReplState map[uint64]*ReplNodeState // replNodeId
+	engine    Engine
+	migrated  bool                 // moved to the next layout, while resharding
+	usage     map[string]*keyUsage // of keys, if tracked for eviction
+	expiry    expiryIndex          // of keys with an expiry
+	deletes   map[string]int64     // versions of deleted keys, until synced to every node
+	memory    *int64               // running total of the store, if accounted
 }
 
 // Holds state for a single replication node
+//
+// Synced is the block's version when last synced to the node,
+// so only slots & deletes of a later version are sent.
+// Reconcile is true if deletes may be missing, so keys of
+// the node that are not in the block must be deleted.
 type ReplNodeState struct {
-	MustSync bool
+	MustSync  bool
+	Synced    int64
+	Reconcile bool
 }
 
 // Contains a value & associated metadata
+//
+// Modified is the slot's version. Each write gives the slot
+// the next version of its block, so versions of a key
+// strictly increase, even if the key is deleted & re-created.
 type Slot struct {
 	Value    []byte
 	Expires  int64
 	Modified int64
 }
 
-// NewBlock returns a pointer to a new Block
+// NewBlock returns a pointer to a new Block,
+// holding its slots in memory
 func NewBlock(id []byte) *Block {
+	return newBlock(id, EngineMemory)
+}
+
+// newBlock returns a pointer to a new Block,
+// holding its slots in the named engine
+func newBlock(id []byte, engine string) *Block {
 	return &Block{
 		Id:        id,
 		Mutex:     new(sync.RWMutex),
-		Slots:     make(map[string]Slot),
 		ReplState: make(map[uint64]*ReplNodeState),
+		engine:    engines[engine](id),
+		deletes:   make(map[string]int64),
 	}
 }
 
-// WriteToFile encodes blocks as gobs,
-// and writes each to a file
-func (b *Block) WriteToFile(dir string) {
-	if !b.MustWrite {
-		return
+// WriteToFile flushes the block's engine to dir
+//
+// The engine is snapshotted under the lock, then written
+// without it, so writes to the block don't wait for the disk.
+// Calls must not overlap, they are serialised by persistMu.
+// If writing fails, the previous files are kept,
+// & the block is written again next time.
+func (b *Block) WriteToFile(dir string) error {
+	b.Mutex.Lock()
+	if !b.MustWrite || b.migrated {
+		b.Mutex.Unlock()
+		return nil
 	}
-	name := util.GetName(b.Id)
-	fullPath := path.Join(dir, name+".gob")
-	file, err := os.Create(fullPath)
-	if err != nil {
-		fmt.Println("failed to create part file")
-		panic(err)
+	write, err := b.engine.Snapshot(dir, b.Version)
+	if err == nil {
+		b.MustWrite = false
+	}
+	b.Mutex.Unlock()
+	if err == nil {
+		err = write()
 	}
-	b.Mutex.RLock()
-	err = gob.NewEncoder(file).Encode(&b.Slots)
 	if err != nil {
-		panic(err)
+		b.Mutex.Lock()
+		b.MustWrite = true
+		b.Mutex.Unlock()
+		return fmt.Errorf("failed to write block %s: %w", util.GetName(b.Id), err)
 	}
-	file.Close()
-	b.MustWrite = false
-	b.Mutex.RUnlock()
+	return nil
 }
 
-// ReadFromFile decodes a block file & populates slots
-func (b *Block) ReadFromFile(dir string) {
+// ReadFromFile loads the block's engine from dir
+//
+// If the files can't be read, an error is returned
+// & the files are left untouched. If they are of an
+// older format, the block is flagged to be upgraded.
+func (b *Block) ReadFromFile(dir string) error {
 	b.Mutex.Lock()
 	defer b.Mutex.Unlock()
-	name := util.GetName(b.Id)
-	fullPath := path.Join(dir, name+".gob")
-	file, err := os.Open(fullPath)
+	version, upgrade, err := b.engine.Load(dir)
 	if err != nil {
+		return err
+	}
+	b.Version = version
+	if upgrade {
+		b.MustWrite = true
+	}
+	b.expiry = expiryIndex{}
+	b.engine.Keys(func(key string, meta Slot) bool {
+		b.expiry.set(key, meta.Expires)
+		return true
+	})
+	return nil
+}
+
+// get returns the slot of the key,
+// & records the access if usage is tracked
+//
+// An expired slot is absent, even if not yet deleted.
+// The caller must hold the read lock.
+func (b *Block) get(key string) (Slot, bool) {
+	if u := b.usage[key]; u != nil {
+		u.touch()
+	}
+	slot, found := b.engine.Get(key)
+	if !found || isExpired(slot) {
+		return Slot{}, false
+	}
+	return slot, true
+}
+
+// each calls fn for each slot, until fn returns false
+//
+// A migrated block is empty.
+// The caller must hold the read lock.
+func (b *Block) each(fn func(key string, slot Slot) bool) {
+	if b.migrated {
 		return
 	}
-	err = gob.NewDecoder(file).Decode(&b.Slots)
-	file.Close()
-	if err != nil {
-		fmt.Printf("failed to decode data in block %s\r\n", name)
+	b.engine.Iterate(fn)
+}
+
+// eachKey is like each, but the slots may be without values
+//
+// The caller must hold the read lock.
+func (b *Block) eachKey(fn func(key string, meta Slot) bool) {
+	if b.migrated {
 		return
 	}
-	fmt.Printf("read from block %s\r\n", name)
+	b.engine.Keys(fn)
+}
+
+// len returns the number of slots
+//
+// The caller must hold the read lock.
+func (b *Block) len() int {
+	if b.migrated {
+		return 0
+	}
+	return b.engine.Len()
+}
+
+// put sets the slot of the key & gives it the next version
+//
+// If repl is true, the slot keeps its version,
+// unless the existing slot is newer, in which case
+// nothing is changed.
+//
+// Returns the version of the stored slot.
+// The caller must hold the write lock.
+func (b *Block) put(key string, slot Slot, repl bool) int64 {
+	if repl {
+		current, found := b.engine.Get(key)
+		if found && current.Modified > slot.Modified {
+			// if key has been modified since, skip it
+			return current.Modified
+		}
+		if slot.Modified > b.Version {
+			b.Version = slot.Modified
+		}
+	} else {
+		b.Version++
+		slot.Modified = b.Version
+	}
+	before := b.engine.Memory()
+	mustStore(b.engine.Set(key, slot))
+	b.resized(before)
+	b.MustWrite = true
+	b.expiry.set(key, slot.Expires)
+	delete(b.deletes, key)
+	if b.usage != nil {
+		if u := b.usage[key]; u != nil {
+			u.touch()
+		} else {
+			b.usage[key] = newKeyUsage()
+		}
+	}
+
+	// don't re-replicate (for now)
+	// TODO: think more about this, maybe it's better
+	// to re-replicate except to origin of repl.
+	// This would ensure that all replicas arrive at a consistent state,
+	// even if they are not all connected. However, it increases the amount
+	// of work that is done. Maybe we can make this a config option.
+	if !repl {
+		b.markSync()
+	}
+	return slot.Modified
+}
+
+// remove deletes the slot of the key
+//
+// If the block is replicated, the delete is given the next
+// version, & kept until synced, so followers can tell
+// whether their slot is older.
+// Returns false if there was no slot.
+// The caller must hold the write lock.
+func (b *Block) remove(key string) bool {
+	if !b.drop(key) {
+		return false
+	}
+	if len(b.ReplState) > 0 {
+		b.Version++
+		b.recordDelete(key, b.Version)
+	}
+	b.markSync()
+	return true
+}
+
+// drop deletes the slot of the key,
+// without flagging the block to be synced
+//
+// Returns false if there was no slot.
+// The caller must hold the write lock.
+func (b *Block) drop(key string) bool {
+	n := b.engine.Len()
+	before := b.engine.Memory()
+	mustStore(b.engine.Delete(key))
+	b.resized(before)
+	delete(b.usage, key)
+	b.expiry.remove(key)
+	if b.engine.Len() == n {
+		return false
+	}
+	b.MustWrite = true
+	return true
+}
+
+// resized adds the change of the engine's memory
+// since the given bytes to the store's total
+//
+// The caller must hold the write lock.
+func (b *Block) resized(before int64) {
+	if b.memory != nil {
+		atomic.AddInt64(b.memory, b.engine.Memory()-before)
+	}
+}
+
+// mustStore stops the server if an engine failed to
+// store a change, rather than acknowledge a write that
+// may be lost
+func mustStore(err error) {
+	if err != nil {
+		fmt.Println("failed to store change in engine")
+		panic(err)
+	}
+}
+
+// markSync flags the block to be synced to every node
+func (b *Block) markSync() {
+	for _, replNodeState := range b.ReplState {
+		if replNodeState != nil {
+			replNodeState.MustSync = true
+		}
+	}
 }
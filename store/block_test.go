@@ -0,0 +1,125 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/intob/rocketkv/util"
+)
+
+func getTestBlock() *Block {
+	id, _ := util.RandomId()
+	b := NewBlock(id)
+	b.Mutex.Lock()
+	b.put("a", Slot{Value: []byte("1")}, false)
+	b.put("b", Slot{Value: []byte("2")}, false)
+	b.Mutex.Unlock()
+	return b
+}
+
+func TestWriteReadBlockFile(t *testing.T) {
+	dir := t.TempDir()
+	b := getTestBlock()
+	err := b.WriteToFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.MustWrite {
+		t.Fatal("expected MustWrite to be cleared")
+	}
+	_, err = os.Stat(path.Join(dir, util.GetName(b.Id)+blockFileExt+tmpExt))
+	if !os.IsNotExist(err) {
+		t.Fatal("expected temp file to be renamed")
+	}
+	read := NewBlock(b.Id)
+	err = read.ReadFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, _ := read.get("b")
+	if read.len() != 2 || !bytes.Equal(slot.Value, []byte("2")) {
+		t.Fatalf("expected slots to be read, got %v", read.engine)
+	}
+	if read.Version != b.Version {
+		t.Fatalf("expected version %v, got %v", b.Version, read.Version)
+	}
+}
+
+// Tests that a corrupt block file is reported,
+// & left in place
+func TestReadCorruptBlockFile(t *testing.T) {
+	dir := t.TempDir()
+	b := getTestBlock()
+	fullPath := path.Join(dir, util.GetName(b.Id)+blockFileExt)
+	corrupt := []byte("not a gob")
+	os.WriteFile(fullPath, corrupt, 0600)
+	read := NewBlock(b.Id)
+	err := read.ReadFromFile(dir)
+	if err == nil {
+		t.Fatal("expected decode error")
+	}
+	data, _ := os.ReadFile(fullPath)
+	if !bytes.Equal(data, corrupt) {
+		t.Fatal("expected file to be untouched")
+	}
+}
+
+// Tests that a failed write keeps the block flagged
+func TestWriteBlockFileFails(t *testing.T) {
+	dir := path.Join(t.TempDir(), "missing")
+	b := getTestBlock()
+	err := b.WriteToFile(dir)
+	if err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if !b.MustWrite {
+		t.Fatal("expected MustWrite to remain set")
+	}
+}
+
+func TestReadMissingBlockFile(t *testing.T) {
+	b := getTestBlock()
+	err := NewBlock(b.Id).ReadFromFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a legacy gob file is read,
+// & replaced by a block file on the next write
+func TestUpgradeLegacyBlockFile(t *testing.T) {
+	dir := t.TempDir()
+	b := getTestBlock()
+	legacyPath := path.Join(dir, util.GetName(b.Id)+legacyBlockFileExt)
+	file, _ := os.Create(legacyPath)
+	gob.NewEncoder(file).Encode(&b.engine.(*memoryEngine).slots)
+	file.Close()
+
+	read := NewBlock(b.Id)
+	err := read.ReadFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.len() != 2 || read.Version != b.Version {
+		t.Fatalf("expected legacy slots to be read, got %v", read.engine)
+	}
+	if !read.MustWrite {
+		t.Fatal("expected legacy block to be flagged for writing")
+	}
+	err = read.WriteToFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(legacyPath)
+	if !os.IsNotExist(err) {
+		t.Fatal("expected legacy file to be removed")
+	}
+	upgraded := NewBlock(b.Id)
+	err = upgraded.ReadFromFile(dir)
+	if err != nil || upgraded.len() != 2 || upgraded.MustWrite {
+		t.Fatalf("expected upgraded block to be read, got %v", err)
+	}
+}
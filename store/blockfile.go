@@ -0,0 +1,143 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+const ErrBlockFileMagic = "not a block file"
+const ErrBlockFileFormat = "unsupported block file format"
+const ErrBlockFileCorrupt = "block file is corrupt"
+
+const blockFileExt = ".blk"
+const legacyBlockFileExt = ".gob"
+
+var BLOCK_FILE_MAGIC = []byte("RKVB")
+
+const BLOCK_FILE_FORMAT = 1
+
+// Fixed lengths
+const (
+	blockFileHeadLen   = 20 // magic, format, reserved, version, count
+	blockFileRecordLen = 22 // key len, expires, modified, value len
+	blockFileCrcLen    = 4
+)
+
+// encodeBlockFile writes the slots of a block
+//
+// Header:
+// | MAGIC 4B | FORMAT UINT16 | RESERVED UINT16 | VERSION INT64 | COUNT UINT32 |
+// followed by COUNT records:
+// | KEY LEN UINT16 | EXPIRES INT64 | MODIFIED INT64 | VALUE LEN UINT32 | KEY | VALUE |
+// followed by the CRC32 of all preceding bytes.
+func encodeBlockFile(w io.Writer, version int64, slots Engine) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	head := make([]byte, blockFileHeadLen)
+	copy(head, BLOCK_FILE_MAGIC)
+	binary.BigEndian.PutUint16(head[4:], BLOCK_FILE_FORMAT)
+	binary.BigEndian.PutUint64(head[8:], uint64(version))
+	binary.BigEndian.PutUint32(head[16:], uint32(slots.Len()))
+	bw.Write(head)
+	rec := make([]byte, blockFileRecordLen)
+	var err error
+	slots.Iterate(func(key string, slot Slot) bool {
+		if len(key) > protocol.KEY_LEN_MAX {
+			err = errors.New(protocol.ErrMsgKeyTooLong)
+			return false
+		}
+		binary.BigEndian.PutUint16(rec, uint16(len(key)))
+		binary.BigEndian.PutUint64(rec[2:], uint64(slot.Expires))
+		binary.BigEndian.PutUint64(rec[10:], uint64(slot.Modified))
+		binary.BigEndian.PutUint32(rec[18:], uint32(len(slot.Value)))
+		bw.Write(rec)
+		bw.WriteString(key)
+		bw.Write(slot.Value)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	sum := make([]byte, blockFileCrcLen)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	_, err = w.Write(sum)
+	return err
+}
+
+// decodeBlockFile reads & verifies the slots of a block
+//
+// Returns the block's version & slots.
+func decodeBlockFile(r io.Reader) (int64, map[string]Slot, error) {
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(r)
+	tr := io.TeeReader(br, crc)
+	head := make([]byte, blockFileHeadLen)
+	_, err := io.ReadFull(tr, head)
+	if err != nil {
+		return 0, nil, errors.New(ErrBlockFileCorrupt)
+	}
+	if string(head[:4]) != string(BLOCK_FILE_MAGIC) {
+		return 0, nil, errors.New(ErrBlockFileMagic)
+	}
+	if binary.BigEndian.Uint16(head[4:]) != BLOCK_FILE_FORMAT {
+		return 0, nil, errors.New(ErrBlockFileFormat)
+	}
+	version := int64(binary.BigEndian.Uint64(head[8:]))
+	count := binary.BigEndian.Uint32(head[16:])
+	slots := make(map[string]Slot)
+	for i := uint32(0); i < count; i++ {
+		key, slot, err := readBlockFileRecord(tr)
+		if err != nil {
+			return 0, nil, err
+		}
+		slots[key] = slot
+	}
+	return version, slots, verifyBlockFileCrc(br, crc)
+}
+
+func readBlockFileRecord(r io.Reader) (string, Slot, error) {
+	slot := Slot{}
+	rec := make([]byte, blockFileRecordLen)
+	_, err := io.ReadFull(r, rec)
+	if err != nil {
+		return "", slot, errors.New(ErrBlockFileCorrupt)
+	}
+	keyLen := int(binary.BigEndian.Uint16(rec))
+	slot.Expires = ExpiresMillis(int64(binary.BigEndian.Uint64(rec[2:])))
+	slot.Modified = int64(binary.BigEndian.Uint64(rec[10:]))
+	valueLen := int(binary.BigEndian.Uint32(rec[18:]))
+	// don't trust the lengths for allocation, the file may be truncated
+	data, err := io.ReadAll(io.LimitReader(r, int64(keyLen+valueLen)))
+	if err != nil || len(data) != keyLen+valueLen {
+		return "", slot, errors.New(ErrBlockFileCorrupt)
+	}
+	if valueLen > 0 {
+		slot.Value = data[keyLen:]
+	}
+	return string(data[:keyLen]), slot, nil
+}
+
+// verifyBlockFileCrc reads the trailing CRC,
+// & checks that nothing follows it
+func verifyBlockFileCrc(r io.Reader, crc hash.Hash32) error {
+	sum := make([]byte, blockFileCrcLen)
+	_, err := io.ReadFull(r, sum)
+	if err != nil || binary.BigEndian.Uint32(sum) != crc.Sum32() {
+		return errors.New(ErrBlockFileCorrupt)
+	}
+	n, _ := r.Read(make([]byte, 1))
+	if n != 0 {
+		return errors.New(ErrBlockFileCorrupt)
+	}
+	return nil
+}
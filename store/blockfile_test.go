@@ -0,0 +1,59 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecodeBlockFile(t *testing.T) {
+	slots := map[string]Slot{
+		"a":    {Value: []byte("1"), Modified: 1},
+		"ns/b": {Value: []byte("22"), Expires: 1700000000000, Modified: 7},
+		"c":    {Modified: 3},
+	}
+	buf := new(bytes.Buffer)
+	err := encodeBlockFile(buf, 9, &memoryEngine{slots: slots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, decoded, err := decodeBlockFile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 9 {
+		t.Fatalf("expected version 9, got %v", version)
+	}
+	if len(decoded) != len(slots) {
+		t.Fatalf("expected %v slots, got %v", len(slots), len(decoded))
+	}
+	for key, slot := range slots {
+		d := decoded[key]
+		if !bytes.Equal(d.Value, slot.Value) || d.Expires != slot.Expires ||
+			d.Modified != slot.Modified {
+			t.Fatalf("expected %v for %s, got %v", slot, key, d)
+		}
+	}
+}
+
+func TestDecodeBlockFileCorrupt(t *testing.T) {
+	buf := new(bytes.Buffer)
+	encodeBlockFile(buf, 1, &memoryEngine{slots: map[string]Slot{"key": {Value: []byte("value")}}})
+	enc := buf.Bytes()
+	flipped := append([]byte{}, enc...)
+	flipped[blockFileHeadLen+blockFileRecordLen] ^= 0xFF
+	cases := map[string][]byte{
+		"truncated": enc[:len(enc)-1],
+		"flipped":   flipped,
+		"trailing":  append(append([]byte{}, enc...), 0),
+	}
+	for name, data := range cases {
+		_, _, err := decodeBlockFile(bytes.NewReader(data))
+		if err == nil || err.Error() != ErrBlockFileCorrupt {
+			t.Fatalf("%s: expected corrupt error, got %v", name, err)
+		}
+	}
+	_, _, err := decodeBlockFile(bytes.NewReader([]byte("gob data, not a block file")))
+	if err == nil || err.Error() != ErrBlockFileMagic {
+		t.Fatalf("expected magic error, got %v", err)
+	}
+}
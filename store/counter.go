@@ -0,0 +1,55 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+const ErrNotCounter = "value is not a 64-bit integer"
+const ErrCounterOverflow = "counter would overflow"
+
+const COUNTER_LEN = 8
+
+// Incr atomically adds delta to the big endian int64 value of the key
+//
+// A missing key is created with a value of delta.
+// If expires is not 0, the key's expiry is set,
+// otherwise an existing expiry is kept.
+// Returns the new value & version.
+func (s *Store) Incr(key string, delta, expires int64) (int64, int64, error) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
+	block.Mutex.Lock()
+	defer block.Mutex.Unlock()
+	slot, found := block.get(key)
+	var value int64
+	if found {
+		if len(slot.Value) != COUNTER_LEN {
+			return 0, slot.Modified, errors.New(ErrNotCounter)
+		}
+		value = int64(binary.BigEndian.Uint64(slot.Value))
+	}
+	if (delta > 0 && value > math.MaxInt64-delta) ||
+		(delta < 0 && value < math.MinInt64-delta) {
+		return value, slot.Modified, errors.New(ErrCounterOverflow)
+	}
+	value += delta
+	slot.Value = EncodeCounter(value)
+	if expires != 0 {
+		slot.Expires = expires
+	}
+	slot.Modified = block.put(key, slot, false)
+	s.commit(protocol.OpSet, key, slot)
+	return value, slot.Modified, nil
+}
+
+// EncodeCounter returns the value as stored by Incr
+func EncodeCounter(value int64) []byte {
+	b := make([]byte, COUNTER_LEN)
+	binary.BigEndian.PutUint64(b, uint64(value))
+	return b
+}
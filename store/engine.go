@@ -0,0 +1,73 @@
+package store
+
+import "fmt"
+
+const ErrEngine = "unknown engine"
+const ErrEngineFiles = "block is stored by another engine"
+const ErrEnginePersist = "engine requires persistence"
+
+// Names of the storage engines
+const (
+	EngineMemory = "memory"
+	EngineLog    = "log"
+)
+
+// Holds the slots of a block
+//
+// An engine is not safe for concurrent use,
+// calls are guarded by the block's mutex.
+type Engine interface {
+	Get(key string) (Slot, bool)
+	Set(key string, slot Slot) error
+	Delete(key string) error
+	// Iterate calls fn for each slot, until fn returns false
+	Iterate(fn func(key string, slot Slot) bool)
+	// Keys is like Iterate, but the slots may be without values
+	Keys(fn func(key string, meta Slot) bool)
+	Len() int
+	// Size returns the bytes of all keys & values
+	Size() int64
+	// Memory returns the bytes held in memory,
+	// as accounted against maxmemory
+	Memory() int64
+	// Load reads the block's files in dir, & returns the
+	// block's version. Upgrade is true if the files are of
+	// an older format, & should be flushed.
+	Load(dir string) (version int64, upgrade bool, err error)
+	// Snapshot captures the block, to be flushed to dir.
+	// The returned write durably writes it, & may be called
+	// without the block's lock, but not concurrently with
+	// another write of the engine.
+	Snapshot(dir string, version int64) (write func() error, err error)
+	Close() error
+}
+
+// Constructors of the engines, by name,
+// each given the id of the block
+var engines = map[string]func(id []byte) Engine{
+	EngineMemory: newMemoryEngine,
+	EngineLog:    newLogEngine,
+}
+
+// slotSize returns the bytes of a key & its value
+func slotSize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// flush snapshots the engine, & writes it to dir
+func flush(e Engine, dir string, version int64) error {
+	write, err := e.Snapshot(dir, version)
+	if err != nil {
+		return err
+	}
+	return write()
+}
+
+// checkEngine returns an error if there is
+// no engine with the given name
+func checkEngine(name string) error {
+	if engines[name] == nil {
+		return fmt.Errorf("%s: %s", ErrEngine, name)
+	}
+	return nil
+}
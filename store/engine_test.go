@@ -0,0 +1,113 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/intob/rocketkv/util"
+)
+
+// Tests that each engine stores slots,
+// & loads what it flushed
+func TestEngines(t *testing.T) {
+	for name, newEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			id, _ := util.RandomId()
+			e := newEngine(id)
+			_, _, err := e.Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Set("a", Slot{Value: []byte("1"), Modified: 1})
+			e.Set("b", Slot{Value: []byte("2"), Expires: 1700000000000, Modified: 2})
+			e.Set("a", Slot{Value: []byte("3"), Modified: 3})
+			e.Set("c", Slot{Modified: 4})
+			e.Delete("c")
+			if e.Len() != 2 || e.Size() != 4 {
+				t.Fatalf("expected 2 slots of 4 bytes, got %v of %v", e.Len(), e.Size())
+			}
+			err = flush(e, dir, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Close()
+
+			loaded := newEngine(id)
+			defer loaded.Close()
+			version, _, err := loaded.Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != 4 || loaded.Size() != 4 {
+				t.Fatalf("expected version 4 of 4 bytes, got %v of %v", version, loaded.Size())
+			}
+			got := make(map[string]Slot)
+			loaded.Iterate(func(key string, slot Slot) bool {
+				got[key] = slot
+				return true
+			})
+			if len(got) != 2 || !bytes.Equal(got["a"].Value, []byte("3")) ||
+				got["b"].Expires != 1700000000000 || got["b"].Modified != 2 {
+				t.Fatalf("expected flushed slots to be loaded, got %v", got)
+			}
+			if _, found := loaded.Get("c"); found {
+				t.Fatal("expected deleted slot to be absent")
+			}
+		})
+	}
+}
+
+// Tests that a snapshot written after later changes
+// holds the slots as they were when it was taken,
+// & that a log scans the later changes on load
+func TestEngineSnapshot(t *testing.T) {
+	for name, newEngine := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			id, _ := util.RandomId()
+			e := newEngine(id)
+			_, _, err := e.Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Set("a", Slot{Value: []byte("1"), Modified: 1})
+			write, err := e.Snapshot(dir, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Set("b", Slot{Value: []byte("2"), Modified: 2})
+			e.Delete("a")
+			err = write()
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.Close()
+
+			loaded := newEngine(id)
+			defer loaded.Close()
+			version, _, err := loaded.Load(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, key := int64(1), "a"
+			if name == EngineLog {
+				expected, key = 2, "b"
+			}
+			_, found := loaded.Get(key)
+			if version != expected || !found || loaded.Len() != 1 {
+				t.Fatalf("expected version %v holding %s, got version %v of %v slots",
+					expected, key, version, loaded.Len())
+			}
+		})
+	}
+}
+
+func TestCheckEngine(t *testing.T) {
+	if checkEngine(EngineMemory) != nil {
+		t.Fatal("expected memory engine to exist")
+	}
+	if checkEngine("tape") == nil {
+		t.Fatal("expected unknown engine to be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+const ErrEviction = "unknown eviction policy"
+
+// Eviction policies
+const (
+	EvictLru      = "lru"      // least recently used key
+	EvictLfu      = "lfu"      // least frequently used key
+	EvictVolatile = "volatile" // key expiring soonest, only keys with Expires
+	EvictRandom   = "random"   // any key
+)
+
+// Number of keys sampled from each of EVICT_SAMPLE_BLOCKS
+// blocks, from which the best to evict is chosen
+const (
+	EVICT_SAMPLE_KEYS   = 5
+	EVICT_SAMPLE_BLOCKS = 5
+)
+
+// Holds the state of eviction
+//
+// If maxMemory is 0, there is no limit, & nothing is evicted.
+// The zero value is disabled.
+type evictor struct {
+	maxMemory int64
+	policy    string
+	evictions uint64 // atomic
+	memory    int64  // atomic, bytes of the accounted blocks
+	wake      chan struct{}
+}
+
+// Usage of a key, tracked for lru & lfu eviction
+//
+// Keys loaded from disk have no usage until written,
+// so they are the first to be evicted.
+type keyUsage struct {
+	last int64  // atomic, unix nanos of last access
+	hits uint32 // atomic, saturates
+}
+
+func newKeyUsage() *keyUsage {
+	return &keyUsage{last: time.Now().UnixNano(), hits: 1}
+}
+
+// touch records an access of the key,
+// safe to call while holding only the read lock
+func (u *keyUsage) touch() {
+	atomic.StoreInt64(&u.last, time.Now().UnixNano())
+	if atomic.LoadUint32(&u.hits) < ^uint32(0) {
+		atomic.AddUint32(&u.hits, 1)
+	}
+}
+
+// checkEviction returns an error if the policy is unknown
+func checkEviction(policy string) error {
+	switch policy {
+	case EvictLru, EvictLfu, EvictVolatile, EvictRandom:
+		return nil
+	}
+	return fmt.Errorf("%s: %s", ErrEviction, policy)
+}
+
+// tracksUsage returns true if keys must be tracked
+// for the policy
+func (e *evictor) tracksUsage() bool {
+	return e.maxMemory > 0 && (e.policy == EvictLru || e.policy == EvictLfu)
+}
+
+// notify wakes the eviction loop without blocking
+func (e *evictor) notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// trackUsage flags the blocks to track usage of their
+// keys, if required by the eviction policy
+//
+// Must be called before the blocks are used.
+func (s *Store) trackUsage(parts map[uint64]*Part) {
+	if !s.evict.tracksUsage() {
+		return
+	}
+	for _, part := range parts {
+		for _, b := range part.Blocks {
+			b.usage = make(map[string]*keyUsage)
+		}
+	}
+}
+
+// accountMemory adds the memory of the blocks to the
+// store's total, & keeps it up to date as they change
+//
+// Must be called before the blocks are used.
+func (s *Store) accountMemory(parts map[uint64]*Part) {
+	for _, part := range parts {
+		for _, b := range part.Blocks {
+			b.memory = &s.evict.memory
+			atomic.AddInt64(b.memory, b.engine.Memory())
+		}
+	}
+}
+
+// Memory returns the bytes held in memory by all blocks:
+// keys & values, or only keys & their index for the log engine
+func (s *Store) Memory() int64 {
+	return atomic.LoadInt64(&s.evict.memory)
+}
+
+// Stats returns the counters of the store
+func (s *Store) Stats() *protocol.Stats {
+	return &protocol.Stats{
+		Keys:      s.Count(""),
+		Memory:    uint64(s.Memory()),
+		MaxMemory: uint64(s.evict.maxMemory),
+		Evictions: atomic.LoadUint64(&s.evict.evictions),
+	}
+}
+
+// evictLoop evicts keys, each time a write is committed,
+// until the memory is within the limit
+func (s *Store) evictLoop() {
+	fmt.Printf("will evict %s keys above %v bytes\r\n", s.evict.policy, s.evict.maxMemory)
+	for range s.evict.wake {
+		for s.Memory() > s.evict.maxMemory {
+			if !s.evictOne() {
+				// nothing left to evict under this policy
+				break
+			}
+		}
+	}
+}
+
+// evictOne samples keys of random blocks, & evicts the
+// best candidate under the policy
+//
+// Like a delete, the eviction is replicated to followers.
+// Returns false if there was no candidate.
+func (s *Store) evictOne() bool {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	blocks := make([]*Block, 0)
+	for _, layout := range []map[uint64]*Part{s.Parts, s.reshard.next} {
+		for _, part := range layout {
+			for _, b := range part.Blocks {
+				blocks = append(blocks, b)
+			}
+		}
+	}
+
+	var victim *Block
+	var victimKey string
+	var best int64
+	sampled := 0
+	for _, i := range rand.Perm(len(blocks)) {
+		b := blocks[i]
+		n := 0
+		b.Mutex.RLock()
+		b.eachKey(func(key string, meta Slot) bool {
+			score, ok := s.evictScore(b, key, meta)
+			if !ok {
+				return true
+			}
+			if victim == nil || score < best {
+				victim, victimKey, best = b, key, score
+			}
+			n++
+			return n < EVICT_SAMPLE_KEYS
+		})
+		b.Mutex.RUnlock()
+		if n > 0 {
+			sampled++
+		}
+		if victim != nil && (s.evict.policy == EvictRandom || sampled >= EVICT_SAMPLE_BLOCKS) {
+			break
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	victim.Mutex.Lock()
+	defer victim.Mutex.Unlock()
+	if victim.migrated {
+		// retried with the next sample
+		return true
+	}
+	if victim.remove(victimKey) {
+		s.commit(protocol.OpEvicted, victimKey, Slot{})
+		atomic.AddUint64(&s.evict.evictions, 1)
+	}
+	return true
+}
+
+// evictScore returns the score of a key, lowest is evicted
+// first, & false if the key can't be evicted under the policy
+//
+// The caller must hold the read lock of the block.
+func (s *Store) evictScore(b *Block, key string, meta Slot) (int64, bool) {
+	switch s.evict.policy {
+	case EvictLru:
+		if u := b.usage[key]; u != nil {
+			return atomic.LoadInt64(&u.last), true
+		}
+		return 0, true
+	case EvictLfu:
+		if u := b.usage[key]; u != nil {
+			return int64(atomic.LoadUint32(&u.hits)), true
+		}
+		return 0, true
+	case EvictVolatile:
+		return meta.Expires, meta.Expires != 0
+	}
+	return 0, true
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+// getTestEvictStore returns a store of a single block,
+// so every key is sampled
+func getTestEvictStore(policy string, maxMemory int64) *Store {
+	s := getTestStore(1, false)
+	s.evict = evictor{
+		maxMemory: maxMemory,
+		policy:    policy,
+		wake:      make(chan struct{}, 1),
+	}
+	s.trackUsage(s.Parts)
+	return s
+}
+
+// evictAndCheck evicts one key, & fails unless it is the expected key
+func evictAndCheck(t *testing.T, s *Store, expected string) {
+	w := s.Watch("", 10)
+	defer s.Unwatch(w)
+	if !s.evictOne() {
+		t.Fatal("expected a key to be evicted")
+	}
+	e := <-w.Events
+	if e.Op != protocol.OpEvicted || e.Key != expected {
+		t.Fatalf("expected %s to be evicted, got %s", expected, e.Key)
+	}
+	if _, found := s.Get(expected); found {
+		t.Fatalf("expected %s to be deleted", expected)
+	}
+}
+
+func TestEvictLru(t *testing.T) {
+	s := getTestEvictStore(EvictLru, 1)
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, Slot{}, false)
+		time.Sleep(time.Millisecond)
+	}
+	s.Get("a")
+	evictAndCheck(t, s, "b")
+}
+
+func TestEvictLfu(t *testing.T) {
+	s := getTestEvictStore(EvictLfu, 1)
+	for _, key := range []string{"a", "b", "c"} {
+		s.Set(key, Slot{}, false)
+	}
+	s.Get("b")
+	s.Get("b")
+	s.Get("c")
+	evictAndCheck(t, s, "a")
+}
+
+func TestEvictVolatile(t *testing.T) {
+	s := getTestEvictStore(EvictVolatile, 1)
+	now := time.Now().UnixMilli()
+	s.Set("a", Slot{}, false)
+	s.Set("b", Slot{Expires: now + 200000}, false)
+	s.Set("c", Slot{Expires: now + 100000}, false)
+	evictAndCheck(t, s, "c")
+	evictAndCheck(t, s, "b")
+	if s.evictOne() {
+		t.Fatal("expected keys without expiry to be kept")
+	}
+}
+
+// Tests that the loop evicts until within the limit,
+// & that evictions are counted
+func TestEvictLoop(t *testing.T) {
+	for _, policy := range []string{EvictLru, EvictLfu, EvictRandom} {
+		t.Run(policy, func(t *testing.T) {
+			s := getTestStore(4, false)
+			s.evict = evictor{
+				maxMemory: 5000,
+				policy:    policy,
+				wake:      make(chan struct{}, 1),
+			}
+			s.trackUsage(s.Parts)
+			go s.evictLoop()
+			defer close(s.evict.wake)
+			for i := 0; i < 100; i++ {
+				s.Set(fmt.Sprintf("key%v", i), Slot{Value: make([]byte, 95)}, false)
+			}
+			for i := 0; s.Memory() > 5000; i++ {
+				if i == 1000 {
+					t.Fatalf("expected memory within limit, got %v", s.Memory())
+				}
+				time.Sleep(time.Millisecond)
+			}
+			stats := s.Stats()
+			if stats.Evictions < 50 || stats.Keys != 100-stats.Evictions {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+		})
+	}
+}
+
+// Tests that an eviction is replicated as a delete
+func TestEvictReplicated(t *testing.T) {
+	s := getTestLeader(1)
+	s.evict = evictor{maxMemory: 1, policy: EvictRandom}
+	s.Set("key", Slot{}, false)
+	b := s.locate("key")
+	state := b.ReplState[0]
+	state.Synced = b.Version
+	state.MustSync = false
+	if !s.evictOne() {
+		t.Fatal("expected a key to be evicted")
+	}
+	entries := b.changes(state.Synced)
+	if !state.MustSync || len(entries) != 1 || entries[0].Op != protocol.OpDel {
+		t.Fatalf("expected eviction to be synced as a delete, got %+v", entries)
+	}
+}
+
+// expectMemory fails unless the memory of the store
+// is that of its blocks
+func expectMemory(t *testing.T, s *Store) {
+	var expected int64
+	for _, part := range s.Parts {
+		for _, b := range part.Blocks {
+			expected += b.engine.Memory()
+		}
+	}
+	if s.Memory() != expected {
+		t.Fatalf("expected memory %v, got %v", expected, s.Memory())
+	}
+}
+
+// Tests that the memory of the store is kept up to date,
+// & excludes values of the log engine
+func TestMemory(t *testing.T) {
+	eachEngine(t, 2, func(t *testing.T, s *Store) {
+		for i := 0; i < 10; i++ {
+			s.Set(fmt.Sprintf("key%v", i), Slot{Value: make([]byte, 100)}, false)
+		}
+		s.Set("key1", Slot{Value: make([]byte, 10)}, false)
+		s.Del("key0")
+		expectMemory(t, s)
+		values := s.engine == EngineMemory
+		if values != (s.Memory() >= 800) {
+			t.Fatalf("unexpected memory %v of engine %s", s.Memory(), s.engine)
+		}
+	})
+}
+
+// Tests that the memory of the store is kept up to date
+// while resharding
+func TestMemoryReshard(t *testing.T) {
+	s := getTestStore(2, false)
+	for i := 0; i < 10; i++ {
+		s.Set(fmt.Sprintf("key%v", i), Slot{Value: make([]byte, 100)}, false)
+	}
+	err := s.Reshard(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForReshard(t, s)
+	expectMemory(t, s)
+	if s.Memory() != 1040 {
+		t.Fatalf("expected memory of 10 keys, got %v", s.Memory())
+	}
+}
+
+func TestCheckEviction(t *testing.T) {
+	if err := checkEviction(EvictLfu); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEviction("fifo"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
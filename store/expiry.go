@@ -0,0 +1,142 @@
+package store
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+// Smallest expiry read as milliseconds, see ExpiresMillis
+const EXPIRES_MS_MIN = 1e11
+
+// Index of the keys of a block that have an expiry,
+// as a min-heap, soonest first
+//
+// Holds only keys with an expiry, so the janitor's work
+// is proportional to the keys expiring, not the dataset.
+// The zero value is ready to use.
+type expiryIndex struct {
+	items []expiryItem
+	pos   map[string]int // index of each key in items
+}
+
+type expiryItem struct {
+	key     string
+	expires int64
+}
+
+// set adds or moves the key, or removes it if expires is 0
+func (x *expiryIndex) set(key string, expires int64) {
+	if expires == 0 {
+		x.remove(key)
+		return
+	}
+	if i, found := x.pos[key]; found {
+		x.items[i].expires = expires
+		heap.Fix(x, i)
+		return
+	}
+	if x.pos == nil {
+		x.pos = make(map[string]int)
+	}
+	heap.Push(x, expiryItem{key: key, expires: expires})
+}
+
+// remove drops the key, if indexed
+func (x *expiryIndex) remove(key string) {
+	if i, found := x.pos[key]; found {
+		heap.Remove(x, i)
+	}
+}
+
+// peek returns the key expiring soonest,
+// & false if there is none
+func (x *expiryIndex) peek() (expiryItem, bool) {
+	if len(x.items) == 0 {
+		return expiryItem{}, false
+	}
+	return x.items[0], true
+}
+
+// Implements heap.Interface, not to be called directly
+
+func (x *expiryIndex) Len() int {
+	return len(x.items)
+}
+
+func (x *expiryIndex) Less(i, j int) bool {
+	return x.items[i].expires < x.items[j].expires
+}
+
+func (x *expiryIndex) Swap(i, j int) {
+	x.items[i], x.items[j] = x.items[j], x.items[i]
+	x.pos[x.items[i].key] = i
+	x.pos[x.items[j].key] = j
+}
+
+func (x *expiryIndex) Push(v any) {
+	item := v.(expiryItem)
+	x.pos[item.key] = len(x.items)
+	x.items = append(x.items, item)
+}
+
+func (x *expiryIndex) Pop() any {
+	last := len(x.items) - 1
+	item := x.items[last]
+	x.items = x.items[:last]
+	delete(x.pos, item.key)
+	return item
+}
+
+// ExpiresMillis returns the expiry in Unix milliseconds
+//
+// Before millisecond precision, expiry was in Unix seconds,
+// & files written then are read as is. Times in seconds are
+// below 1e11 until the year 5138, & times in milliseconds
+// below it have passed (in 1973), so smaller values are
+// read as seconds.
+func ExpiresMillis(expires int64) int64 {
+	if expires > 0 && expires < EXPIRES_MS_MIN {
+		return expires * 1000
+	}
+	return expires
+}
+
+// isExpired returns true if the slot has an expiry,
+// & it has passed
+func isExpired(slot Slot) bool {
+	return slot.Expires != 0 && time.Now().UnixMilli() >= slot.Expires
+}
+
+// Expire sets the expiry of the key, keeping its value,
+// or clears it if expires is 0
+//
+// The slot is given the next version, unless it had
+// no expiry to clear. Returns the version & true,
+// or false if the key doesn't exist.
+func (s *Store) Expire(key string, expires int64) (int64, bool) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
+	block.Mutex.Lock()
+	defer block.Mutex.Unlock()
+	slot, found := block.get(key)
+	if !found {
+		return 0, false
+	}
+	if slot.Expires == expires {
+		return slot.Modified, true
+	}
+	slot.Expires = expires
+	slot.Modified = block.put(key, slot, false)
+	s.commit(protocol.OpSet, key, slot)
+	return slot.Modified, true
+}
+
+// Expiry returns the expiry & version of the key,
+// & false if the key doesn't exist
+func (s *Store) Expiry(key string) (int64, int64, bool) {
+	slot, found := s.Get(key)
+	return slot.Expires, slot.Modified, found
+}
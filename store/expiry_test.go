@@ -0,0 +1,145 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+func TestExpiryIndex(t *testing.T) {
+	x := expiryIndex{}
+	x.set("a", 30)
+	x.set("b", 10)
+	x.set("c", 20)
+	x.set("d", 0)
+	x.set("b", 40)
+	x.remove("c")
+	expected := []string{"a", "b"}
+	for _, key := range expected {
+		item, found := x.peek()
+		if !found || item.key != key {
+			t.Fatalf("expected %s, got %v", key, item)
+		}
+		x.remove(key)
+	}
+	if _, found := x.peek(); found || len(x.pos) != 0 {
+		t.Fatal("expected index to be empty")
+	}
+}
+
+// Tests that only expired keys are deleted, soonest first
+func TestExpireBlock(t *testing.T) {
+	s := getTestStore(1, false)
+	now := time.Now().UnixMilli()
+	s.Set("a", Slot{Expires: now - 1}, false)
+	s.Set("b", Slot{Expires: now - 2}, false)
+	s.Set("c", Slot{Expires: now + 100}, false)
+	s.Set("d", Slot{}, false)
+	w := s.Watch("", 10)
+	defer s.Unwatch(w)
+	for _, part := range s.Parts {
+		for _, b := range part.Blocks {
+			s.expireBlock(b)
+		}
+	}
+	for _, key := range []string{"b", "a"} {
+		e := <-w.Events
+		if e.Op != protocol.OpExpired || e.Key != key {
+			t.Fatalf("expected %s to expire, got %v", key, e)
+		}
+	}
+	if count := s.Count(""); count != 2 {
+		t.Fatalf("expected 2 keys, got %v", count)
+	}
+}
+
+// Tests that the index is rebuilt when a block is loaded
+func TestExpiryIndexLoaded(t *testing.T) {
+	dir := t.TempDir()
+	b := getTestBlock()
+	b.Mutex.Lock()
+	b.put("expiring", Slot{Expires: time.Now().Add(time.Hour).UnixMilli()}, false)
+	b.Mutex.Unlock()
+	b.WriteToFile(dir)
+
+	loaded := NewBlock(b.Id)
+	err := loaded.ReadFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, found := loaded.expiry.peek()
+	if !found || item.key != "expiring" || loaded.expiry.Len() != 1 {
+		t.Fatalf("expected expiring key to be indexed, got %v", item)
+	}
+}
+
+// Tests that expired keys are absent before they are deleted
+func TestLazyExpiry(t *testing.T) {
+	eachEngine(t, 2, func(t *testing.T, s *Store) {
+		now := time.Now().UnixMilli()
+		s.Set("ns/expired", Slot{Value: []byte("1"), Expires: now - 1}, false)
+		s.Set("ns/live", Slot{Value: []byte("2"), Expires: now + 60000}, false)
+		if _, found := s.Get("ns/expired"); found {
+			t.Fatal("expected expired key to be absent")
+		}
+		if _, found := s.Get("ns/live"); !found {
+			t.Fatal("expected live key")
+		}
+		if count := s.Count("ns/"); count != 1 {
+			t.Fatalf("expected 1 key, got %v", count)
+		}
+		keys := make([]string, 0)
+		for key := range s.List("ns/", 10) {
+			keys = append(keys, key)
+		}
+		if len(keys) != 1 || keys[0] != "ns/live" {
+			t.Fatalf("expected only ns/live, got %v", keys)
+		}
+		if _, ok := s.Cas("ns/expired", Slot{Value: []byte("3")}, 0); !ok {
+			t.Fatal("expected cas to treat expired key as missing")
+		}
+	})
+}
+
+func TestExpiresMillis(t *testing.T) {
+	for in, out := range map[int64]int64{
+		0:             0,
+		1646000000:    1646000000000,
+		1646000000000: 1646000000000,
+	} {
+		if got := ExpiresMillis(in); got != out {
+			t.Fatalf("expected %v for %v, got %v", out, in, got)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	eachEngine(t, 2, func(t *testing.T, s *Store) {
+		if _, found := s.Expire("missing", 1); found {
+			t.Fatal("expected missing key not to be found")
+		}
+		v1 := s.Set("key", Slot{Value: []byte("value")}, false)
+		expires := time.Now().Add(time.Hour).UnixMilli()
+		v2, found := s.Expire("key", expires)
+		if !found || v2 <= v1 {
+			t.Fatalf("expected a new version above %v, got %v", v1, v2)
+		}
+		slot, _ := s.Get("key")
+		if string(slot.Value) != "value" || slot.Expires != expires {
+			t.Fatalf("expected value to be kept with expiry, got %v", slot)
+		}
+		v3, _ := s.Expire("key", 0)
+		if v3 <= v2 {
+			t.Fatalf("expected a new version above %v, got %v", v2, v3)
+		}
+		// nothing to clear
+		v4, _ := s.Expire("key", 0)
+		if v4 != v3 {
+			t.Fatalf("expected version %v to be kept, got %v", v3, v4)
+		}
+		if expires, _, _ := s.Expiry("key"); expires != 0 {
+			t.Fatalf("expected expiry to be cleared, got %v", expires)
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path"
+
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/util"
+)
+
+// A key & its slot, as a line of an export
+//
+// Value is base64 encoded in JSON.
+type ExportRecord struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value"`
+	Expires  int64  `json:"expires"`
+	Modified int64  `json:"modified"`
+}
+
+// ExportDir writes every key of the dataset in dir to w,
+// as JSON lines, reading the block files & the wal directly
+//
+// The dataset is not written to, so a server may be running
+// on dir, though its writes in progress may be missed.
+// Returns the number of keys written.
+func ExportDir(dir string, w io.Writer) (int, error) {
+	st, overlay, err := readDataset(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer closeBlocks(st.Parts)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	count := 0
+	write := func(key string, slot Slot) bool {
+		err = enc.Encode(&ExportRecord{
+			Key:      key,
+			Value:    slot.Value,
+			Expires:  slot.Expires,
+			Modified: slot.Modified,
+		})
+		count++
+		return err == nil
+	}
+	for _, part := range st.Parts {
+		for _, b := range part.Blocks {
+			b.each(func(key string, slot Slot) bool {
+				if _, changed := overlay[key]; changed {
+					return true
+				}
+				return write(key, slot)
+			})
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	for key, rec := range overlay {
+		if rec.Op == protocol.OpSet && !write(key, rec.Slot) {
+			return count, err
+		}
+	}
+	return count, bw.Flush()
+}
+
+// ImportDir reads JSON lines from r into the dataset in dir,
+// or a new dataset with the given number of segments,
+// using the named engine
+//
+// Like replicated writes, a key is not replaced by an older
+// version. The server must not be running on dir.
+// Returns the number of records read.
+func ImportDir(r io.Reader, dir, engine string, segments int) (int, error) {
+	st, err := openDataset(dir, engine)
+	if errors.Is(err, os.ErrNotExist) {
+		st = &Store{Dir: dir, Parts: newParts(segments, engine), engine: engine}
+		err = ensureNoDataset(dir)
+		if err == nil {
+			err = loadBlocks(st.Parts, dir)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer closeBlocks(st.Parts)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	count := 0
+	for {
+		rec := ExportRecord{}
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		b := st.locate(rec.Key)
+		b.put(rec.Key, Slot{
+			Value:    rec.Value,
+			Expires:  ExpiresMillis(rec.Expires),
+			Modified: rec.Modified,
+		}, true)
+		count++
+	}
+	err = st.WriteAllBlocks(dir)
+	if err != nil {
+		return count, err
+	}
+	err = writeManifest(dir, st.getManifest())
+	if err != nil {
+		return count, err
+	}
+	// the blocks now include the records of the wal
+	return count, os.RemoveAll(path.Join(dir, walDirName))
+}
+
+// openDataset reads the dataset in dir, including
+// the records of its wal, without starting a store
+func openDataset(dir, engine string) (*Store, error) {
+	err := checkEngine(engine)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	st := &Store{Dir: dir, Parts: partsFromManifest(manifest, engine), engine: engine}
+	err = loadBlocks(st.Parts, dir)
+	if err != nil {
+		closeBlocks(st.Parts)
+		return nil, err
+	}
+	walDir := path.Join(dir, walDirName)
+	_, err = os.Stat(walDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	// replay all segments
+	w := &Wal{dir: walDir, seq: math.MaxUint64}
+	return st, w.Replay(st.replay)
+}
+
+// readDataset reads the dataset in dir without writing to it
+//
+// Blocks with a log are read by a read-only log engine,
+// others by the memory engine. The records of the wal are
+// not applied to the blocks, but returned as an overlay,
+// holding the last record that applies to each key.
+func readDataset(dir string) (*Store, map[string]walRecord, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	st := &Store{Dir: dir, Parts: partsFromManifest(manifest, EngineMemory), engine: EngineMemory}
+	eachBlock(st.Parts, func(b *Block) error {
+		_, err := os.Stat(path.Join(dir, util.GetName(b.Id)+logDirExt))
+		if err == nil {
+			e := newLogEngine(b.Id).(*logEngine)
+			e.readOnly = true
+			b.engine = e
+		}
+		return nil
+	})
+	err = loadBlocks(st.Parts, dir)
+	if err != nil {
+		closeBlocks(st.Parts)
+		return nil, nil, err
+	}
+	overlay := make(map[string]walRecord)
+	walDir := path.Join(dir, walDirName)
+	_, err = os.Stat(walDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, overlay, nil
+	}
+	// replay all segments, as the store would
+	w := &Wal{dir: walDir, seq: math.MaxUint64, readOnly: true}
+	err = w.Replay(func(rec walRecord) {
+		if rec.Op != protocol.OpSet {
+			overlay[rec.Key] = walRecord{Op: protocol.OpDel}
+			return
+		}
+		current, found := overlay[rec.Key]
+		if !found {
+			var slot Slot
+			slot, found = st.locate(rec.Key).engine.Get(rec.Key)
+			current = walRecord{Op: protocol.OpSet, Slot: slot}
+		}
+		if found && current.Op == protocol.OpSet && current.Slot.Modified > rec.Slot.Modified {
+			return
+		}
+		overlay[rec.Key] = rec
+	})
+	if err != nil {
+		closeBlocks(st.Parts)
+		return nil, nil, err
+	}
+	return st, overlay, nil
+}
+
+// closeBlocks closes the engines of the given parts
+func closeBlocks(parts map[uint64]*Part) {
+	eachBlock(parts, func(b *Block) error {
+		b.Mutex.Lock()
+		defer b.Mutex.Unlock()
+		return b.engine.Close()
+	})
+}
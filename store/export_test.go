@@ -0,0 +1,211 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := t.TempDir()
+	s := getTestStore(2, false)
+	s.Dir = dir
+	expires := time.Now().Add(time.Hour).UnixMilli()
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("ns%v/key%v", i%5, i), Slot{
+			Value:   []byte{byte(i), '+', 'E', 'N', 'D'},
+			Expires: expires + int64(i),
+		}, false)
+	}
+	err := s.WriteAllBlocks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(dir, s.getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	count, err := ExportDir(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 keys exported, got %v", count)
+	}
+	rec := ExportRecord{}
+	err = json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// import into a dataset with a different segment count
+	imported := path.Join(t.TempDir(), "imported")
+	count, err = ImportDir(bytes.NewReader(buf.Bytes()), imported, EngineMemory, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Fatalf("expected 100 keys imported, got %v", count)
+	}
+	loaded := loadTestStore(t, imported)
+	if len(loaded.Parts) != 4 {
+		t.Fatalf("expected 4 parts, got %v", len(loaded.Parts))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("ns%v/key%v", i%5, i)
+		want, _ := s.Get(key)
+		got, found := loaded.Get(key)
+		if !found {
+			t.Fatalf("expected %s to be imported", key)
+		}
+		if !bytes.Equal(got.Value, want.Value) || got.Expires != want.Expires || got.Modified != want.Modified {
+			t.Fatalf("expected %s to equal %v, got %v", key, want, got)
+		}
+	}
+
+	// importing again must not replace newer versions
+	loaded.Set("ns0/key0", Slot{Value: []byte("newer")}, false)
+	err = loaded.WriteAllBlocks(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ImportDir(bytes.NewReader(buf.Bytes()), imported, EngineMemory, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, _ := loadTestStore(t, imported).Get("ns0/key0")
+	if string(slot.Value) != "newer" {
+		t.Fatalf("expected newer value to be kept, got %s", slot.Value)
+	}
+}
+
+// Tests that records of the wal are exported
+func TestExportIncludesWal(t *testing.T) {
+	dir := t.TempDir()
+	s := getTestStore(2, false)
+	s.Dir = dir
+	s.Set("a", Slot{Value: []byte("a")}, false)
+	s.Set("b", Slot{Value: []byte("b")}, false)
+	err := s.WriteAllBlocks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(dir, s.getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := OpenWal(path.Join(dir, walDirName), WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal = w
+	s.Set("c", Slot{Value: []byte("c")}, false)
+	s.Del("a")
+	w.Close()
+
+	buf := new(bytes.Buffer)
+	count, err := ExportDir(dir, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 keys exported, got %v", count)
+	}
+	dec := json.NewDecoder(buf)
+	keys := make(map[string]bool)
+	for dec.More() {
+		rec := ExportRecord{}
+		err = dec.Decode(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[rec.Key] = true
+	}
+	if !keys["b"] || !keys["c"] || keys["a"] {
+		t.Fatalf("expected keys b & c, got %v", keys)
+	}
+}
+
+// Tests that exporting a dir reads the blocks & the wal
+// without writing to them, as a server may be running on it
+func TestExportDirReadOnly(t *testing.T) {
+	eachEngine(t, 2, func(t *testing.T, s *Store) {
+		s.Set("a", Slot{Value: []byte("a")}, false)
+		s.Set("b", Slot{Value: []byte("b")}, false)
+		err := s.WriteAllBlocks(s.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeManifest(s.Dir, s.getManifest())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := OpenWal(path.Join(s.Dir, walDirName), WalSyncNever, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		s.wal = w
+		s.Del("a")
+		s.Set("b", Slot{Value: []byte("changed")}, false)
+		s.Set("c", Slot{Value: []byte("c")}, false)
+		// a write in progress
+		enc, _ := encodeWalRecord(walRecord{Op: protocol.OpSet, Key: "d"})
+		_, err = w.file.Write(enc[:len(enc)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := readDirFiles(t, s.Dir)
+		buf := new(bytes.Buffer)
+		count, err := ExportDir(s.Dir, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(readDirFiles(t, s.Dir), before) {
+			t.Fatal("expected dir to be unchanged by export")
+		}
+		values := make(map[string]string)
+		dec := json.NewDecoder(buf)
+		for dec.More() {
+			rec := ExportRecord{}
+			err = dec.Decode(&rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values[rec.Key] = string(rec.Value)
+		}
+		if count != 2 || len(values) != 2 || values["b"] != "changed" || values["c"] != "c" {
+			t.Fatalf("unexpected export %v", values)
+		}
+	})
+}
+
+// readDirFiles returns the content of each file under dir,
+// by path
+func readDirFiles(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(name)
+		files[name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"os"
+	"path"
+)
+
+const tmpExt = ".tmp"
+
+// writeFileAtomic writes a file, such that a crash leaves
+// either the previous or the new file, never a partial one
+//
+// The data is written to a temp file & synced, then renamed
+// over the file. Finally, the directory is synced to
+// persist the rename.
+func writeFileAtomic(fullPath string, write func(file *os.File) error) error {
+	tmpPath := fullPath + tmpExt
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, fullPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(path.Dir(fullPath))
+}
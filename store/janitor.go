@@ -2,40 +2,50 @@ package store
 
 import (
 	"fmt"
-	"sync"
 	"time"
+
+	"github.com/intob/rocketkv/protocol"
 )
 
 // Delete expired keys
-func scanForExpiredKeys(s *Store, scanPeriod int) {
-	fmt.Printf("will scan for expired keys every %v seconds\r\n", scanPeriod)
+//
+// Every period, the soonest expiry of each block is checked,
+// so a key is deleted within a period of its expiry.
+func expireKeys(s *Store, period int) {
+	fmt.Printf("will check for expired keys every %v milliseconds\r\n", period)
 	for {
-		wg := new(sync.WaitGroup)
-		for _, part := range s.Parts {
-			for _, block := range part.Blocks {
-				wg.Add(1)
-				go func(block *Block, dir string) {
-					defer wg.Done()
-					block.Mutex.RLock()
-					for k, slot := range block.Slots {
-						if slot.Expires == 0 {
-							continue
-						}
-						expires := time.Unix(slot.Expires, 0)
-						if time.Now().After(expires) {
-							block.Mutex.RUnlock()
-							block.Mutex.Lock()
-							delete(block.Slots, k)
-							block.MustWrite = true
-							block.Mutex.Unlock()
-							block.Mutex.RLock()
-						}
-					}
-					block.Mutex.RUnlock()
-				}(block, s.Dir)
+		current, next := s.layouts()
+		for _, layout := range []map[uint64]*Part{current, next} {
+			for _, part := range layout {
+				for _, block := range part.Blocks {
+					s.expireBlock(block)
+				}
 			}
-			time.Sleep(time.Duration(scanPeriod) * time.Second)
 		}
-		wg.Wait()
+		time.Sleep(time.Duration(period) * time.Millisecond)
+	}
+}
+
+// expireBlock deletes the expired keys of the block,
+// in order of expiry
+//
+// The write lock is only taken if a key has expired.
+func (s *Store) expireBlock(b *Block) {
+	b.Mutex.RLock()
+	item, found := b.expiry.peek()
+	b.Mutex.RUnlock()
+	if !found || !isExpired(Slot{Expires: item.expires}) {
+		return
+	}
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	for {
+		item, found = b.expiry.peek()
+		if !found || !isExpired(Slot{Expires: item.expires}) {
+			return
+		}
+		slot, _ := b.engine.Get(item.key)
+		b.drop(item.key)
+		s.commit(protocol.OpExpired, item.key, slot)
 	}
 }
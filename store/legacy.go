@@ -0,0 +1,75 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/util"
+	"github.com/spf13/viper"
+)
+
+const ErrLegacyNamespace = "unknown or ambiguous namespace of legacy key"
+
+// Implemented by engines that read legacy gob files,
+// to give the slots of such a file their full key
+type legacyLoader interface {
+	setLegacyKey(fn func(name string) (string, error))
+}
+
+// legacyNamespaces returns the configured namespaces of keys
+// stored before keys were stored in full, each ending in "/"
+func legacyNamespaces() []string {
+	namespaces := viper.GetStringSlice(cfg.LEGACY_NAMESPACES)
+	for i, ns := range namespaces {
+		if !strings.HasSuffix(ns, "/") {
+			namespaces[i] = ns + "/"
+		}
+	}
+	return namespaces
+}
+
+// legacyKey returns a func giving a slot of a legacy gob file
+// of the block its full key
+//
+// Before keys were stored in full, a namespaced key was stored
+// by its name only, in the block of its namespace. Such a slot
+// is found as a name that would not be in this block of the
+// given layout. Its namespace is the one of the given namespaces
+// that is in this block.
+//
+// A legacy name that would be in this block is a bare key,
+// unless a namespace is in this block too, as then it may be
+// either. If the key is ambiguous, or has no namespace or
+// several, an error is returned, as it can't be restored.
+func (b *Block) legacyKey(parts map[uint64]*Part, namespaces []string) func(name string) (string, error) {
+	var owners []string
+	return func(name string) (string, error) {
+		if strings.Contains(name, "/") {
+			return name, nil
+		}
+		if owners == nil {
+			owners = make([]string, 0)
+			for _, ns := range namespaces {
+				if b.isClosest(parts, hashKey(ns, "")) {
+					owners = append(owners, ns)
+				}
+			}
+		}
+		bare := b.isClosest(parts, hashKey("", name))
+		if bare && len(owners) == 0 {
+			return name, nil
+		}
+		if bare || len(owners) != 1 {
+			return "", fmt.Errorf("%s %s in block %s, see %s",
+				ErrLegacyNamespace, name, util.GetName(b.Id), cfg.LEGACY_NAMESPACES)
+		}
+		return owners[0] + name, nil
+	}
+}
+
+// isClosest returns true if the key hash is mapped
+// to the block in the given layout
+func (b *Block) isClosest(parts map[uint64]*Part, keyHash []byte) bool {
+	return closestPart(parts, keyHash).getClosestBlock(keyHash) == b
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/util"
+	"github.com/spf13/viper"
+)
+
+// setLegacyNamespaces configures the legacy namespaces
+// for the duration of the test
+func setLegacyNamespaces(t *testing.T, namespaces ...string) {
+	viper.Set(cfg.LEGACY_NAMESPACES, namespaces)
+	t.Cleanup(func() {
+		viper.Set(cfg.LEGACY_NAMESPACES, nil)
+	})
+}
+
+// Tests that slots of a block file written before keys were
+// stored in full are given their namespace when loaded
+func TestRestoreNamespaces(t *testing.T) {
+	setLegacyNamespaces(t, "coffee")
+	parts := newParts(2, EngineMemory)
+	nsBlock := closestPart(parts, hashKey("coffee/", "")).getClosestBlock(hashKey("coffee/", ""))
+	// a name that is not in the namespace's block as a bare key
+	var name string
+	for i := 0; ; i++ {
+		name = fmt.Sprintf("name%v", i)
+		h := hashKey("", name)
+		if closestPart(parts, h).getClosestBlock(h) != nsBlock {
+			break
+		}
+	}
+	// a bare key of another block
+	var bare string
+	var bareBlock *Block
+	for i := 0; ; i++ {
+		bare = fmt.Sprintf("tea%v", i)
+		h := hashKey("", bare)
+		bareBlock = closestPart(parts, h).getClosestBlock(h)
+		if bareBlock != nsBlock {
+			break
+		}
+	}
+	files := map[*Block]map[string]Slot{
+		nsBlock:   {name: {Value: []byte("beans"), Modified: 1}},
+		bareBlock: {bare: {Value: []byte("leaves"), Modified: 2}},
+	}
+
+	for engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			// written as by versions without a block file format
+			dir := t.TempDir()
+			s := &Store{Dir: dir, Parts: parts}
+			err := writeManifest(dir, s.getManifest())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for b, slots := range files {
+				file, err := os.Create(path.Join(dir, util.GetName(b.Id)+legacyBlockFileExt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				gob.NewEncoder(file).Encode(&slots)
+				file.Close()
+			}
+
+			loaded, err := openDataset(dir, engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeBlocks(loaded.Parts)
+			slot, found := loaded.Get("coffee/" + name)
+			if !found || string(slot.Value) != "beans" {
+				t.Fatalf("expected namespaced key to be restored, got %+v", slot)
+			}
+			slot, found = loaded.Get(bare)
+			if !found || string(slot.Value) != "leaves" {
+				t.Fatalf("expected bare key to be kept, got %+v", slot)
+			}
+			keys := make([]string, 0)
+			for key := range loaded.List("", 10) {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if len(keys) != 2 || keys[0] != "coffee/"+name || keys[1] != bare {
+				t.Fatalf("unexpected keys %v", keys)
+			}
+		})
+	}
+}
+
+// Tests that loading fails if a legacy slot is not
+// in its block as a bare key, & no namespace is configured
+func TestRestoreNamespacesUnknown(t *testing.T) {
+	parts := newParts(2, EngineMemory)
+	var b *Block
+	for _, part := range parts {
+		for _, block := range part.Blocks {
+			b = block
+		}
+	}
+	var name string
+	for i := 0; ; i++ {
+		name = fmt.Sprintf("name%v", i)
+		if !b.isClosest(parts, hashKey("", name)) {
+			break
+		}
+	}
+	dir := t.TempDir()
+	err := writeManifest(dir, (&Store{Parts: parts}).getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Create(path.Join(dir, util.GetName(b.Id)+legacyBlockFileExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gob.NewEncoder(file).Encode(map[string]Slot{name: {Modified: 1}})
+	file.Close()
+	for engine := range engines {
+		_, err = openDataset(dir, engine)
+		if err == nil || !strings.Contains(err.Error(), ErrLegacyNamespace) {
+			t.Fatalf("expected %s, got %v", ErrLegacyNamespace, err)
+		}
+	}
+	_, err = os.Stat(file.Name())
+	if err != nil {
+		t.Fatal("expected legacy file to be kept")
+	}
+}
+
+// Tests that loading fails if a legacy slot is in its block
+// as a bare key, while a configured namespace is in it too
+func TestRestoreNamespacesAmbiguous(t *testing.T) {
+	setLegacyNamespaces(t, "coffee")
+	parts := newParts(2, EngineMemory)
+	h := hashKey("coffee/", "")
+	b := closestPart(parts, h).getClosestBlock(h)
+	var name string
+	for i := 0; ; i++ {
+		name = fmt.Sprintf("name%v", i)
+		if b.isClosest(parts, hashKey("", name)) {
+			break
+		}
+	}
+	_, err := b.legacyKey(parts, legacyNamespaces())(name)
+	if err == nil || !strings.Contains(err.Error(), ErrLegacyNamespace) {
+		t.Fatalf("expected %s, got %v", ErrLegacyNamespace, err)
+	}
+}
+
+// Tests that a dataset written by a version storing
+// namespaced keys by name only is loaded with full keys
+//
+// The dataset in testdata/baseline was written by that version,
+// with 2 segments. Its namespaced keys map to other blocks as
+// bare keys, & its bare keys to a block of no namespace,
+// so they can be told apart.
+func TestLoadBaselineDataset(t *testing.T) {
+	setLegacyNamespaces(t, "coffee", "juice")
+	expected := map[string]string{
+		"coffee/latte": "milk",
+		"coffee/mocha": "cocoa",
+		"juice/orange": "pulp",
+		"juice/apple":  "cider",
+		"kombucha":     "scoby",
+		"seltzer":      "fizz",
+	}
+	for engine := range engines {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			entries, err := os.ReadDir("testdata/baseline")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				data, err := os.ReadFile(path.Join("testdata/baseline", e.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(path.Join(dir, e.Name()), data, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			loaded, err := openDataset(dir, engine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeBlocks(loaded.Parts)
+			for key, value := range expected {
+				slot, found := loaded.Get(key)
+				if !found || string(slot.Value) != value {
+					t.Fatalf("expected %s to be %s, got %+v", key, value, slot)
+				}
+			}
+			slot, _ := loaded.Get("seltzer")
+			if slot.Expires != 4102444800000 {
+				t.Fatalf("expected expiry in milliseconds, got %v", slot.Expires)
+			}
+			keys := make([]string, 0)
+			for key := range loaded.List("", 10) {
+				keys = append(keys, key)
+			}
+			if len(keys) != len(expected) {
+				t.Fatalf("unexpected keys %v", keys)
+			}
+			juice := 0
+			for range loaded.List("juice/", 10) {
+				juice++
+			}
+			if juice != 2 {
+				t.Fatalf("expected 2 keys in namespace juice, got %v", juice)
+			}
+		})
+	}
+}
@@ -0,0 +1,715 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/util"
+)
+
+const ErrLogCorrupt = "log segment is corrupt"
+const ErrLogDir = "log engine is loaded from another dir"
+const ErrLogNotLoaded = "log engine is not loaded"
+const ErrHintFile = "hint file is corrupt"
+
+const logDirExt = ".data"
+const logSegmentExt = ".data"
+const hintFileName = "keys.hint"
+
+var HINT_FILE_MAGIC = []byte("RKVH")
+
+const HINT_FILE_FORMAT = 1
+
+// Fixed lengths
+const (
+	hintFileHeadLen  = 36 // magic, format, reserved, version, seq, offset, count
+	hintFileEntryLen = 42 // key len, seq, offset, size, value len, expires, modified
+)
+
+// Bytes of an index entry, excluding its key
+const logEntryMem = 40
+
+// Defaults of a log engine
+const (
+	LOG_SEGMENT_MAX = 64 << 20 // bytes of a segment before starting the next
+	LOG_COMPACT_MIN = 1 << 20  // dead bytes before compacting
+)
+
+// Holds the values of a block in append-only segment files,
+// & only an index of keys in memory
+//
+// Each write appends a record, in the format of the wal,
+// to the active segment. A delete appends a tombstone.
+// Records that are replaced or deleted are dead, & are
+// dropped by compaction, which rewrites the live records
+// to a new segment when more than half of the bytes are dead.
+//
+// When flushed, the active segment is synced, & the index
+// is written to a hint file, with the position up to which
+// it is complete. On load, the hint file is read, & only
+// records after that position are scanned.
+//
+// The files of a block are in the dir "<block id>.data".
+type logEngine struct {
+	id         []byte
+	dir        string // of the block's files, set by Load
+	index      map[string]logEntry
+	files      map[uint64]*os.File // segments, by seq
+	active     uint64              // seq of the segment appended to
+	activeLen  int64
+	size       int64 // bytes of all segments
+	live       int64 // bytes of indexed records
+	data       int64 // bytes of indexed keys & values
+	keys       int64 // bytes of indexed keys
+	segmentMax int64
+	compactMin int64
+	legacyKey  func(name string) (string, error) // of an imported legacy gob file
+	readOnly   bool                              // loaded without writing, see Load
+}
+
+// Position & metadata of a record
+type logEntry struct {
+	seq      uint64
+	offset   int64
+	size     uint32 // of the whole record
+	valueLen uint32
+	expires  int64
+	modified int64
+}
+
+func newLogEngine(id []byte) Engine {
+	return &logEngine{
+		id:         id,
+		index:      make(map[string]logEntry),
+		files:      make(map[uint64]*os.File),
+		segmentMax: LOG_SEGMENT_MAX,
+		compactMin: LOG_COMPACT_MIN,
+	}
+}
+
+// Get reads the slot of the key from its segment
+//
+// If the record can't be read, the server stops,
+// rather than report the key as missing.
+func (e *logEngine) Get(key string) (Slot, bool) {
+	entry, found := e.index[key]
+	if !found {
+		return Slot{}, false
+	}
+	slot, err := e.read(key, entry)
+	if err != nil {
+		fmt.Printf("failed to read %s from block %s\r\n", key, util.GetName(e.id))
+		panic(err)
+	}
+	return slot, true
+}
+
+// read reads & verifies the record of the entry
+func (e *logEngine) read(key string, entry logEntry) (Slot, error) {
+	f := e.files[entry.seq]
+	if f == nil {
+		return Slot{}, errors.New(ErrLogCorrupt)
+	}
+	rec, err := readWalRecord(io.NewSectionReader(f, entry.offset, int64(entry.size)), int64(entry.size))
+	if err != nil {
+		return Slot{}, err
+	}
+	if rec.Key != key || rec.Op != protocol.OpSet {
+		return Slot{}, errors.New(ErrLogCorrupt)
+	}
+	return rec.Slot, nil
+}
+
+func (e *logEngine) Set(key string, slot Slot) error {
+	offset, size, err := e.append(walRecord{Op: protocol.OpSet, Key: key, Slot: slot})
+	if err != nil {
+		return err
+	}
+	if old, found := e.index[key]; found {
+		e.live -= int64(old.size)
+		e.data -= int64(len(key)) + int64(old.valueLen)
+		e.keys -= int64(len(key))
+	}
+	e.index[key] = logEntry{
+		seq:      e.active,
+		offset:   offset,
+		size:     size,
+		valueLen: uint32(len(slot.Value)),
+		expires:  slot.Expires,
+		modified: slot.Modified,
+	}
+	e.live += int64(size)
+	e.data += slotSize(key, slot.Value)
+	e.keys += int64(len(key))
+	return nil
+}
+
+func (e *logEngine) Delete(key string) error {
+	old, found := e.index[key]
+	if !found {
+		return nil
+	}
+	_, _, err := e.append(walRecord{Op: protocol.OpDel, Key: key})
+	if err != nil {
+		return err
+	}
+	delete(e.index, key)
+	e.live -= int64(old.size)
+	e.data -= int64(len(key)) + int64(old.valueLen)
+	e.keys -= int64(len(key))
+	return nil
+}
+
+// append writes the record to the active segment,
+// starting the next segment if it is full
+//
+// Returns the offset & size of the record.
+func (e *logEngine) append(rec walRecord) (int64, uint32, error) {
+	b, err := encodeWalRecord(rec)
+	if err != nil {
+		return 0, 0, err
+	}
+	if e.dir == "" {
+		return 0, 0, errors.New(ErrLogNotLoaded)
+	}
+	if e.files[e.active] == nil || e.activeLen >= e.segmentMax {
+		err = e.startSegment()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	offset := e.activeLen
+	_, err = e.files[e.active].WriteAt(b, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	e.activeLen += int64(len(b))
+	e.size += int64(len(b))
+	return offset, uint32(len(b)), nil
+}
+
+// startSegment syncs the active segment,
+// & creates the next one
+func (e *logEngine) startSegment() error {
+	if f := e.files[e.active]; f != nil {
+		err := f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	err := os.MkdirAll(e.dir, 0700)
+	if err != nil {
+		return err
+	}
+	seq := e.active + 1
+	f, err := os.OpenFile(e.segmentPath(seq), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	e.files[seq] = f
+	e.active = seq
+	e.activeLen = 0
+	return syncDir(e.dir)
+}
+
+func (e *logEngine) setLegacyKey(fn func(name string) (string, error)) {
+	e.legacyKey = fn
+}
+
+func (e *logEngine) Iterate(fn func(key string, slot Slot) bool) {
+	for key := range e.index {
+		slot, _ := e.Get(key)
+		if !fn(key, slot) {
+			return
+		}
+	}
+}
+
+func (e *logEngine) Keys(fn func(key string, meta Slot) bool) {
+	for key, entry := range e.index {
+		if !fn(key, Slot{Expires: entry.expires, Modified: entry.modified}) {
+			return
+		}
+	}
+}
+
+func (e *logEngine) Len() int {
+	return len(e.index)
+}
+
+func (e *logEngine) Size() int64 {
+	return e.data
+}
+
+// Memory returns the bytes of the index,
+// as values are read from the segments
+func (e *logEngine) Memory() int64 {
+	return e.keys + int64(len(e.index))*logEntryMem
+}
+
+// Load opens the segments of the block in dir, reads the
+// hint file, & scans the records written after it
+//
+// A torn record at the end of the last segment, left by
+// a crash, is truncated. If there is no log, but a block
+// file, it is imported, so a dataset of the memory engine
+// moves to the log engine when it is next started.
+//
+// If read-only, the segments are opened only for reading,
+// & a torn record ends the scan. A missing log is an error.
+func (e *logEngine) Load(dir string) (int64, bool, error) {
+	name := util.GetName(e.id)
+	e.dir = path.Join(dir, name+logDirExt)
+	_, err := os.Stat(e.dir)
+	if errors.Is(err, os.ErrNotExist) && !e.readOnly {
+		return e.importBlockFile(dir)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	seqs, err := e.segments()
+	if err != nil {
+		return 0, false, err
+	}
+	flag := os.O_RDWR
+	if e.readOnly {
+		flag = os.O_RDONLY
+	}
+	for _, seq := range seqs {
+		f, err := os.OpenFile(e.segmentPath(seq), flag, 0600)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to open segment of block %s: %w", name, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return 0, false, err
+		}
+		e.files[seq] = f
+		e.active = seq
+		e.activeLen = info.Size()
+		e.size += info.Size()
+	}
+
+	version, fromSeq, fromOffset, err := e.readHintFile()
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("ignoring hint file of block %s: %s\r\n", name, err)
+		}
+		e.index = make(map[string]logEntry)
+		version, fromSeq, fromOffset = 0, 0, 0
+	}
+	for _, seq := range seqs {
+		if seq < fromSeq {
+			continue
+		}
+		var offset int64
+		if seq == fromSeq {
+			offset = fromOffset
+		}
+		modified, err := e.scan(seq, offset, seq == e.active)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to scan segment %v of block %s: %w", seq, name, err)
+		}
+		if modified > version {
+			version = modified
+		}
+	}
+	e.live, e.data, e.keys = 0, 0, 0
+	for key, entry := range e.index {
+		e.live += int64(entry.size)
+		e.data += int64(len(key)) + int64(entry.valueLen)
+		e.keys += int64(len(key))
+	}
+	fmt.Printf("read index of block %s, %v keys\r\n", name, len(e.index))
+	return version, false, nil
+}
+
+// scan indexes the records of the segment from offset
+//
+// Returns the highest version of the records.
+// If last is true, a torn record is truncated.
+// Any other corrupt record is an error.
+func (e *logEngine) scan(seq uint64, offset int64, last bool) (int64, error) {
+	f := e.files[seq]
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, offset, info.Size()-offset))
+	var version int64
+	for {
+		rec, err := readWalRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			return version, nil
+		}
+		if err != nil {
+			if !last || err.Error() != ErrWalTorn {
+				return version, errors.New(ErrLogCorrupt)
+			}
+			if e.readOnly {
+				return version, nil
+			}
+			fmt.Printf("truncating torn record of segment %v at %v\r\n", seq, offset)
+			e.size -= info.Size() - offset
+			e.activeLen = offset
+			return version, f.Truncate(offset)
+		}
+		size := uint32(walRecordHeadLen + walPayloadLenMin + len(rec.Key) + len(rec.Slot.Value))
+		switch rec.Op {
+		case protocol.OpSet:
+			e.index[rec.Key] = logEntry{
+				seq:      seq,
+				offset:   offset,
+				size:     size,
+				valueLen: uint32(len(rec.Slot.Value)),
+				expires:  rec.Slot.Expires,
+				modified: rec.Slot.Modified,
+			}
+			if rec.Slot.Modified > version {
+				version = rec.Slot.Modified
+			}
+		case protocol.OpDel:
+			delete(e.index, rec.Key)
+		}
+		offset += int64(size)
+	}
+}
+
+// importBlockFile reads the block file in dir, if any,
+// & writes its slots to a new log
+//
+// The log is written to a temp dir, which is renamed
+// once complete. Then the block file is removed.
+func (e *logEngine) importBlockFile(dir string) (int64, bool, error) {
+	m := newMemoryEngine(e.id).(*memoryEngine)
+	m.legacyKey = e.legacyKey
+	version, _, err := m.Load(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	if version == 0 && m.Len() == 0 {
+		// new block
+		return 0, false, nil
+	}
+	name := util.GetName(e.id)
+	logDir := e.dir
+	e.dir = logDir + tmpExt
+	err = os.RemoveAll(e.dir)
+	if err != nil {
+		return 0, false, err
+	}
+	for key, slot := range m.slots {
+		err = e.Set(key, slot)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	err = e.snapshot(version)()
+	if err != nil {
+		return 0, false, err
+	}
+	err = os.Rename(e.dir, logDir)
+	if err != nil {
+		return 0, false, err
+	}
+	e.dir = logDir
+	err = syncDir(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, ext := range []string{blockFileExt, legacyBlockFileExt} {
+		err = os.Remove(path.Join(dir, name+ext))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, false, err
+		}
+	}
+	fmt.Printf("imported block %s to log, %v keys\r\n", name, len(e.index))
+	return version, false, syncDir(dir)
+}
+
+// Snapshot compacts the log if more than half of it is dead,
+// & captures the index, to be written to the hint file once
+// the active segment is synced
+//
+// The log is always in the dir it was loaded from.
+func (e *logEngine) Snapshot(dir string, version int64) (func() error, error) {
+	if path.Join(dir, util.GetName(e.id)+logDirExt) != e.dir {
+		return nil, errors.New(ErrLogDir)
+	}
+	dead := e.size - e.live
+	if dead >= e.compactMin && dead*2 > e.size {
+		err := e.compact()
+		if err != nil {
+			return nil, fmt.Errorf("failed to compact: %w", err)
+		}
+	}
+	return e.snapshot(version), nil
+}
+
+// snapshot returns a func that syncs the active segment,
+// & writes the current index to the hint file
+//
+// Records appended meanwhile are after the hint's position,
+// so are scanned on load.
+func (e *logEngine) snapshot(version int64) func() error {
+	hint := logHint{
+		version: version,
+		seq:     e.active,
+		offset:  e.activeLen,
+		index:   make(map[string]logEntry, len(e.index)),
+	}
+	for key, entry := range e.index {
+		hint.index[key] = entry
+	}
+	active := e.files[e.active]
+	dir := e.dir
+	return func() error {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		if active != nil {
+			err = active.Sync()
+			if err != nil {
+				return err
+			}
+		}
+		return writeFileAtomic(path.Join(dir, hintFileName), func(file *os.File) error {
+			return writeHintFile(file, hint)
+		})
+	}
+}
+
+// compact copies the live records to a new segment,
+// then removes all previous segments
+//
+// The new segment is synced before the others are removed,
+// so a crash leaves either all records, or the live ones.
+func (e *logEngine) compact() error {
+	seq := e.active + 1
+	f, err := os.OpenFile(e.segmentPath(seq), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]logEntry, len(e.index))
+	bw := bufio.NewWriter(f)
+	var offset int64
+	for key, entry := range e.index {
+		b := make([]byte, entry.size)
+		_, err = e.files[entry.seq].ReadAt(b, entry.offset)
+		if err == nil {
+			_, err = bw.Write(b)
+		}
+		if err != nil {
+			break
+		}
+		entry.seq = seq
+		entry.offset = offset
+		index[key] = entry
+		offset += int64(entry.size)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(e.segmentPath(seq))
+		return err
+	}
+	previous := e.files
+	e.files = map[uint64]*os.File{seq: f}
+	e.index = index
+	e.active = seq
+	e.activeLen = offset
+	e.size = offset
+	e.live = offset
+	for s, pf := range previous {
+		pf.Close()
+		err = os.Remove(e.segmentPath(s))
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(e.dir)
+}
+
+// The index of a log, complete up to a position
+type logHint struct {
+	version int64
+	seq     uint64
+	offset  int64
+	index   map[string]logEntry
+}
+
+// writeHintFile writes the index, & the position
+// of the log up to which it is complete
+//
+// Header:
+// | MAGIC 4B | FORMAT UINT16 | RESERVED UINT16 | VERSION INT64 | SEQ UINT64 | OFFSET INT64 | COUNT UINT32 |
+// followed by COUNT entries:
+// | KEY LEN UINT16 | SEQ UINT64 | OFFSET INT64 | SIZE UINT32 | VALUE LEN UINT32 | EXPIRES INT64 | MODIFIED INT64 | KEY |
+// followed by the CRC32 of all preceding bytes.
+func writeHintFile(w io.Writer, hint logHint) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	head := make([]byte, hintFileHeadLen)
+	copy(head, HINT_FILE_MAGIC)
+	binary.BigEndian.PutUint16(head[4:], HINT_FILE_FORMAT)
+	binary.BigEndian.PutUint64(head[8:], uint64(hint.version))
+	binary.BigEndian.PutUint64(head[16:], hint.seq)
+	binary.BigEndian.PutUint64(head[24:], uint64(hint.offset))
+	binary.BigEndian.PutUint32(head[32:], uint32(len(hint.index)))
+	bw.Write(head)
+	b := make([]byte, hintFileEntryLen)
+	for key, entry := range hint.index {
+		binary.BigEndian.PutUint16(b, uint16(len(key)))
+		binary.BigEndian.PutUint64(b[2:], entry.seq)
+		binary.BigEndian.PutUint64(b[10:], uint64(entry.offset))
+		binary.BigEndian.PutUint32(b[18:], entry.size)
+		binary.BigEndian.PutUint32(b[22:], entry.valueLen)
+		binary.BigEndian.PutUint64(b[26:], uint64(entry.expires))
+		binary.BigEndian.PutUint64(b[34:], uint64(entry.modified))
+		bw.Write(b)
+		bw.WriteString(key)
+	}
+	err := bw.Flush()
+	if err != nil {
+		return err
+	}
+	sum := make([]byte, blockFileCrcLen)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	_, err = w.Write(sum)
+	return err
+}
+
+// readHintFile reads the index from the hint file
+//
+// Returns the block's version, & the position
+// from which the log must be scanned. The hint file
+// is rejected if it refers to a missing record.
+// The caller must have opened the segments.
+func (e *logEngine) readHintFile() (int64, uint64, int64, error) {
+	file, err := os.Open(path.Join(e.dir, hintFileName))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer file.Close()
+	crc := crc32.NewIEEE()
+	br := bufio.NewReader(file)
+	tr := io.TeeReader(br, crc)
+	head := make([]byte, hintFileHeadLen)
+	_, err = io.ReadFull(tr, head)
+	if err != nil || !bytes.Equal(head[:4], HINT_FILE_MAGIC) ||
+		binary.BigEndian.Uint16(head[4:]) != HINT_FILE_FORMAT {
+		return 0, 0, 0, errors.New(ErrHintFile)
+	}
+	version := int64(binary.BigEndian.Uint64(head[8:]))
+	seq := binary.BigEndian.Uint64(head[16:])
+	offset := int64(binary.BigEndian.Uint64(head[24:]))
+	count := binary.BigEndian.Uint32(head[32:])
+	if !e.contains(seq, offset) {
+		return 0, 0, 0, errors.New(ErrHintFile)
+	}
+	b := make([]byte, hintFileEntryLen)
+	for i := uint32(0); i < count; i++ {
+		_, err = io.ReadFull(tr, b)
+		if err != nil {
+			return 0, 0, 0, errors.New(ErrHintFile)
+		}
+		key := make([]byte, binary.BigEndian.Uint16(b))
+		_, err = io.ReadFull(tr, key)
+		if err != nil {
+			return 0, 0, 0, errors.New(ErrHintFile)
+		}
+		entry := logEntry{
+			seq:      binary.BigEndian.Uint64(b[2:]),
+			offset:   int64(binary.BigEndian.Uint64(b[10:])),
+			size:     binary.BigEndian.Uint32(b[18:]),
+			valueLen: binary.BigEndian.Uint32(b[22:]),
+			expires:  ExpiresMillis(int64(binary.BigEndian.Uint64(b[26:]))),
+			modified: int64(binary.BigEndian.Uint64(b[34:])),
+		}
+		if !e.contains(entry.seq, entry.offset+int64(entry.size)) {
+			return 0, 0, 0, errors.New(ErrHintFile)
+		}
+		e.index[string(key)] = entry
+	}
+	err = verifyBlockFileCrc(br, crc)
+	if err != nil {
+		return 0, 0, 0, errors.New(ErrHintFile)
+	}
+	return version, seq, offset, nil
+}
+
+// contains returns true if the segment exists,
+// & is at least as long as the given offset
+func (e *logEngine) contains(seq uint64, offset int64) bool {
+	if seq == 0 && offset == 0 {
+		// hint of an empty log
+		return true
+	}
+	f := e.files[seq]
+	if f == nil {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Size() >= offset
+}
+
+// Close closes the segments, leaving the files
+func (e *logEngine) Close() error {
+	var firstErr error
+	for _, f := range e.files {
+		err := f.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	e.files = make(map[uint64]*os.File)
+	e.index = make(map[string]logEntry)
+	e.size, e.live, e.data, e.keys = 0, 0, 0, 0
+	return firstErr
+}
+
+// segments returns the seqs of the segments, ascending
+func (e *logEngine) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, logSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, logSegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+func (e *logEngine) segmentPath(seq uint64) string {
+	return path.Join(e.dir, fmt.Sprintf("%016x%s", seq, logSegmentExt))
+}
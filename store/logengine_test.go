@@ -0,0 +1,159 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/intob/rocketkv/util"
+)
+
+// getTestLogEngine returns a log engine loaded from dir
+func getTestLogEngine(t *testing.T, dir string, id []byte) *logEngine {
+	e := newLogEngine(id).(*logEngine)
+	_, _, err := e.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func TestLogEngineCompact(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := util.RandomId()
+	e := getTestLogEngine(t, dir, id)
+	e.segmentMax = 1000
+	e.compactMin = 1000
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 100; i++ {
+		e.Set(fmt.Sprintf("key%v", i%10), Slot{Value: value, Modified: int64(i + 1)})
+	}
+	e.Delete("key0")
+	if len(e.files) < 2 {
+		t.Fatalf("expected segments to rotate, got %v", len(e.files))
+	}
+	err := flush(e, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.files) != 1 || e.size != e.live {
+		t.Fatalf("expected 1 compacted segment, got %v of %v bytes, %v live", len(e.files), e.size, e.live)
+	}
+	seqs, _ := e.segments()
+	if len(seqs) != 1 {
+		t.Fatalf("expected previous segments to be removed, got %v", seqs)
+	}
+	e.Close()
+
+	loaded := getTestLogEngine(t, dir, id)
+	if loaded.Len() != 9 {
+		t.Fatalf("expected 9 keys, got %v", loaded.Len())
+	}
+	slot, found := loaded.Get("key9")
+	if !found || !bytes.Equal(slot.Value, value) || slot.Modified != 100 {
+		t.Fatalf("expected key9 to be loaded, got %v", slot)
+	}
+}
+
+// Tests that records after the hint file are scanned,
+// & that a corrupt hint file falls back to scanning all
+func TestLogEngineHint(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := util.RandomId()
+	e := getTestLogEngine(t, dir, id)
+	e.Set("a", Slot{Value: []byte("1"), Modified: 1})
+	e.Set("b", Slot{Value: []byte("2"), Modified: 2})
+	err := flush(e, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Set("c", Slot{Value: []byte("3"), Modified: 3})
+	e.Delete("a")
+	e.Close()
+
+	check := func() {
+		loaded := newLogEngine(id).(*logEngine)
+		defer loaded.Close()
+		version, _, err := loaded.Load(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 3 || loaded.Len() != 2 {
+			t.Fatalf("expected version 3 & 2 keys, got %v & %v", version, loaded.Len())
+		}
+		if _, found := loaded.Get("a"); found {
+			t.Fatal("expected a to be deleted")
+		}
+		slot, _ := loaded.Get("c")
+		if string(slot.Value) != "3" {
+			t.Fatalf("expected c to be scanned, got %v", slot)
+		}
+	}
+	check()
+
+	hintPath := path.Join(e.dir, hintFileName)
+	data, _ := os.ReadFile(hintPath)
+	data[hintFileHeadLen] ^= 0xFF
+	os.WriteFile(hintPath, data, 0600)
+	check()
+}
+
+// Tests that a torn record at the end of the log
+// is truncated, & that appending continues after it
+func TestLogEngineTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	id, _ := util.RandomId()
+	e := getTestLogEngine(t, dir, id)
+	e.Set("a", Slot{Value: []byte("1"), Modified: 1})
+	e.Close()
+	segment := e.segmentPath(e.active)
+	before, _ := os.ReadFile(segment)
+	f, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 1, 0, 0, 0, 99, 1})
+	f.Close()
+
+	loaded := getTestLogEngine(t, dir, id)
+	after, _ := os.ReadFile(segment)
+	if !bytes.Equal(before, after) {
+		t.Fatal("expected torn record to be truncated")
+	}
+	err := loaded.Set("b", Slot{Value: []byte("2"), Modified: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Close()
+	reloaded := getTestLogEngine(t, dir, id)
+	if reloaded.Len() != 2 {
+		t.Fatalf("expected 2 keys, got %v", reloaded.Len())
+	}
+}
+
+// Tests that a block file is imported to a new log,
+// & that the memory engine then refuses the block
+func TestLogEngineImportBlockFile(t *testing.T) {
+	dir := t.TempDir()
+	b := getTestBlock()
+	b.WriteToFile(dir)
+
+	imported := newBlock(b.Id, EngineLog)
+	err := imported.ReadFromFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.engine.Close()
+	slot, found := imported.get("b")
+	if imported.len() != 2 || !found || string(slot.Value) != "2" || imported.Version != b.Version {
+		t.Fatalf("expected block file to be imported, got %v keys", imported.len())
+	}
+	_, err = os.Stat(path.Join(dir, util.GetName(b.Id)+blockFileExt))
+	if !os.IsNotExist(err) {
+		t.Fatal("expected block file to be removed")
+	}
+	err = NewBlock(b.Id).ReadFromFile(dir)
+	if err == nil {
+		t.Fatal("expected memory engine to refuse the log")
+	}
+}
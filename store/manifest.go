@@ -3,6 +3,7 @@ package store
 import (
 	"crypto/rand"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -28,57 +29,86 @@ type BlockManifest struct {
 
 // ensureManifest ensures that a manifest & block files exist
 func ensureManifest(s *Store) {
+	segments := viper.GetInt(cfg.SEGMENTS)
 	if !viper.GetBool(cfg.PERSIST) {
+		s.Parts = newParts(segments, s.engine)
 		return
 	}
-	s.Parts = make(map[uint64]*Part)
-	manifestPath := path.Join(s.Dir, manifestFileName)
-	manifestFile, err := os.Open(manifestPath)
-	segments := viper.GetInt(cfg.SEGMENTS)
+	manifest, err := readManifest(s.Dir)
 	if err != nil {
-		fmt.Println("no manifest found, will create...")
-		// parts
-		for p := 0; p < segments; p++ {
-			partId := make([]byte, util.ID_LEN)
-			_, err := rand.Read(partId)
-			if err != nil {
-				fmt.Println("failed to read from rand reader")
-				panic(err)
-			}
-			part := NewPart(partId)
-			// blocks
-			for b := 0; b < segments; b++ {
-				blockId := make([]byte, util.ID_LEN)
-				rand.Read(blockId)
-				part.Blocks[util.GetNumber(blockId)] = NewBlock(blockId)
-			}
-			s.Parts[util.GetNumber(partId)] = &part
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("failed to decode manifest")
+			panic(err)
 		}
-		newManifestFile, err := os.Create(manifestPath)
+		fmt.Println("no manifest found, will create...")
+		s.Parts = newParts(segments, s.engine)
+		err := writeManifest(s.Dir, s.getManifest())
 		if err != nil {
 			fmt.Printf("failed to create manifest, check directory exists: %s\r\n", s.Dir)
 			panic(err)
 		}
-		manifest := s.getManifest()
-		gob.NewEncoder(newManifestFile).Encode(manifest)
 	} else {
-		// decode list
-		manifest := make(Manifest, 0)
-		err := gob.NewDecoder(manifestFile).Decode(&manifest)
+		s.Parts = partsFromManifest(manifest, s.engine)
+		blockCount := len(s.Parts) * len(s.Parts)
+		fmt.Printf("initialised %v blocks from manifest\r\n", blockCount)
+	}
+}
+
+// partsFromManifest returns empty parts & blocks
+// with the ids of the manifest
+func partsFromManifest(manifest Manifest, engine string) map[uint64]*Part {
+	parts := make(map[uint64]*Part)
+	for _, partManifest := range manifest {
+		part := NewPart(partManifest.PartId)
+		for _, block := range partManifest.Blocks {
+			part.Blocks[util.GetNumber(block.BlockId)] = newBlock(block.BlockId, engine)
+		}
+		parts[util.GetNumber(part.Id)] = &part
+	}
+	return parts
+}
+
+// newParts returns the given number of parts,
+// each with the given number of blocks, all with random ids
+func newParts(segments int, engine string) map[uint64]*Part {
+	parts := make(map[uint64]*Part)
+	for p := 0; p < segments; p++ {
+		partId := make([]byte, util.ID_LEN)
+		_, err := rand.Read(partId)
 		if err != nil {
-			fmt.Println("failed to decode manifest")
+			fmt.Println("failed to read from rand reader")
 			panic(err)
 		}
-		for _, partManifest := range manifest {
-			part := NewPart(partManifest.PartId)
-			for _, block := range partManifest.Blocks {
-				part.Blocks[util.GetNumber(block.BlockId)] = NewBlock(block.BlockId)
-			}
-			s.Parts[util.GetNumber(part.Id)] = &part
+		part := NewPart(partId)
+		// blocks
+		for b := 0; b < segments; b++ {
+			blockId := make([]byte, util.ID_LEN)
+			rand.Read(blockId)
+			part.Blocks[util.GetNumber(blockId)] = newBlock(blockId, engine)
 		}
-		blockCount := len(s.Parts) * len(s.Parts)
-		fmt.Printf("initialised %v blocks from manifest\r\n", blockCount)
+		parts[util.GetNumber(partId)] = &part
 	}
+	return parts
+}
+
+// readManifest decodes the manifest in the given directory
+func readManifest(dir string) (Manifest, error) {
+	file, err := os.Open(path.Join(dir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	manifest := make(Manifest, 0)
+	err = gob.NewDecoder(file).Decode(&manifest)
+	return manifest, err
+}
+
+// writeManifest atomically writes the manifest
+// to the given directory
+func writeManifest(dir string, manifest *Manifest) error {
+	return writeFileAtomic(path.Join(dir, manifestFileName), func(file *os.File) error {
+		return gob.NewEncoder(file).Encode(manifest)
+	})
 }
 
 // getManifest returns a pointer to a new manifest
@@ -0,0 +1,195 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/intob/rocketkv/util"
+)
+
+// Holds all slots of a block in a map,
+// & writes them to a block file when flushed
+type memoryEngine struct {
+	id        []byte
+	slots     map[string]Slot
+	size      int64
+	legacy    bool                              // read from a legacy gob file
+	legacyKey func(name string) (string, error) // gives slots of a legacy gob file their full key
+}
+
+func newMemoryEngine(id []byte) Engine {
+	return &memoryEngine{
+		id:    id,
+		slots: make(map[string]Slot),
+	}
+}
+
+func (m *memoryEngine) Get(key string) (Slot, bool) {
+	slot, found := m.slots[key]
+	return slot, found
+}
+
+func (m *memoryEngine) Set(key string, slot Slot) error {
+	if old, found := m.slots[key]; found {
+		m.size -= slotSize(key, old.Value)
+	}
+	m.slots[key] = slot
+	m.size += slotSize(key, slot.Value)
+	return nil
+}
+
+func (m *memoryEngine) Delete(key string) error {
+	if old, found := m.slots[key]; found {
+		m.size -= slotSize(key, old.Value)
+		delete(m.slots, key)
+	}
+	return nil
+}
+
+func (m *memoryEngine) Iterate(fn func(key string, slot Slot) bool) {
+	for key, slot := range m.slots {
+		if !fn(key, slot) {
+			return
+		}
+	}
+}
+
+func (m *memoryEngine) Keys(fn func(key string, meta Slot) bool) {
+	m.Iterate(fn)
+}
+
+func (m *memoryEngine) Len() int {
+	return len(m.slots)
+}
+
+func (m *memoryEngine) Size() int64 {
+	return m.size
+}
+
+func (m *memoryEngine) Memory() int64 {
+	return m.size
+}
+
+func (m *memoryEngine) setLegacyKey(fn func(name string) (string, error)) {
+	m.legacyKey = fn
+}
+
+// load replaces the slots
+func (m *memoryEngine) load(slots map[string]Slot) {
+	m.slots = slots
+	m.size = 0
+	for key, slot := range slots {
+		m.size += slotSize(key, slot.Value)
+	}
+}
+
+// Load decodes the block file in dir
+//
+// A missing file is not an error, the block is new.
+// If the file can't be decoded, an error is returned
+// & the file is left untouched.
+//
+// If there is no block file, but a legacy gob file,
+// that is read & an upgrade is requested. If there is
+// a log of the block instead, an error is returned.
+func (m *memoryEngine) Load(dir string) (int64, bool, error) {
+	name := util.GetName(m.id)
+	file, err := os.Open(path.Join(dir, name+blockFileExt))
+	if errors.Is(err, os.ErrNotExist) {
+		return m.loadLegacy(dir)
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open block %s: %w", name, err)
+	}
+	defer file.Close()
+	version, slots, err := decodeBlockFile(file)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to decode block %s: %w", name, err)
+	}
+	m.load(slots)
+	fmt.Printf("read from block %s\r\n", name)
+	return version, false, nil
+}
+
+// loadLegacy reads a block written as a raw gob,
+// by versions without a block file format
+//
+// Such versions stored namespaced keys by name only,
+// so each slot is given its full key by legacyKey, if set.
+func (m *memoryEngine) loadLegacy(dir string) (int64, bool, error) {
+	name := util.GetName(m.id)
+	file, err := os.Open(path.Join(dir, name+legacyBlockFileExt))
+	if errors.Is(err, os.ErrNotExist) {
+		_, err = os.Stat(path.Join(dir, name+logDirExt))
+		if err == nil {
+			return 0, false, fmt.Errorf("%s: %s", ErrEngineFiles, name)
+		}
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open legacy block %s: %w", name, err)
+	}
+	defer file.Close()
+	slots := make(map[string]Slot)
+	err = gob.NewDecoder(file).Decode(&slots)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to decode legacy block %s: %w", name, err)
+	}
+	var version int64
+	full := make(map[string]Slot, len(slots))
+	for key, slot := range slots {
+		if m.legacyKey != nil {
+			key, err = m.legacyKey(key)
+			if err != nil {
+				return 0, false, err
+			}
+		}
+		if slot.Modified > version {
+			version = slot.Modified
+		}
+		slot.Expires = ExpiresMillis(slot.Expires)
+		full[key] = slot
+	}
+	m.load(full)
+	m.legacy = true
+	fmt.Printf("read from legacy block %s, will upgrade\r\n", name)
+	return version, true, nil
+}
+
+// Snapshot copies the slots, to atomically
+// replace the block file in dir
+//
+// Once written, a legacy gob file is removed. The engine
+// stays flagged as legacy, as removing a missing file is
+// no error.
+func (m *memoryEngine) Snapshot(dir string, version int64) (func() error, error) {
+	slots := make(map[string]Slot, len(m.slots))
+	for key, slot := range m.slots {
+		slots[key] = slot
+	}
+	snapshot := &memoryEngine{id: m.id, slots: slots, size: m.size}
+	legacy := m.legacy
+	return func() error {
+		name := util.GetName(m.id)
+		err := writeFileAtomic(path.Join(dir, name+blockFileExt), func(file *os.File) error {
+			return encodeBlockFile(file, version, snapshot)
+		})
+		if err != nil || !legacy {
+			return err
+		}
+		err = os.Remove(path.Join(dir, name+legacyBlockFileExt))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove legacy block: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// Close releases the slots
+func (m *memoryEngine) Close() error {
+	m.load(make(map[string]Slot))
+	return nil
+}
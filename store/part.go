@@ -43,31 +43,33 @@ func (p *Part) getClosestBlock(keyHash []byte) *Block {
 	return clBlock
 }
 
-// listKeys lists all keys matching given prefix
-//
-// If a namespace is provided, results will be prefixed with it
-func (p *Part) listKeys(namespace, prefix string, o chan string) {
+// listKeys lists all keys matching given prefix,
+// except expired keys
+func (p *Part) listKeys(prefix string, o chan string) {
 	for _, block := range p.Blocks {
 		block.Mutex.RLock()
-		for k := range block.Slots {
-			if strings.HasPrefix(k, prefix) {
-				o <- namespace + k
+		block.eachKey(func(k string, meta Slot) bool {
+			if strings.HasPrefix(k, prefix) && !isExpired(meta) {
+				o <- k
 			}
-		}
+			return true
+		})
 		block.Mutex.RUnlock()
 	}
 }
 
-// countKeys returns the number of keys matching the prefix
+// countKeys returns the number of keys matching the prefix,
+// except expired keys
 func (p *Part) countKeys(prefix string) uint64 {
 	var count uint64
 	for _, block := range p.Blocks {
 		block.Mutex.RLock()
-		for k := range block.Slots {
-			if strings.HasPrefix(k, prefix) {
+		block.eachKey(func(k string, meta Slot) bool {
+			if strings.HasPrefix(k, prefix) && !isExpired(meta) {
 				count++
 			}
-		}
+			return true
+		})
 		block.Mutex.RUnlock()
 	}
 	return count
@@ -19,7 +19,7 @@ func getTestPart(blocks int, putSlots bool) Part {
 			// fill with blocks*256 random slots
 			for s := 0; s < blocks*256; s++ {
 				slotId, _ := util.RandomId()
-				block.Slots[util.GetName(slotId)] = Slot{Value: slotId}
+				block.engine.Set(util.GetName(slotId), Slot{Value: slotId})
 			}
 		}
 		p.Blocks[util.GetNumber(blockId)] = block
@@ -60,6 +60,6 @@ func BenchmarkListKeys(b *testing.B) {
 		}
 	}()
 	for i := 0; i < b.N; i++ {
-		part.listKeys("", "", out)
+		part.listKeys("", out)
 	}
 }
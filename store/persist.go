@@ -3,6 +3,7 @@ package store
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/intob/rocketkv/cfg"
@@ -15,37 +16,149 @@ func (st *Store) Persist(dir string, period int) {
 
 	fmt.Printf("will write changed partitions every %v seconds\r\n", period)
 	for {
-		st.WriteAllBlocks(dir)
+		st.Checkpoint(dir)
 		time.Sleep(time.Duration(period) * time.Second)
 	}
 }
 
+// Checkpoint writes all changed blocks, then removes
+// the wal segments that they make redundant
+//
+// While resharding, the blocks of both layouts are written,
+// see writeAllBlocks. Once resharding is done,
+// the new layout is committed.
+func (st *Store) Checkpoint(dir string) {
+	st.persistMu.Lock()
+	defer st.persistMu.Unlock()
+	var seq uint64
+	var err error
+	if st.wal != nil {
+		seq, err = st.wal.Rotate()
+		if err != nil {
+			fmt.Printf("failed to rotate wal: %s\r\n", err)
+			return
+		}
+	}
+	if st.reshard.uncommitted {
+		current, _ := st.layouts()
+		err = commitLayout(dir, current)
+		if err != nil {
+			fmt.Printf("failed to commit layout, will retry: %s\r\n", err)
+			return
+		}
+		st.reshard.uncommitted = false
+	} else {
+		var complete bool
+		complete, err = st.writeAllBlocks(dir)
+		if err != nil || !complete {
+			// keep the wal, blocks that failed are retried next time
+			return
+		}
+	}
+	if seq == 0 {
+		return
+	}
+	err = st.wal.Truncate(seq)
+	if err != nil {
+		fmt.Printf("failed to truncate wal: %s\r\n", err)
+	}
+}
+
 // WriteAllBlocks writes all blocks in the store
 // to the file system, in the given directory
-func (st *Store) WriteAllBlocks(dir string) {
-	for _, part := range st.Parts {
-		for _, block := range part.Blocks {
-			go func(b *Block) {
-				b.WriteToFile(dir)
-			}(block)
+//
+// Returns once all blocks are written. Failures are printed,
+// & the first is returned.
+func (st *Store) WriteAllBlocks(dir string) error {
+	_, err := st.writeAllBlocks(dir)
+	return err
+}
+
+// writeAllBlocks writes the blocks of the current layout,
+// & of the next layout if resharding
+//
+// While resharding, the next layout is written first. Then
+// the files of the blocks that were migrated before are
+// removed, as their keys are now in the next layout on disk.
+// So each key is on disk in at least one of the layouts, to
+// be merged by resumeReshard after a crash.
+//
+// Returns false if a block was migrated meanwhile, as its
+// latest writes may be in neither layout on disk.
+// The caller must hold persistMu.
+func (st *Store) writeAllBlocks(dir string) (bool, error) {
+	current, next := st.layouts()
+	if next == nil {
+		return true, writeBlocks(dir, current, nil)
+	}
+	migrated := atomic.LoadUint32(&st.reshard.migrated)
+	removable := make(map[*Block]bool)
+	for _, part := range current {
+		for _, b := range part.Blocks {
+			b.Mutex.RLock()
+			removable[b] = b.migrated
+			b.Mutex.RUnlock()
 		}
 	}
+	err := writeBlocks(dir, next, nil)
+	if err != nil {
+		return false, err
+	}
+	err = writeBlocks(dir, current, removable)
+	if err != nil {
+		return false, err
+	}
+	return atomic.LoadUint32(&st.reshard.migrated) == migrated, nil
+}
+
+// writeBlocks writes the changed blocks of the given parts,
+// & removes the files of the given migrated blocks
+//
+// Failures are printed, & the first is returned.
+func writeBlocks(dir string, parts map[uint64]*Part, removable map[*Block]bool) error {
+	return eachBlock(parts, func(b *Block) error {
+		var err error
+		if removable[b] {
+			err = b.removeFiles(dir)
+		} else {
+			err = b.WriteToFile(dir)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+		return err
+	})
 }
 
-func readFromBlockFiles(st *Store) {
+func readFromBlockFiles(st *Store) error {
 	if !viper.GetBool(cfg.PERSIST) {
-		return
+		return nil
 	}
-	dir := viper.GetString(cfg.DIR)
+	return loadBlocks(st.Parts, viper.GetString(cfg.DIR))
+}
+
+// eachBlock calls fn for all blocks of the given parts
+// concurrently, & returns the first error
+func eachBlock(parts map[uint64]*Part, fn func(b *Block) error) error {
+	var firstErr error
+	mu := new(sync.Mutex)
 	wg := new(sync.WaitGroup)
-	for _, part := range st.Parts {
-		for _, b := range part.Blocks {
+	for _, part := range parts {
+		for _, block := range part.Blocks {
 			wg.Add(1)
 			go func(b *Block) {
-				b.ReadFromFile(dir)
-				wg.Done()
-			}(b)
+				defer wg.Done()
+				err := fn(b)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}(block)
 		}
 	}
 	wg.Wait()
+	return firstErr
 }
@@ -0,0 +1,209 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/intob/rocketkv/util"
+)
+
+const repartitionDirName = "repartition"
+
+// repartition re-maps all keys to a new layout with
+// the given number of segments, & replaces the layout on disk
+//
+// Must be called before serving connections.
+func repartition(st *Store, segments int) error {
+	fmt.Printf("repartitioning from %v to %v segments...\r\n", len(st.Parts), segments)
+	err := beginLayout(st.Dir)
+	if err != nil {
+		return err
+	}
+	next := newParts(segments, st.engine)
+	err = loadBlocks(next, st.Dir)
+	if err != nil {
+		return err
+	}
+	count := remap(st.Parts, next)
+	err = commitLayout(st.Dir, next)
+	if err != nil {
+		return err
+	}
+	closeBlocks(st.Parts)
+	st.Parts = next
+	fmt.Printf("re-mapped %v keys to %v blocks\r\n", count, segments*segments)
+	return nil
+}
+
+// beginLayout creates the repartition sub-directory,
+// which marks that the blocks of a new layout may be
+// written alongside the current ones
+//
+// Until the new layout is committed, its blocks are removed
+// by cleanupRepartition when the store is next started.
+func beginLayout(dir string) error {
+	tmpDir := path.Join(dir, repartitionDirName)
+	err := os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(tmpDir, 0700)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// loadBlocks loads the blocks of the given parts from dir
+//
+// The blocks of a new layout must be loaded before use,
+// as an engine may write to dir. Slots of legacy gob files
+// are given their full key, see legacyKey.
+func loadBlocks(parts map[uint64]*Part, dir string) error {
+	namespaces := legacyNamespaces()
+	return eachBlock(parts, func(b *Block) error {
+		if l, ok := b.engine.(legacyLoader); ok {
+			l.setLegacyKey(b.legacyKey(parts, namespaces))
+		}
+		return b.ReadFromFile(dir)
+	})
+}
+
+// commitLayout writes the blocks of the given layout,
+// & replaces the layout on disk
+//
+// The blocks are written alongside the current ones, &
+// the manifest to the repartition sub-directory. Then
+// the manifest is swapped, which commits the new layout.
+// Finally, the old block files are removed.
+func commitLayout(dir string, parts map[uint64]*Part) error {
+	tmpDir := path.Join(dir, repartitionDirName)
+	err := os.MkdirAll(tmpDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = eachBlock(parts, func(b *Block) error {
+		// write every block, in case an earlier attempt failed
+		b.Mutex.Lock()
+		b.MustWrite = b.len() > 0
+		b.Mutex.Unlock()
+		return b.WriteToFile(dir)
+	})
+	if err != nil {
+		return err
+	}
+	next := &Store{Parts: parts}
+	err = writeManifest(tmpDir, next.getManifest())
+	if err != nil {
+		return err
+	}
+	// commit
+	err = os.Rename(path.Join(tmpDir, manifestFileName), path.Join(dir, manifestFileName))
+	if err != nil {
+		return err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		return err
+	}
+	return cleanupRepartition(dir, parts)
+}
+
+// remap puts every slot of the current layout
+// in its block of the next layout
+//
+// A slot already in the next layout is kept, if not older.
+// Each new block gets at least the highest version of the
+// store, so that versions of every key keep increasing.
+// Returns the number of keys re-mapped.
+func remap(current, next map[uint64]*Part) int {
+	var version int64
+	count := 0
+	for _, part := range current {
+		for _, block := range part.Blocks {
+			block.Mutex.RLock()
+			block.each(func(key string, slot Slot) bool {
+				ns, name := path.Split(key)
+				h := hashKey(ns, name)
+				b := closestPart(next, h).getClosestBlock(h)
+				if old, found := b.engine.Get(key); found && old.Modified >= slot.Modified {
+					return true
+				}
+				mustStore(b.engine.Set(key, slot))
+				b.MustWrite = true
+				count++
+				return true
+			})
+			if block.Version > version {
+				version = block.Version
+			}
+			block.Mutex.RUnlock()
+		}
+	}
+	for _, part := range next {
+		for _, block := range part.Blocks {
+			if version > block.Version {
+				block.Version = version
+			}
+		}
+	}
+	return count
+}
+
+// cleanupRepartition removes block files that are not
+// in the given layout, & the repartition sub-directory
+//
+// These are left by a completed repartition,
+// or one that was interrupted by a crash.
+func cleanupRepartition(dir string, parts map[uint64]*Part) error {
+	tmpDir := path.Join(dir, repartitionDirName)
+	_, err := os.Stat(tmpDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	live := make(map[string]bool)
+	for _, part := range parts {
+		for _, block := range part.Blocks {
+			live[util.GetName(block.Id)] = true
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !isBlockFile(name) || live[blockFileId(name)] {
+			continue
+		}
+		err = os.RemoveAll(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// isBlockFile returns true if the file name is of
+// a block file, legacy block file, log dir, or temp file
+// of one of these
+func isBlockFile(name string) bool {
+	if name == manifestFileName {
+		return false
+	}
+	name = strings.TrimSuffix(name, tmpExt)
+	return strings.HasSuffix(name, blockFileExt) || strings.HasSuffix(name, legacyBlockFileExt) ||
+		strings.HasSuffix(name, logDirExt)
+}
+
+// blockFileId returns the block id of a block file name
+func blockFileId(name string) string {
+	return strings.SplitN(name, ".", 2)[0]
+}
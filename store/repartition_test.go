@@ -0,0 +1,82 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/intob/rocketkv/util"
+)
+
+func TestRepartition(t *testing.T) {
+	dir := t.TempDir()
+	st := &Store{Dir: dir, Parts: newParts(2, EngineMemory), engine: EngineMemory}
+	err := writeManifest(dir, st.getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		st.Set(fmt.Sprintf("ns%v/key%v", i%7, i), Slot{Value: []byte{byte(i)}}, false)
+	}
+	err = st.WriteAllBlocks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// left by an earlier, interrupted repartition
+	os.WriteFile(path.Join(dir, "orphan"+blockFileExt), []byte{}, 0600)
+
+	err = repartition(st, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Parts) != 4 {
+		t.Fatalf("expected 4 parts, got %v", len(st.Parts))
+	}
+
+	// load the new layout from disk
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Store{Parts: make(map[uint64]*Part)}
+	live := make(map[string]bool)
+	for _, pm := range manifest {
+		part := NewPart(pm.PartId)
+		for _, bm := range pm.Blocks {
+			part.Blocks[util.GetNumber(bm.BlockId)] = NewBlock(bm.BlockId)
+			live[util.GetName(bm.BlockId)] = true
+		}
+		loaded.Parts[util.GetNumber(part.Id)] = &part
+	}
+	if len(loaded.Parts) != 4 {
+		t.Fatalf("expected manifest with 4 parts, got %v", len(loaded.Parts))
+	}
+	err = eachBlock(loaded.Parts, func(b *Block) error {
+		return b.ReadFromFile(dir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		slot, found := loaded.Get(fmt.Sprintf("ns%v/key%v", i%7, i))
+		if !found || slot.Value[0] != byte(i) {
+			t.Fatalf("expected key%v to be re-mapped", i)
+		}
+	}
+	// versions keep increasing
+	v := loaded.Set("ns0/key0", Slot{}, false)
+	if v <= 100 {
+		t.Fatalf("expected version above 100, got %v", v)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if e.Name() == manifestFileName {
+			continue
+		}
+		if !live[blockFileId(e.Name())] {
+			t.Fatalf("expected %s to be removed", e.Name())
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/client"
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/util"
+	"github.com/spf13/viper"
+)
+
+const ErrReplCap = "follower does not support replication"
+
+// Bytes of entries sent per Repl msg, unless a single
+// entry is larger. Smaller if the follower's buffersize is.
+const REPL_BATCH_LEN = 1000000
+
+// Bytes of a Repl msg other than its entries,
+// allowed for when sizing batches for a follower
+const REPL_MSG_OVERHEAD = 64
+
+// Deletes kept per block until synced. Beyond that, the
+// deletes are forgotten, & followers are reconciled instead.
+const REPL_DELETES_MAX = 10000
+
+// Time allowed for a follower to apply a Repl msg
+const REPL_TIMEOUT = 10 * time.Second
+
+// Holds the config of replication to followers
+//
+// The repl node id of a follower is its index in nodes.
+// The zero value replicates to no node.
+type replicator struct {
+	nodes  []string
+	auth   string
+	period int // milliseconds
+}
+
+// trackRepl adds the state of each follower to the blocks
+//
+// If full, each block is synced in full, as on startup,
+// when followers may have none of the keys, or keys deleted
+// before a restart, so followers are reconciled too.
+// Otherwise, blocks are synced from their current version,
+// as blocks of a new layout receive their keys by migration.
+// Must be called before the blocks are used.
+func (s *Store) trackRepl(parts map[uint64]*Part, full bool) {
+	for _, part := range parts {
+		for _, b := range part.Blocks {
+			for id := range s.repl.nodes {
+				state := &ReplNodeState{MustSync: full, Reconcile: full}
+				if !full {
+					state.Synced = b.Version
+				}
+				b.ReplState[uint64(id)] = state
+			}
+		}
+	}
+}
+
+// replicate syncs changed blocks to the follower with
+// the given repl node id, every period
+//
+// If syncing fails, the connection is dropped,
+// & the follower is dialled again next period.
+func (s *Store) replicate(id uint64) {
+	addr := s.repl.nodes[id]
+	period := time.Duration(s.repl.period) * time.Millisecond
+	fmt.Printf("will replicate to %s every %v milliseconds\r\n", addr, s.repl.period)
+	var c *client.Client
+	for {
+		time.Sleep(period)
+		if c == nil {
+			var err error
+			c, err = s.dialFollower(addr)
+			if err != nil {
+				fmt.Printf("failed to connect to follower %s: %s\r\n", addr, err)
+				continue
+			}
+		}
+		err := s.syncNode(c, id)
+		if err != nil {
+			fmt.Printf("failed to replicate to %s, will retry: %s\r\n", addr, err)
+			c.Close()
+			c = nil
+		}
+	}
+}
+
+// dialFollower connects & authenticates to the follower,
+// using the network & TLS config of the server
+func (s *Store) dialFollower(addr string) (*client.Client, error) {
+	network := viper.GetString(cfg.NETWORK)
+	cert := viper.GetString(cfg.TLS_CERT)
+	var conn net.Conn
+	var err error
+	if cert != "" {
+		conn, err = util.GetConnWithTLS(network, addr, cert, viper.GetString(cfg.TLS_KEY))
+	} else {
+		conn, err = util.GetConn(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.NewClientWithFraming(conn, protocol.FramingLenPrefix)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(REPL_TIMEOUT))
+	_, err = c.Hello(s.Build)
+	conn.SetDeadline(time.Time{})
+	if err == nil && !c.HasCap(protocol.CapRepl) {
+		err = errors.New(ErrReplCap)
+	}
+	if err == nil && s.repl.auth != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), REPL_TIMEOUT)
+		err = c.AuthAck(ctx, s.repl.auth)
+		cancel()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// syncNode sends the changes of each block flagged
+// to be synced to the node, stopping at the first error
+func (s *Store) syncNode(c *client.Client, id uint64) error {
+	err := s.reconcile(c, id)
+	if err != nil {
+		return err
+	}
+	current, next := s.layouts()
+	for _, layout := range []map[uint64]*Part{current, next} {
+		for _, part := range layout {
+			for _, b := range part.Blocks {
+				err := b.sync(c, id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reconcile deletes the keys of the node that are not in
+// their block, for each block flagged to be reconciled
+//
+// This covers deletes that were not kept, as on a restart.
+// The deletes are given the block's version, so a key set
+// on the node by a later sync is kept. Skipped while
+// resharding, as the blocks may not yet hold their keys.
+func (s *Store) reconcile(c *client.Client, id uint64) error {
+	current, next := s.layouts()
+	if next != nil {
+		return nil
+	}
+	flagged := make(map[*Block]bool)
+	for _, part := range current {
+		for _, b := range part.Blocks {
+			b.Mutex.Lock()
+			state := b.ReplState[id]
+			if state != nil && state.Reconcile {
+				state.Reconcile = false
+				flagged[b] = true
+			}
+			b.Mutex.Unlock()
+		}
+	}
+	if len(flagged) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), REPL_TIMEOUT)
+	keys, err := c.ListKeys(ctx, "")
+	cancel()
+	if err == nil {
+		entries := make([]protocol.Entry, 0)
+		for _, key := range keys {
+			if entry, ok := s.reconcileKey(key, flagged); ok {
+				entries = append(entries, entry)
+			}
+		}
+		err = sendRepl(c, entries)
+	}
+	if err != nil {
+		for b := range flagged {
+			b.Mutex.Lock()
+			if state := b.ReplState[id]; state != nil {
+				state.Reconcile = true
+			}
+			b.Mutex.Unlock()
+		}
+	}
+	return err
+}
+
+// reconcileKey returns a delete of the node's key,
+// if its block is flagged & does not hold the key
+func (s *Store) reconcileKey(key string, flagged map[*Block]bool) (protocol.Entry, bool) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	b := s.locateRead(key)
+	defer b.Mutex.RUnlock()
+	if !flagged[b] {
+		return protocol.Entry{}, false
+	}
+	if _, found := b.engine.Get(key); found {
+		return protocol.Entry{}, false
+	}
+	return protocol.Entry{
+		Op:       protocol.OpDel,
+		Key:      key,
+		Modified: b.Version,
+	}, true
+}
+
+// sync sends the slots & deletes of the block that are newer
+// than its last sync to the node, if flagged to be synced
+//
+// The block is unlocked while sending, so writes made
+// meanwhile flag it to be synced again.
+func (b *Block) sync(c *client.Client, id uint64) error {
+	b.Mutex.Lock()
+	state := b.ReplState[id]
+	if state == nil || !state.MustSync || b.migrated {
+		b.Mutex.Unlock()
+		return nil
+	}
+	entries := b.changes(state.Synced)
+	version := b.Version
+	state.MustSync = false
+	b.Mutex.Unlock()
+
+	err := sendRepl(c, entries)
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	if err != nil {
+		state.MustSync = true
+		return err
+	}
+	if version > state.Synced {
+		state.Synced = version
+	}
+	b.pruneDeletes()
+	return nil
+}
+
+// changes returns the slots & deletes of a later version
+// than the given version, as entries of a Repl msg
+//
+// Expired slots are skipped, as followers expire keys too.
+// The caller must hold the read lock.
+func (b *Block) changes(since int64) []protocol.Entry {
+	entries := make([]protocol.Entry, 0)
+	b.each(func(key string, slot Slot) bool {
+		if slot.Modified > since && !isExpired(slot) {
+			entries = append(entries, protocol.Entry{
+				Op:       protocol.OpSet,
+				Key:      key,
+				Value:    slot.Value,
+				Expires:  slot.Expires,
+				Modified: slot.Modified,
+			})
+		}
+		return true
+	})
+	for key, version := range b.deletes {
+		if version > since {
+			entries = append(entries, protocol.Entry{
+				Op:       protocol.OpDel,
+				Key:      key,
+				Modified: version,
+			})
+		}
+	}
+	return entries
+}
+
+// recordDelete keeps the delete of the key until synced
+//
+// If the block holds too many deletes, as when a node is
+// down, they are forgotten, & each node is reconciled.
+// The caller must hold the write lock.
+func (b *Block) recordDelete(key string, version int64) {
+	b.deletes[key] = version
+	if len(b.deletes) <= REPL_DELETES_MAX {
+		return
+	}
+	b.deletes = make(map[string]int64)
+	for _, state := range b.ReplState {
+		state.Reconcile = true
+		state.MustSync = true
+	}
+}
+
+// pruneDeletes forgets the deletes synced to every node
+//
+// The caller must hold the write lock.
+func (b *Block) pruneDeletes() {
+	for key, version := range b.deletes {
+		synced := true
+		for _, state := range b.ReplState {
+			if state.Synced < version {
+				synced = false
+				break
+			}
+		}
+		if synced {
+			delete(b.deletes, key)
+		}
+	}
+}
+
+// inheritSync flags the block to sync the keys migrated
+// to it from the given block, that were not yet synced
+//
+// The caller must hold the write lock of both blocks.
+func (b *Block) inheritSync(from *Block) {
+	for id, state := range from.ReplState {
+		own := b.ReplState[id]
+		if own == nil {
+			continue
+		}
+		if state.Synced < own.Synced {
+			own.Synced = state.Synced
+		}
+		if state.Reconcile {
+			own.Reconcile = true
+		}
+		// a sync of the migrated block may be in flight, & fail
+		own.MustSync = true
+	}
+}
+
+// sendRepl sends the entries in Repl msgs of
+// up to replBatchLen bytes
+func sendRepl(c *client.Client, entries []protocol.Entry) error {
+	batchLen := replBatchLen(c)
+	for len(entries) > 0 {
+		n, size := 0, 0
+		for n < len(entries) {
+			entryLen := protocol.ENTRY_LEN_MIN + len(entries[n].Key) + len(entries[n].Value)
+			if n > 0 && size+entryLen > batchLen {
+				break
+			}
+			size += entryLen
+			n++
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REPL_TIMEOUT)
+		err := c.Replicate(ctx, entries[:n])
+		cancel()
+		if err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// replBatchLen returns the bytes of entries to send per
+// Repl msg, within the msg length the follower reads
+//
+// An entry larger than that is still sent alone,
+// & fails, as the follower can't read it.
+func replBatchLen(c *client.Client) int {
+	msgLen := c.MsgLenMax()
+	if msgLen == 0 || msgLen-REPL_MSG_OVERHEAD > REPL_BATCH_LEN {
+		return REPL_BATCH_LEN
+	}
+	if msgLen <= REPL_MSG_OVERHEAD {
+		return 1
+	}
+	return msgLen - REPL_MSG_OVERHEAD
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/intob/rocketkv/client"
+	"github.com/intob/rocketkv/protocol"
+)
+
+// getTestLeader returns a store replicating to a single node
+func getTestLeader(parts int) *Store {
+	s := getTestStore(parts, false)
+	s.repl = replicator{nodes: []string{"follower"}}
+	s.trackRepl(s.Parts, true)
+	return s
+}
+
+// getTestFollower serves a new store & returns it,
+// with a client connected to it
+func getTestFollower(t *testing.T, port int) (*Store, *client.Client) {
+	follower := getTestStore(4, false)
+	conn := getTestServerConnWithStore(port, "", follower)
+	c, err := client.NewClientWithFraming(conn, protocol.FramingLenPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Hello("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return follower, c
+}
+
+// expectReplicated fails unless the follower holds
+// the same slot as the leader for each key
+func expectReplicated(t *testing.T, leader, follower *Store, keys ...string) {
+	for _, key := range keys {
+		expected, found := leader.Get(key)
+		actual, replicated := follower.Get(key)
+		if found != replicated {
+			t.Fatalf("expected %s found %v on follower, got %v", key, found, replicated)
+		}
+		if found && (!bytes.Equal(actual.Value, expected.Value) || actual.Modified != expected.Modified) {
+			t.Fatalf("expected %s to be replicated, got %+v", key, actual)
+		}
+	}
+}
+
+// Tests that writes & deletes are replicated with their
+// versions, & that synced deletes are forgotten
+func TestReplicate(t *testing.T) {
+	leader := getTestLeader(4)
+	follower, c := getTestFollower(t, 42526)
+	defer c.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		leader.Set(key, Slot{Value: []byte(key)}, false)
+	}
+	leader.Del("b")
+	err := leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, leader, follower, "a", "b", "c")
+
+	leader.Set("a", Slot{Value: []byte("changed")}, false)
+	leader.Del("c")
+	err = leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, leader, follower, "a", "b", "c")
+
+	for _, part := range leader.Parts {
+		for _, b := range part.Blocks {
+			if len(b.deletes) > 0 || b.ReplState[0].MustSync {
+				t.Fatalf("expected block %x to be synced", b.Id)
+			}
+		}
+	}
+}
+
+// Tests that only changed slots are sent
+func TestReplChanges(t *testing.T) {
+	leader := getTestLeader(1)
+	leader.Set("a", Slot{}, false)
+	b := leader.locate("a")
+	state := b.ReplState[0]
+	state.Synced = b.Version
+	state.MustSync = false
+	leader.Set("b", Slot{}, false)
+	leader.Del("a")
+	if !state.MustSync {
+		t.Fatal("expected block to be flagged to sync")
+	}
+	entries := b.changes(state.Synced)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 changes, got %v", len(entries))
+	}
+	for _, e := range entries {
+		if e.Key == "a" && e.Op != protocol.OpDel || e.Key == "b" && e.Op != protocol.OpSet {
+			t.Fatalf("unexpected change %+v", e)
+		}
+	}
+}
+
+// Tests that a replicated delete keeps a newer slot
+func TestReplDel(t *testing.T) {
+	s := getTestStore(1, false)
+	s.Set("key", Slot{Modified: 5}, true)
+	if s.ReplDel("key", 3) {
+		t.Fatal("expected newer slot to be kept")
+	}
+	if !s.ReplDel("key", 6) {
+		t.Fatal("expected key to be deleted")
+	}
+	if _, found := s.Get("key"); found {
+		t.Fatal("expected key to be deleted")
+	}
+}
+
+// Tests that changes not yet synced when resharding
+// are synced from the blocks of the next layout
+func TestReplReshard(t *testing.T) {
+	leader := getTestLeader(2)
+	follower, c := getTestFollower(t, 42527)
+	defer c.Close()
+	keys := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		keys = append(keys, fmt.Sprintf("key%v", i))
+		leader.Set(keys[i], Slot{Value: []byte("value")}, false)
+	}
+	err := leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i += 2 {
+		leader.Del(keys[i])
+	}
+	leader.Set("new", Slot{}, false)
+	err = leader.Reshard(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForReshard(t, leader)
+	err = leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, leader, follower, append(keys, "new")...)
+}
+
+// Tests that keys deleted before a restart of the leader,
+// so no longer kept as deletes, are deleted on the follower
+func TestReplReconcile(t *testing.T) {
+	leader := getTestLeader(2)
+	follower, c := getTestFollower(t, 42531)
+	defer c.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		leader.Set(key, Slot{Value: []byte(key)}, false)
+	}
+	err := leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leader.Del("b")
+	// as on a restart
+	leader.trackRepl(leader.Parts, true)
+	for _, part := range leader.Parts {
+		for _, b := range part.Blocks {
+			b.deletes = make(map[string]int64)
+		}
+	}
+	err = leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, leader, follower, "a", "b", "c")
+}
+
+// Tests that deleting a missing key keeps no delete
+func TestReplDelMissing(t *testing.T) {
+	leader := getTestLeader(1)
+	b := leader.locate("missing")
+	version := b.Version
+	leader.Del("missing")
+	if len(b.deletes) > 0 || b.Version != version {
+		t.Fatal("expected no delete to be kept")
+	}
+}
+
+// Tests that too many deletes are forgotten,
+// & the follower flagged to be reconciled
+func TestReplDeletesMax(t *testing.T) {
+	leader := getTestLeader(1)
+	b := leader.locate("key")
+	state := b.ReplState[0]
+	state.MustSync = false
+	state.Reconcile = false
+	for i := 0; i <= REPL_DELETES_MAX; i++ {
+		key := fmt.Sprintf("key%v", i)
+		leader.Set(key, Slot{}, false)
+		leader.Del(key)
+	}
+	if len(b.deletes) > 0 {
+		t.Fatalf("expected deletes to be forgotten, got %v", len(b.deletes))
+	}
+	if !state.Reconcile || !state.MustSync {
+		t.Fatal("expected follower to be flagged to reconcile")
+	}
+}
+
+// Tests that changes are sent in msgs the follower can read
+func TestReplBatchLen(t *testing.T) {
+	leader := getTestLeader(1)
+	follower, c := getTestFollower(t, 42532)
+	defer c.Close()
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		leader.Set(key, Slot{Value: bytes.Repeat([]byte(key), 300)}, false)
+	}
+	err := leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, leader, follower, keys...)
+}
+
+// Tests that writes & deletes of a leader restarted without
+// its keys are applied by the follower, which holds slots
+// of the versions before the restart
+func TestReplRestart(t *testing.T) {
+	leader := getTestLeader(2)
+	follower, c := getTestFollower(t, 42533)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		leader.Set("a", Slot{Value: []byte("before")}, false)
+		leader.Set("b", Slot{Value: []byte("before")}, false)
+	}
+	err := leader.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as on a restart without persistence
+	restarted := getTestLeader(2)
+	seedVersions(restarted.Parts)
+	restarted.Set("a", Slot{Value: []byte("after")}, false)
+	err = restarted.syncNode(c, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReplicated(t, restarted, follower, "a", "b")
+}
@@ -0,0 +1,305 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/intob/rocketkv/protocol"
+	"github.com/intob/rocketkv/util"
+)
+
+const ErrReshardActive = "resharding is already in progress"
+const ErrReshardSegments = "segments must be between 1 & 256"
+
+const SEGMENTS_MAX = 256
+
+// Holds the state of online resharding
+//
+// While resharding, next is the target layout. The blocks of
+// the current layout are migrated to it one by one, in the
+// background, or when one of their keys is written.
+// Once all are migrated, next replaces the current layout.
+//
+// The zero value is ready to use.
+type reshardState struct {
+	mu          sync.RWMutex // read by ops, written to swap layouts
+	next        map[uint64]*Part
+	started     bool
+	segments    uint32
+	migrated    uint32 // atomic
+	total       uint32
+	uncommitted bool // layout not yet written to disk, guarded by persistMu
+}
+
+// Reshard starts moving all keys to a new layout with
+// the given number of segments, without blocking ops
+//
+// Progress is reported by ReshardProgress.
+// If persistence is enabled, the blocks of the new layout
+// are written with the others, & the new layout is committed
+// to disk once all keys are moved.
+func (s *Store) Reshard(segments int) error {
+	blocks, err := s.startReshard(segments)
+	if err != nil {
+		return err
+	}
+	go s.migrateAll(blocks)
+	return nil
+}
+
+// startReshard creates the next layout, & returns
+// the blocks of the current layout to migrate
+func (s *Store) startReshard(segments int) ([]*Block, error) {
+	if segments < 1 || segments > SEGMENTS_MAX {
+		return nil, errors.New(ErrReshardSegments)
+	}
+	// the previous layout must be on disk before starting again
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	r := &s.reshard
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.next != nil || r.uncommitted {
+		return nil, errors.New(ErrReshardActive)
+	}
+
+	// Every block of the next layout starts at the highest version,
+	// so versions keep increasing, even for deleted keys.
+	// No op is in flight, as the layout is locked.
+	blocks := make([]*Block, 0)
+	var version int64
+	for _, part := range s.Parts {
+		for _, b := range part.Blocks {
+			b.Mutex.RLock()
+			if b.Version > version {
+				version = b.Version
+			}
+			b.Mutex.RUnlock()
+			blocks = append(blocks, b)
+		}
+	}
+	next := newParts(segments, s.engine)
+	s.trackUsage(next)
+	s.accountMemory(next)
+	if s.persist {
+		// blocks of the next layout are written alongside,
+		// & its manifest marks the resharding as started
+		err := beginLayout(s.Dir)
+		if err != nil {
+			return nil, err
+		}
+		err = loadBlocks(next, s.Dir)
+		if err != nil {
+			return nil, err
+		}
+		err = writeManifest(path.Join(s.Dir, repartitionDirName), (&Store{Parts: next}).getManifest())
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, part := range next {
+		for _, b := range part.Blocks {
+			b.Version = version
+		}
+	}
+	s.trackRepl(next, false)
+	sort.Slice(blocks, func(i, j int) bool {
+		return bytes.Compare(blocks[i].Id, blocks[j].Id) < 0
+	})
+
+	r.next = next
+	r.started = true
+	r.segments = uint32(segments)
+	r.total = uint32(len(blocks))
+	atomic.StoreUint32(&r.migrated, 0)
+	fmt.Printf("resharding from %v to %v segments...\r\n", len(s.Parts), segments)
+	return blocks, nil
+}
+
+// ReshardProgress returns the progress of the
+// current or last resharding, and false if there was none
+func (s *Store) ReshardProgress() (*protocol.ReshardProgress, bool) {
+	r := &s.reshard
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !r.started {
+		return nil, false
+	}
+	return &protocol.ReshardProgress{
+		Segments: r.segments,
+		Migrated: atomic.LoadUint32(&r.migrated),
+		Total:    r.total,
+		Done:     r.next == nil,
+	}, true
+}
+
+// resharding returns true until all blocks are migrated
+func (s *Store) resharding() bool {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	return s.reshard.next != nil
+}
+
+// layouts returns the current layout,
+// and the next layout if resharding
+func (s *Store) layouts() (map[uint64]*Part, map[uint64]*Part) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	return s.Parts, s.reshard.next
+}
+
+// migrateAll migrates the given blocks of the current layout,
+// then swaps in the next layout
+func (s *Store) migrateAll(blocks []*Block) {
+	for _, b := range blocks {
+		s.reshard.mu.RLock()
+		s.migrate(b)
+		s.reshard.mu.RUnlock()
+	}
+	s.finishReshard()
+}
+
+// migrate moves the slots of a block of the current layout
+// to their blocks in the next layout, unless already migrated
+//
+// The migrated block is left empty, & is flagged to
+// have its files removed, once its keys are written
+// to disk in the next layout, see writeAllBlocks.
+//
+// The caller must hold the layout's read lock.
+func (s *Store) migrate(b *Block) {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	if b.migrated {
+		return
+	}
+	groups := make(map[*Block]map[string]Slot)
+	b.each(func(key string, slot Slot) bool {
+		nb := s.nextBlock(key)
+		if groups[nb] == nil {
+			groups[nb] = make(map[string]Slot)
+		}
+		groups[nb][key] = slot
+		return true
+	})
+	for nb, slots := range groups {
+		nb.Mutex.Lock()
+		for key, slot := range slots {
+			nb.put(key, slot, true)
+		}
+		nb.inheritSync(b)
+		nb.Mutex.Unlock()
+	}
+	// deletes not yet synced are synced from the next layout
+	for key, version := range b.deletes {
+		nb := s.nextBlock(key)
+		nb.Mutex.Lock()
+		if version > nb.deletes[key] {
+			nb.recordDelete(key, version)
+		}
+		nb.inheritSync(b)
+		nb.Mutex.Unlock()
+	}
+	before := b.engine.Memory()
+	b.engine.Close()
+	b.resized(before)
+	b.expiry = expiryIndex{}
+	b.deletes = nil
+	b.migrated = true
+	b.MustWrite = true
+	atomic.AddUint32(&s.reshard.migrated, 1)
+}
+
+// nextBlock returns the block of the key in the next layout
+//
+// The caller must hold the layout's read lock.
+func (s *Store) nextBlock(key string) *Block {
+	ns, name := path.Split(key)
+	h := hashKey(ns, name)
+	return closestPart(s.reshard.next, h).getClosestBlock(h)
+}
+
+// removeFiles removes the files of a migrated block
+//
+// The files are removed once, as the block is flagged
+// to be written when migrated.
+func (b *Block) removeFiles(dir string) error {
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	if !b.MustWrite {
+		return nil
+	}
+	name := util.GetName(b.Id)
+	for _, ext := range []string{blockFileExt, legacyBlockFileExt, logDirExt} {
+		err := os.RemoveAll(path.Join(dir, name+ext))
+		if err != nil {
+			return fmt.Errorf("failed to remove block %s: %w", name, err)
+		}
+	}
+	err := syncDir(dir)
+	if err != nil {
+		return err
+	}
+	b.MustWrite = false
+	return nil
+}
+
+// resumeReshard completes a resharding interrupted by a crash
+//
+// While resharding, keys are written to disk in the next
+// layout, & the files of migrated blocks are removed. So the
+// keys left in the current layout are moved to the next, the
+// newer version winning, & the next layout is committed.
+// If no resharding was started, files left by an
+// interrupted repartition are removed.
+//
+// Must be called after the blocks are loaded,
+// & before the wal is replayed.
+func resumeReshard(st *Store) error {
+	manifest, err := readManifest(path.Join(st.Dir, repartitionDirName))
+	if errors.Is(err, os.ErrNotExist) {
+		return cleanupRepartition(st.Dir, st.Parts)
+	}
+	if err != nil {
+		return err
+	}
+	next := partsFromManifest(manifest, st.engine)
+	fmt.Printf("resuming resharding to %v segments...\r\n", len(next))
+	err = loadBlocks(next, st.Dir)
+	if err != nil {
+		return err
+	}
+	count := remap(st.Parts, next)
+	err = commitLayout(st.Dir, next)
+	if err != nil {
+		return err
+	}
+	closeBlocks(st.Parts)
+	st.Parts = next
+	fmt.Printf("resharded to %v segments, moved %v keys\r\n", len(next), count)
+	return nil
+}
+
+// finishReshard replaces the current layout with the next,
+// & commits it to disk if persistence is enabled
+func (s *Store) finishReshard() {
+	s.persistMu.Lock()
+	r := &s.reshard
+	r.mu.Lock()
+	s.Parts = r.next
+	r.next = nil
+	r.uncommitted = s.persist
+	segments := r.segments
+	r.mu.Unlock()
+	s.persistMu.Unlock()
+	fmt.Printf("resharded to %v segments\r\n", segments)
+	if s.persist {
+		s.Checkpoint(s.Dir)
+	}
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/util"
+)
+
+// waitForReshard polls the progress until done
+func waitForReshard(t *testing.T, s *Store) {
+	for i := 0; i < 1000; i++ {
+		progress, ok := s.ReshardProgress()
+		if ok && progress.Done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("resharding did not finish")
+}
+
+// Tests that keys written before & during resharding
+// are all found in the new layout
+func TestReshard(t *testing.T) {
+	s := getTestStore(2, false)
+	for i := 0; i < 500; i++ {
+		s.Set(fmt.Sprintf("ns%v/key%v", i%13, i), Slot{Value: []byte{byte(i)}}, false)
+	}
+	before, _ := s.Get("ns0/key0")
+
+	err := s.Reshard(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read, write & delete while migrating
+	wg := new(sync.WaitGroup)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 500; i += 4 {
+				key := fmt.Sprintf("ns%v/key%v", i%13, i)
+				slot, found := s.Get(key)
+				if !found || slot.Value[0] != byte(i) {
+					t.Errorf("expected %s during resharding", key)
+					return
+				}
+				if i%10 == 0 {
+					s.Del(key)
+				}
+				s.Set(fmt.Sprintf("new/key%v", i), Slot{Value: []byte{byte(i)}}, false)
+			}
+		}(w)
+	}
+	wg.Wait()
+	waitForReshard(t, s)
+
+	if len(s.Parts) != 4 {
+		t.Fatalf("expected 4 parts, got %v", len(s.Parts))
+	}
+	for i := 0; i < 500; i++ {
+		slot, found := s.Get(fmt.Sprintf("ns%v/key%v", i%13, i))
+		if found != (i%10 != 0) {
+			t.Fatalf("unexpected key%v found: %v", i, found)
+		}
+		if found && slot.Value[0] != byte(i) {
+			t.Fatalf("unexpected value for key%v", i)
+		}
+		_, found = s.Get(fmt.Sprintf("new/key%v", i))
+		if !found {
+			t.Fatalf("expected new/key%v", i)
+		}
+	}
+	if count := s.Count(""); count != 950 {
+		t.Fatalf("expected 950 keys, got %v", count)
+	}
+	// versions keep increasing
+	v := s.Set("ns0/key0", Slot{}, false)
+	if v <= before.Modified {
+		t.Fatalf("expected version above %v, got %v", before.Modified, v)
+	}
+	progress, _ := s.ReshardProgress()
+	if progress.Migrated != progress.Total || progress.Segments != 4 {
+		t.Fatalf("unexpected progress %+v", progress)
+	}
+}
+
+// Tests that a key is listed once while resharding
+func TestListWhileResharding(t *testing.T) {
+	s := getTestStore(2, false)
+	s.Set("a", Slot{}, false)
+	s.Set("b", Slot{}, false)
+	s.reshard.mu.Lock()
+	s.reshard.next = newParts(3, EngineMemory)
+	s.reshard.mu.Unlock()
+	// migrate only the block of a
+	s.reshard.mu.RLock()
+	s.locate("a")
+	s.reshard.mu.RUnlock()
+
+	if count := s.Count(""); count != 2 {
+		t.Fatalf("expected 2 keys, got %v", count)
+	}
+	slot, found := s.Get("a")
+	if !found || slot.Modified != 1 {
+		t.Fatal("expected a in the next layout")
+	}
+}
+
+func TestReshardActive(t *testing.T) {
+	s := getTestStore(2, false)
+	s.reshard.uncommitted = true
+	err := s.Reshard(4)
+	if err == nil || err.Error() != ErrReshardActive {
+		t.Fatalf("expected %s, got %v", ErrReshardActive, err)
+	}
+	err = s.Reshard(0)
+	if err == nil || err.Error() != ErrReshardSegments {
+		t.Fatalf("expected %s, got %v", ErrReshardSegments, err)
+	}
+}
+
+// Tests that the new layout is committed to disk,
+// with each engine
+func TestReshardPersist(t *testing.T) {
+	for name := range engines {
+		t.Run(name, func(t *testing.T) {
+			testReshardPersist(t, name)
+		})
+	}
+}
+
+func testReshardPersist(t *testing.T, engine string) {
+	dir := t.TempDir()
+	s := &Store{Dir: dir, Parts: newParts(2, engine), persist: true, engine: engine}
+	err := loadBlocks(s.Parts, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(dir, s.getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("key%v", i), Slot{Value: []byte{byte(i)}}, false)
+	}
+	s.Checkpoint(dir)
+
+	err = s.Reshard(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForReshard(t, s)
+	// the commit follows the swap
+	for i := 0; ; i++ {
+		s.persistMu.Lock()
+		uncommitted := s.reshard.uncommitted
+		s.persistMu.Unlock()
+		if !uncommitted {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("expected layout to be committed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer closeBlocks(s.Parts)
+
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 3 {
+		t.Fatalf("expected manifest with 3 parts, got %v", len(manifest))
+	}
+	loaded := &Store{Parts: partsFromManifest(manifest, engine)}
+	err = loadBlocks(loaded.Parts, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBlocks(loaded.Parts)
+	if count := loaded.Count(""); count != 100 {
+		t.Fatalf("expected 100 keys on disk, got %v", count)
+	}
+	live := make(map[string]bool)
+	for _, part := range loaded.Parts {
+		for _, b := range part.Blocks {
+			live[util.GetName(b.Id)] = true
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if isBlockFile(e.Name()) && !live[blockFileId(e.Name())] {
+			t.Fatalf("expected files of the previous layout to be removed, found %s", e.Name())
+		}
+	}
+}
+
+// Tests that checkpoints while resharding write the next
+// layout & truncate the wal, & that a resharding interrupted
+// by a crash is completed from the files, with each engine
+func TestReshardCheckpoint(t *testing.T) {
+	for name := range engines {
+		t.Run(name, func(t *testing.T) {
+			testReshardCheckpoint(t, name)
+		})
+	}
+}
+
+func testReshardCheckpoint(t *testing.T, engine string) {
+	dir := t.TempDir()
+	s := &Store{Dir: dir, Parts: newParts(2, engine), persist: true, engine: engine}
+	err := loadBlocks(s.Parts, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(dir, s.getManifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal, err = OpenWal(path.Join(dir, walDirName), WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("key%v", i), Slot{Value: []byte{byte(i)}}, false)
+	}
+	s.Checkpoint(dir)
+
+	blocks, err := s.startReshard(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reshard.mu.RLock()
+	for _, b := range blocks[:len(blocks)/2] {
+		s.migrate(b)
+	}
+	s.reshard.mu.RUnlock()
+	for i := 0; i < 100; i += 10 {
+		s.Del(fmt.Sprintf("key%v", i))
+		s.Set(fmt.Sprintf("new%v", i), Slot{}, false)
+	}
+	seq := s.wal.seq
+	s.Checkpoint(dir)
+	segments, _ := s.wal.segments()
+	if len(segments) != 1 || segments[0] != seq+1 {
+		t.Fatalf("expected wal to be rotated & truncated, got segments %v", segments)
+	}
+
+	// crash, without replaying the wal
+	s.wal.Close()
+	current, next := s.layouts()
+	closeBlocks(current)
+	closeBlocks(next)
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered := &Store{Dir: dir, Parts: partsFromManifest(manifest, engine), persist: true, engine: engine}
+	err = loadBlocks(recovered.Parts, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = resumeReshard(recovered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBlocks(recovered.Parts)
+	if len(recovered.Parts) != 3 {
+		t.Fatalf("expected 3 parts, got %v", len(recovered.Parts))
+	}
+	for i := 0; i < 100; i++ {
+		slot, found := recovered.Get(fmt.Sprintf("key%v", i))
+		if found != (i%10 != 0) || found && slot.Value[0] != byte(i) {
+			t.Fatalf("unexpected key%v found: %v", i, found)
+		}
+	}
+	if count := recovered.Count(""); count != 100 {
+		t.Fatalf("expected 100 keys, got %v", count)
+	}
+	manifest, _ = readManifest(dir)
+	if len(manifest) != 3 {
+		t.Fatalf("expected next layout to be committed, got %v parts", len(manifest))
+	}
+}
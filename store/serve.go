@@ -5,55 +5,89 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/intob/rocketkv/protocol"
 )
 
+// session holds the state of a single connection
+type session struct {
+	conn    net.Conn
+	framing protocol.Framing
+	authed  bool
+	hello   *protocol.Hello     // negotiated, nil until hello is received
+	msgLen  int                 // of the longest msg read
+	mu      *sync.Mutex         // serialises writes, as watches write concurrently
+	watchMu *sync.Mutex         // guards watches
+	watches map[uint32]*Watcher // by req id, until the final msg is sent
+}
+
 // ServeConn handles reading & writing messages
 // from & to a connection
+//
+// The framing mode is +END, unless the client
+// starts the connection with a framing preamble.
 func (st *Store) ServeConn(conn net.Conn, authSecret string, bufferSize int) {
-	authed := authSecret == ""
+	defer conn.Close()
+	sess := &session{
+		conn:    conn,
+		authed:  authSecret == "",
+		msgLen:  bufferSize,
+		mu:      new(sync.Mutex),
+		watchMu: new(sync.Mutex),
+		watches: make(map[uint32]*Watcher),
+	}
+	defer sess.unwatchAll(st)
+
+	r := bufio.NewReader(conn)
+	framing, err := protocol.ReadFraming(r)
+	if err != nil {
+		return
+	}
+	sess.framing = framing
 
 	buf := make([]byte, bufferSize)
-	scan := bufio.NewScanner(conn)
+	scan := bufio.NewScanner(r)
 	scan.Buffer(buf, cap(buf))
-	scan.Split(protocol.SplitPlusEnd)
+	scan.Split(framing.SplitFunc())
 
-loop:
 	for scan.Scan() {
 		mBytes := scan.Bytes()
 		msg, err := protocol.DecodeMsg(mBytes)
 		if err != nil {
 			fmt.Println(err)
-			break loop
+			return
 		}
 
-		if !authed && msg.Op == protocol.OpAuth {
-			authed = handleAuth(conn, msg, authSecret)
-			if !authed {
-				break loop
+		if !sess.authed && msg.Op == protocol.OpAuth {
+			sess.authed = handleAuth(sess, msg, authSecret)
+			if !sess.authed {
+				return
 			}
 			continue
 		}
 
-		err = st.handle(conn, msg, authed)
+		err = st.handle(sess, msg)
 		if err != nil {
-			break loop
+			return
 		}
 	}
-
-	conn.Close()
 }
 
 // handle is the main handler for messages
-func (st *Store) handle(conn net.Conn, msg *protocol.Msg, authed bool) error {
+func (st *Store) handle(sess *session, msg *protocol.Msg) error {
 	switch msg.Op {
 	case protocol.OpPing:
-		return handlePing(conn)
+		return handlePing(sess, msg)
+	case protocol.OpHello:
+		return handleHello(sess, msg, st)
 	default: // gatekeeping
-		if !authed {
-			respond(conn, &protocol.Msg{
+		if !sess.authed {
+			sess.respond(msg, &protocol.Msg{
 				Status: protocol.StatusUnauthorized,
 			})
 			return errors.New("unauthorized")
@@ -63,19 +97,55 @@ func (st *Store) handle(conn net.Conn, msg *protocol.Msg, authed bool) error {
 	// requires auth
 	switch msg.Op {
 	case protocol.OpGet:
-		return handleGet(conn, msg, st)
+		return handleGet(sess, msg, st)
+	case protocol.OpMGet:
+		return handleMGet(sess, msg, st)
+	case protocol.OpMSet:
+		return handleMSet(sess, msg, st)
+	case protocol.OpMDel:
+		return handleMDel(sess, msg, st)
 	case protocol.OpSet:
-		return handleSet(conn, msg, st)
+		return handleSet(sess, msg, st)
 	case protocol.OpSetAck:
-		return handleSet(conn, msg, st)
+		return handleSet(sess, msg, st)
+	case protocol.OpCas:
+		return handleCas(sess, msg, st)
+	case protocol.OpExpire:
+		return handleExpire(sess, msg, st)
+	case protocol.OpPersist:
+		return handleExpire(sess, msg, st)
+	case protocol.OpTtl:
+		return handleTtl(sess, msg, st)
 	case protocol.OpDel:
-		return handleDel(conn, msg, st)
+		return handleDel(sess, msg, st)
 	case protocol.OpDelAck:
-		return handleDel(conn, msg, st)
+		return handleDel(sess, msg, st)
 	case protocol.OpList:
-		return handleList(conn, msg, st)
+		return handleList(sess, msg, st)
 	case protocol.OpCount:
-		return handleCount(conn, msg, st)
+		return handleCount(sess, msg, st)
+	case protocol.OpTxn:
+		return handleTxn(sess, msg, st)
+	case protocol.OpWatch:
+		return handleWatch(sess, msg, st)
+	case protocol.OpWatchExpired:
+		return handleWatch(sess, msg, st)
+	case protocol.OpUnwatch:
+		return handleUnwatch(sess, msg, st)
+	case protocol.OpIncr:
+		return handleIncr(sess, msg, st)
+	case protocol.OpDecr:
+		return handleIncr(sess, msg, st)
+	case protocol.OpReshard:
+		return handleReshard(sess, msg, st)
+	case protocol.OpReshardStatus:
+		return handleReshardStatus(sess, msg, st)
+	case protocol.OpStats:
+		return handleStats(sess, msg, st)
+	case protocol.OpSnapshot:
+		return handleSnapshot(sess, msg, st)
+	case protocol.OpRepl:
+		return handleRepl(sess, msg, st)
 	case protocol.OpClose:
 		return errors.New("closed by client")
 	default:
@@ -83,82 +153,197 @@ func (st *Store) handle(conn net.Conn, msg *protocol.Msg, authed bool) error {
 	}
 }
 
-func handlePing(conn net.Conn) error {
-	return respond(conn, &protocol.Msg{
+func handlePing(sess *session, msg *protocol.Msg) error {
+	return sess.respond(msg, &protocol.Msg{
 		Op:     protocol.OpPong,
 		Status: protocol.StatusOk,
 	})
 }
 
-func handleAuth(conn net.Conn, msg *protocol.Msg, secret string) bool {
+// handleHello responds with the version & capabilities
+// supported by both the server & the client
+func handleHello(sess *session, msg *protocol.Msg, st *Store) error {
+	peer, err := protocol.DecodeHello(msg)
+	if err != nil {
+		sess.respondWithStatus(msg, protocol.StatusError)
+		return err
+	}
+	server := &protocol.Hello{
+		Version:   protocol.PROTOCOL_VERSION,
+		Caps:      protocol.CAPS,
+		Build:     st.Build,
+		MsgLenMax: uint32(sess.msgLen),
+	}
+	sess.hello = server.Negotiate(peer)
+	return sess.respond(msg, protocol.EncodeHello(sess.hello, protocol.OpHello, protocol.StatusOk))
+}
+
+func handleAuth(sess *session, msg *protocol.Msg, secret string) bool {
 	authed := msg.Key == secret
 	if authed {
-		respondWithStatus(conn, protocol.StatusOk)
+		sess.respondWithStatus(msg, protocol.StatusOk)
 	} else {
-		respondWithStatus(conn, protocol.StatusUnauthorized)
+		sess.respondWithStatus(msg, protocol.StatusUnauthorized)
 	}
 	return authed
 }
 
-func handleGet(conn net.Conn, msg *protocol.Msg, st *Store) error {
+func handleGet(sess *session, msg *protocol.Msg, st *Store) error {
 	slot, found := st.Get(msg.Key)
 	if !found {
-		return respondWithStatus(conn, protocol.StatusNotFound)
+		return sess.respondWithStatus(msg, protocol.StatusNotFound)
 	}
-	return respond(conn, &protocol.Msg{
+	resp := &protocol.Msg{
 		Status:  protocol.StatusOk,
 		Key:     msg.Key,
 		Value:   slot.Value,
-		Expires: slot.Expires,
-	})
+		Expires: expiresTo(slot.Expires, sess.version()),
+	}
+	if sess.supports(2) {
+		resp.Modified = slot.Modified
+	}
+	return sess.respond(msg, resp)
 }
 
-func handleSet(conn net.Conn, msg *protocol.Msg, st *Store) error {
+func handleSet(sess *session, msg *protocol.Msg, st *Store) error {
 	slot := Slot{
 		Value:   msg.Value,
-		Expires: msg.Expires,
+		Expires: sess.expiresIn(msg),
 	}
 	st.Set(msg.Key, slot, false)
 	if msg.Op == protocol.OpSetAck {
-		return respondWithStatus(conn, protocol.StatusOk)
+		return sess.respondWithStatus(msg, protocol.StatusOk)
 	}
 	return nil
 }
 
-func handleDel(conn net.Conn, msg *protocol.Msg, st *Store) error {
+// handleCas sets the slot if msg.Modified equals
+// the current version, 0 meaning the key must not exist
+//
+// Responds with the new version, or with a conflict
+// & the current version.
+func handleCas(sess *session, msg *protocol.Msg, st *Store) error {
+	slot := Slot{
+		Value:   msg.Value,
+		Expires: sess.expiresIn(msg),
+	}
+	version, ok := st.Cas(msg.Key, slot, msg.Modified)
+	resp := &protocol.Msg{
+		Op:     protocol.OpCas,
+		Status: protocol.StatusOk,
+		Key:    msg.Key,
+	}
+	if !ok {
+		resp.Status = protocol.StatusConflict
+	}
+	if sess.supports(2) {
+		resp.Modified = version
+	}
+	return sess.respond(msg, resp)
+}
+
+// handleExpire sets the expiry of the key to the msg's
+// expires or ttl, or clears it for Persist
+//
+// Responds with the version, or NotFound if the key
+// doesn't exist. Expire without an expiry is an error.
+func handleExpire(sess *session, msg *protocol.Msg, st *Store) error {
+	var expires int64
+	if msg.Op == protocol.OpExpire {
+		expires = sess.expiresIn(msg)
+		if expires <= 0 {
+			return sess.respondWithStatus(msg, protocol.StatusError)
+		}
+	}
+	version, found := st.Expire(msg.Key, expires)
+	if !found {
+		return sess.respondWithStatus(msg, protocol.StatusNotFound)
+	}
+	resp := &protocol.Msg{
+		Op:     msg.Op,
+		Status: protocol.StatusOk,
+		Key:    msg.Key,
+	}
+	if sess.supports(2) {
+		resp.Modified = version
+	}
+	return sess.respond(msg, resp)
+}
+
+// handleTtl responds with the expiry of the key, & the
+// remaining milliseconds as INT64 value, -1 if it doesn't expire
+//
+// Responds with NotFound if the key doesn't exist.
+func handleTtl(sess *session, msg *protocol.Msg, st *Store) error {
+	expires, version, found := st.Expiry(msg.Key)
+	if !found {
+		return sess.respondWithStatus(msg, protocol.StatusNotFound)
+	}
+	ttl := int64(-1)
+	if expires != 0 {
+		ttl = expires - time.Now().UnixMilli()
+		if ttl < 0 {
+			ttl = 0
+		}
+	}
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(ttl))
+	resp := &protocol.Msg{
+		Op:      msg.Op,
+		Status:  protocol.StatusOk,
+		Key:     msg.Key,
+		Value:   value,
+		Expires: expiresTo(expires, sess.version()),
+	}
+	if sess.supports(2) {
+		resp.Modified = version
+	}
+	return sess.respond(msg, resp)
+}
+
+func handleDel(sess *session, msg *protocol.Msg, st *Store) error {
 	st.Del(msg.Key)
 	if msg.Op == protocol.OpDelAck {
-		return respondWithStatus(conn, protocol.StatusOk)
+		return sess.respondWithStatus(msg, protocol.StatusOk)
 	}
 	return nil
 }
 
-func handleList(conn net.Conn, msg *protocol.Msg, st *Store) error {
-	buf := bufio.NewWriter(conn)
+// handleList streams the keys with the prefix,
+// ending with StreamEnd
+//
+// Before protocol version 2, keys were sent without status.
+func handleList(sess *session, msg *protocol.Msg, st *Store) error {
+	var status byte
+	if sess.supports(2) {
+		status = protocol.StatusOk
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	buf := bufio.NewWriter(sess.conn)
 	for k := range st.List(msg.Key, 100) {
-		enc, err := protocol.EncodeMsg(&protocol.Msg{
-			Key: k,
+		err := sess.write(buf, msg, &protocol.Msg{
+			Status: status,
+			Key:    k,
 		})
 		if err != nil {
 			return err
 		}
-		_, err = buf.Write(enc)
-		if err != nil {
-			return err
-		}
 	}
-	err := buf.Flush()
+	err := sess.write(buf, msg, &protocol.Msg{
+		Status: protocol.StatusStreamEnd,
+	})
 	if err != nil {
 		return err
 	}
-	return respondWithStatus(conn, protocol.StatusStreamEnd)
+	return buf.Flush()
 }
 
-func handleCount(conn net.Conn, msg *protocol.Msg, st *Store) error {
+func handleCount(sess *session, msg *protocol.Msg, st *Store) error {
 	count := st.Count(msg.Key)
 	countBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(countBytes, count)
-	return respond(conn, &protocol.Msg{
+	return sess.respond(msg, &protocol.Msg{
 		Op:     protocol.OpCount,
 		Status: protocol.StatusOk,
 		Key:    msg.Key,
@@ -166,17 +351,489 @@ func handleCount(conn net.Conn, msg *protocol.Msg, st *Store) error {
 	})
 }
 
-func respond(conn net.Conn, resp *protocol.Msg) error {
+// handleIncr adds (or subtracts for decr) the delta
+// given as big endian int64 value, 1 if the value is empty
+//
+// Responds with the new value.
+func handleIncr(sess *session, msg *protocol.Msg, st *Store) error {
+	delta := int64(1)
+	if len(msg.Value) > 0 {
+		if len(msg.Value) != COUNTER_LEN {
+			return sess.respondWithStatus(msg, protocol.StatusError)
+		}
+		delta = int64(binary.BigEndian.Uint64(msg.Value))
+	}
+	if msg.Op == protocol.OpDecr {
+		if delta == math.MinInt64 {
+			return sess.respondWithStatus(msg, protocol.StatusError)
+		}
+		delta = -delta
+	}
+	value, version, err := st.Incr(msg.Key, delta, sess.expiresIn(msg))
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	resp := &protocol.Msg{
+		Op:     msg.Op,
+		Status: protocol.StatusOk,
+		Key:    msg.Key,
+		Value:  EncodeCounter(value),
+	}
+	if sess.supports(2) {
+		resp.Modified = version
+	}
+	return sess.respond(msg, resp)
+}
+
+// handleMGet responds with an entry for each requested key
+//
+// Found keys have status OK, others NotFound.
+func handleMGet(sess *session, msg *protocol.Msg, st *Store) error {
+	entries, err := protocol.DecodeBatch(msg.Value)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	slots, found := st.MGet(batchKeys(entries))
+	for i := range entries {
+		e := &entries[i]
+		if !found[i] {
+			e.Status = protocol.StatusNotFound
+			continue
+		}
+		e.Status = protocol.StatusOk
+		e.Value = slots[i].Value
+		e.Expires = expiresTo(slots[i].Expires, sess.version())
+		e.Modified = slots[i].Modified
+	}
+	return respondWithBatch(sess, msg, entries)
+}
+
+// handleMSet responds with the new version of each key
+func handleMSet(sess *session, msg *protocol.Msg, st *Store) error {
+	entries, err := protocol.DecodeBatch(msg.Value)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	slots := make([]Slot, len(entries))
+	for i, e := range entries {
+		slots[i] = Slot{
+			Value:   e.Value,
+			Expires: expiresFrom(e.Expires, sess.version()),
+		}
+	}
+	versions := st.MSet(batchKeys(entries), slots)
+	for i := range entries {
+		entries[i] = protocol.Entry{
+			Status:   protocol.StatusOk,
+			Key:      entries[i].Key,
+			Modified: versions[i],
+		}
+	}
+	return respondWithBatch(sess, msg, entries)
+}
+
+// handleMDel responds with status OK for each deleted key,
+// and NotFound for keys that did not exist
+func handleMDel(sess *session, msg *protocol.Msg, st *Store) error {
+	entries, err := protocol.DecodeBatch(msg.Value)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	found := st.MDel(batchKeys(entries))
+	for i := range entries {
+		entries[i] = protocol.Entry{
+			Status: protocol.StatusOk,
+			Key:    entries[i].Key,
+		}
+		if !found[i] {
+			entries[i].Status = protocol.StatusNotFound
+		}
+	}
+	return respondWithBatch(sess, msg, entries)
+}
+
+// handleTxn applies the entries of the batch atomically
+//
+// Entry ops are Get (check version), Set, Cas & Del.
+// If a check fails, responds with Conflict,
+// and sets Conflict as status of each failed entry.
+// Each result entry has the key's version.
+func handleTxn(sess *session, msg *protocol.Msg, st *Store) error {
+	entries, err := protocol.DecodeBatch(msg.Value)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	steps := make([]TxnStep, len(entries))
+	for i, e := range entries {
+		steps[i] = TxnStep{
+			Key:      e.Key,
+			Expected: e.Modified,
+			Slot: Slot{
+				Value:   e.Value,
+				Expires: expiresFrom(e.Expires, sess.version()),
+			},
+		}
+		switch e.Op {
+		case protocol.OpGet:
+			steps[i].Kind = TxnCheck
+		case protocol.OpSet, protocol.OpSetAck:
+			steps[i].Kind = TxnSet
+		case protocol.OpCas:
+			steps[i].Kind = TxnCas
+		case protocol.OpDel, protocol.OpDelAck:
+			steps[i].Kind = TxnDel
+		default:
+			return sess.respondWithStatus(msg, protocol.StatusError)
+		}
+	}
+	versions, ok := st.Txn(steps)
+	for i := range entries {
+		e := &entries[i]
+		e.Status = protocol.StatusOk
+		if !ok && (steps[i].Kind == TxnCheck || steps[i].Kind == TxnCas) &&
+			versions[i] != steps[i].Expected {
+			e.Status = protocol.StatusConflict
+		}
+		e.Value = nil
+		e.Modified = versions[i]
+	}
+	value, err := protocol.EncodeBatch(entries)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	resp := &protocol.Msg{
+		Op:     msg.Op,
+		Status: protocol.StatusOk,
+		Value:  value,
+	}
+	if !ok {
+		resp.Status = protocol.StatusConflict
+	}
+	return sess.respond(msg, resp)
+}
+
+// handleWatch subscribes the session to events
+// for keys with the prefix given as key
+//
+// For WatchExpired, only Expired events are sent, without
+// the last value, unless the msg's value is 1.
+// The watch is identified by the req id, which must not be 0.
+// Responds with OK, followed by an event msg per change,
+// see forwardEvents. Responds with Conflict if a watch with
+// the req id has not yet sent its final msg.
+func handleWatch(sess *session, msg *protocol.Msg, st *Store) error {
+	if msg.ReqId == 0 {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	sess.watchMu.Lock()
+	_, active := sess.watches[msg.ReqId]
+	sess.watchMu.Unlock()
+	if active {
+		// the final msg of the watch would end the new one
+		return sess.respondWithStatus(msg, protocol.StatusConflict)
+	}
+	var w *Watcher
+	withValue := true
+	if msg.Op == protocol.OpWatchExpired {
+		w = st.WatchOps(msg.Key, st.WatchBuffer, protocol.OpExpired)
+		withValue = len(msg.Value) == 1 && msg.Value[0] == 1
+	} else {
+		w = st.Watch(msg.Key, st.WatchBuffer)
+	}
+	sess.watchMu.Lock()
+	sess.watches[msg.ReqId] = w
+	sess.watchMu.Unlock()
+	err := sess.respond(msg, &protocol.Msg{
+		Op:     msg.Op,
+		Status: protocol.StatusOk,
+		Key:    msg.Key,
+	})
+	go sess.forwardEvents(msg, w, sess.version(), withValue)
+	return err
+}
+
+// handleUnwatch ends the watch with the req id
+// given as big endian uint32 value
+func handleUnwatch(sess *session, msg *protocol.Msg, st *Store) error {
+	if len(msg.Value) != 4 {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	id := binary.BigEndian.Uint32(msg.Value)
+	sess.watchMu.Lock()
+	w, ok := sess.watches[id]
+	sess.watchMu.Unlock()
+	if !ok {
+		return sess.respondWithStatus(msg, protocol.StatusNotFound)
+	}
+	st.Unwatch(w)
+	return sess.respondWithStatus(msg, protocol.StatusOk)
+}
+
+// forwardEvents writes a msg for each event of the watcher,
+// with the op of the event, for the negotiated protocol version
+//
+// When the watch ends, a final msg with the op of the request
+// follows, with status StreamEnd, or Error if events were dropped.
+func (sess *session) forwardEvents(req *protocol.Msg, w *Watcher, version uint16, withValue bool) {
+	for e := range w.Events {
+		resp := &protocol.Msg{
+			Op:      e.Op,
+			Status:  protocol.StatusOk,
+			Key:     e.Key,
+			Expires: expiresTo(e.Slot.Expires, version),
+		}
+		if withValue {
+			resp.Value = e.Slot.Value
+		}
+		if version >= 2 {
+			resp.Modified = e.Slot.Modified
+		}
+		// on error, keep draining until the session ends
+		sess.respond(req, resp)
+	}
+	status := protocol.StatusStreamEnd
+	if w.Overflowed() {
+		status = protocol.StatusError
+	}
+	// The req id may be watched again once removed. The write lock
+	// is held, so the response to a new watch follows the final msg.
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.watchMu.Lock()
+	if sess.watches[req.ReqId] == w {
+		delete(sess.watches, req.ReqId)
+	}
+	sess.watchMu.Unlock()
+	sess.write(sess.conn, req, &protocol.Msg{
+		Op:     req.Op,
+		Status: status,
+		Key:    w.Prefix,
+	})
+}
+
+// unwatchAll ends all watches of the session
+func (sess *session) unwatchAll(st *Store) {
+	sess.watchMu.Lock()
+	defer sess.watchMu.Unlock()
+	for _, w := range sess.watches {
+		st.Unwatch(w)
+	}
+}
+
+func batchKeys(entries []protocol.Entry) []string {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	return keys
+}
+
+func respondWithBatch(sess *session, msg *protocol.Msg, entries []protocol.Entry) error {
+	value, err := protocol.EncodeBatch(entries)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	return sess.respond(msg, &protocol.Msg{
+		Op:     msg.Op,
+		Status: protocol.StatusOk,
+		Value:  value,
+	})
+}
+
+// supports returns true if the negotiated
+// protocol version is at least the given version
+func (sess *session) supports(version uint16) bool {
+	return sess.version() >= version
+}
+
+// version returns the negotiated protocol version,
+// or 1 if there was no hello
+func (sess *session) version() uint16 {
+	if sess.hello == nil {
+		return 1
+	}
+	return sess.hello.Version
+}
+
+// expiresIn returns the expiry of the msg in Unix milliseconds
+//
+// A Ttl is relative to now, & takes precedence over Expires.
+func (sess *session) expiresIn(msg *protocol.Msg) int64 {
+	if msg.Ttl > 0 {
+		return time.Now().UnixMilli() + msg.Ttl
+	}
+	return expiresFrom(msg.Expires, sess.version())
+}
+
+// expiresFrom converts an expiry sent by a peer of the
+// protocol version to Unix milliseconds
+//
+// Below version 3, expiry is in Unix seconds.
+func expiresFrom(expires int64, version uint16) int64 {
+	if version < 3 {
+		return expires * 1000
+	}
+	return expires
+}
+
+// expiresTo converts an expiry in Unix milliseconds
+// to the unit of the protocol version
+//
+// Seconds are rounded up, so a key is not
+// reported to expire before it does.
+func expiresTo(expires int64, version uint16) int64 {
+	if version < 3 && expires > 0 {
+		return (expires + 999) / 1000
+	}
+	return expires
+}
+
+// respond encodes, frames & writes the response
+// to the given request msg
+//
+// The request id is echoed in the response.
+func (sess *session) respond(req, resp *protocol.Msg) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.write(sess.conn, req, resp)
+}
+
+// write encodes, frames & writes the response to w,
+// the caller must hold the write lock
+func (sess *session) write(w io.Writer, req, resp *protocol.Msg) error {
+	resp.ReqId = req.ReqId
 	respEnc, err := protocol.EncodeMsg(resp)
 	if err != nil {
 		return err
 	}
-	_, err = conn.Write(respEnc)
+	_, err = w.Write(sess.framing.Frame(respEnc))
 	return err
 }
 
-func respondWithStatus(conn net.Conn, status byte) error {
-	return respond(conn, &protocol.Msg{
+func (sess *session) respondWithStatus(req *protocol.Msg, status byte) error {
+	return sess.respond(req, &protocol.Msg{
+		Status: status,
+	})
+}
+
+// handleReshard starts online resharding
+// to the number of segments given as value
+//
+// Responds with Conflict if resharding is in progress.
+func handleReshard(sess *session, msg *protocol.Msg, st *Store) error {
+	segments, err := protocol.DecodeReshard(msg)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	err = st.Reshard(int(segments))
+	if err != nil {
+		if err.Error() == ErrReshardActive {
+			return sess.respondWithStatus(msg, protocol.StatusConflict)
+		}
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	return sess.respondWithStatus(msg, protocol.StatusOk)
+}
+
+// handleReshardStatus responds with the progress of the
+// current or last resharding, or NotFound if there was none
+func handleReshardStatus(sess *session, msg *protocol.Msg, st *Store) error {
+	progress, ok := st.ReshardProgress()
+	if !ok {
+		return sess.respondWithStatus(msg, protocol.StatusNotFound)
+	}
+	return sess.respond(msg, &protocol.Msg{
+		Op:     protocol.OpReshardStatus,
+		Status: protocol.StatusOk,
+		Value:  protocol.EncodeReshardProgress(progress),
+	})
+}
+
+// handleStats responds with the counters of the store
+func handleStats(sess *session, msg *protocol.Msg, st *Store) error {
+	return sess.respond(msg, &protocol.Msg{
+		Op:     protocol.OpStats,
+		Status: protocol.StatusOk,
+		Value:  protocol.EncodeStats(st.Stats()),
+	})
+}
+
+// handleRepl applies a batch of writes & deletes
+// replicated from a leader, keeping their versions
+//
+// Entries older than the stored slot are skipped.
+// Responds with Error, applying nothing, if an entry's
+// op is not Set or Del.
+func handleRepl(sess *session, msg *protocol.Msg, st *Store) error {
+	entries, err := protocol.DecodeBatch(msg.Value)
+	if err != nil {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	for _, e := range entries {
+		if e.Op != protocol.OpSet && e.Op != protocol.OpDel {
+			return sess.respondWithStatus(msg, protocol.StatusError)
+		}
+	}
+	for _, e := range entries {
+		if e.Op == protocol.OpDel {
+			st.ReplDel(e.Key, e.Modified)
+			continue
+		}
+		st.Set(e.Key, Slot{
+			Value:    e.Value,
+			Expires:  expiresFrom(e.Expires, sess.version()),
+			Modified: e.Modified,
+		}, true)
+	}
+	return sess.respondWithStatus(msg, protocol.StatusOk)
+}
+
+// handleSnapshot streams a snapshot archive in chunks
+// of SNAPSHOT_CHUNK_LEN, ending with StreamEnd
+//
+// Requires length-prefixed framing, as the archive is binary.
+// If the snapshot fails, the stream ends with Error.
+func handleSnapshot(sess *session, msg *protocol.Msg, st *Store) error {
+	if sess.framing != protocol.FramingLenPrefix {
+		return sess.respondWithStatus(msg, protocol.StatusError)
+	}
+	pr, pw := io.Pipe()
+	// unblocks the snapshot if the connection fails
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(st.Snapshot(pw))
+	}()
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	buf := bufio.NewWriter(sess.conn)
+	chunk := make([]byte, SNAPSHOT_CHUNK_LEN)
+	status := protocol.StatusStreamEnd
+	for {
+		n, err := io.ReadFull(pr, chunk)
+		if n > 0 {
+			werr := sess.write(buf, msg, &protocol.Msg{
+				Status: protocol.StatusOk,
+				Value:  chunk[:n],
+			})
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("failed to snapshot: %s\r\n", err)
+			status = protocol.StatusError
+			break
+		}
+	}
+	err := sess.write(buf, msg, &protocol.Msg{
 		Status: status,
 	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
 }
@@ -2,11 +2,15 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/intob/rocketkv/client"
 	"github.com/intob/rocketkv/protocol"
@@ -23,11 +27,20 @@ Each test should use a separate port number, so that they can run in parallel.
 
 // Starts up a TCP server & returns a client connected to it
 func getTestServerAndClient(port int, authSecret string) *client.Client {
+	return client.NewClient(getTestServerConn(port, authSecret))
+}
+
+// Starts up a TCP server & returns a connection to it
+func getTestServerConn(port int, authSecret string) net.Conn {
+	return getTestServerConnWithStore(port, authSecret, getTestStore(8, false))
+}
+
+// Starts up a TCP server of the store & returns a connection to it
+func getTestServerConnWithStore(port int, authSecret string, st *Store) net.Conn {
 	addr := fmt.Sprintf(":%s", strconv.Itoa(port))
 	ready := make(chan bool)
 
 	go func() {
-		st := getTestStore(8, false)
 		listener, err := net.Listen("tcp", addr)
 		if err != nil {
 			panic(err)
@@ -48,7 +61,7 @@ func getTestServerAndClient(port int, authSecret string) *client.Client {
 		panic(err)
 	}
 
-	return client.NewClient(conn)
+	return conn
 }
 
 func TestPing(t *testing.T) {
@@ -193,6 +206,10 @@ func TestServerList(t *testing.T) {
 	gotKey := false
 	for m := range client.Msgs {
 		if m.Key == keyAdded {
+			// no hello, so keys have no status
+			if m.Status != 0 {
+				t.Fatalf("expected status 0, got %v", m.Status)
+			}
 			gotKey = true
 			continue
 		}
@@ -253,3 +270,965 @@ func TestServerCount(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestServerLenPrefixFraming(t *testing.T) {
+	conn := getTestServerConn(42509, "")
+	client, err := client.NewClientWithFraming(conn, protocol.FramingLenPrefix)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+
+	// would be truncated when using +END framing
+	key := "binary+END"
+	value := []byte{0, '+', 'E', 'N', 'D', 0xFF, '+', 'E', 'N', 'D'}
+
+	err = client.Set(key, value, 0, true)
+	if err != nil {
+		panic(err)
+	}
+	resp := <-client.Msgs
+	if resp.Status != protocol.StatusOk {
+		t.FailNow()
+	}
+
+	err = client.Get(key)
+	if err != nil {
+		panic(err)
+	}
+	resp = <-client.Msgs
+	if resp.Key != key || !bytes.Equal(resp.Value, value) {
+		t.FailNow()
+	}
+}
+
+func TestServerHello(t *testing.T) {
+	client := getTestServerAndClient(42510, "test")
+	defer client.Close()
+
+	// hello is allowed before auth
+	server, err := client.Hello("test")
+	if err != nil {
+		panic(err)
+	}
+	if server.Version != protocol.PROTOCOL_VERSION {
+		t.FailNow()
+	}
+	if !client.HasCap(protocol.CapLenPrefix) {
+		t.FailNow()
+	}
+	if client.Caps() != protocol.CAPS {
+		t.FailNow()
+	}
+}
+
+func TestServerReqId(t *testing.T) {
+	client := getTestServerAndClient(42511, "")
+	defer client.Close()
+
+	err := client.Set("testing", []byte("just testing"), 0, false)
+	if err != nil {
+		panic(err)
+	}
+
+	// pipeline a get, a list & a count
+	getId := client.NextReqId()
+	listId := client.NextReqId()
+	countId := client.NextReqId()
+	for _, msg := range []*protocol.Msg{
+		{Op: protocol.OpGet, ReqId: getId, Key: "testing"},
+		{Op: protocol.OpList, ReqId: listId, Key: "test"},
+		{Op: protocol.OpCount, ReqId: countId, Key: "test"},
+	} {
+		err = client.Send(msg)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// every response must carry the id of its request
+	got := make(map[uint32]int)
+	for m := range client.Msgs {
+		got[m.ReqId]++
+		if m.ReqId == countId {
+			break
+		}
+	}
+	// list responds with the key & stream end
+	if got[getId] != 1 || got[listId] != 2 || got[countId] != 1 {
+		t.Fatalf("unexpected responses per id: %v", got)
+	}
+}
+
+func TestServerSyncApi(t *testing.T) {
+	c := getTestServerAndClient(42512, "test")
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Hello("test")
+	if err != nil {
+		panic(err)
+	}
+	err = c.AuthAck(ctx, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.PingAck(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = c.GetValue(ctx, "missing")
+	if err != client.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	value := []byte("beans")
+	expires := time.Now().Add(time.Hour).UnixMilli()
+	err = c.SetAck(ctx, "coffee/arabica", value, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, meta, err := c.GetValue(ctx, "coffee/arabica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) || meta.Expires != expires || meta.Modified == 0 {
+		t.Fatalf("unexpected value %q or meta %+v", got, meta)
+	}
+
+	keys, err := c.ListKeys(ctx, "coffee/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "coffee/arabica" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	count, err := c.CountKeys(ctx, "coffee/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected count 1, got %v", count)
+	}
+
+	err = c.DelAck(ctx, "coffee/arabica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.GetValue(ctx, "coffee/arabica")
+	if err != client.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+// Tests that responses arriving after a request
+// timed out don't block the connection
+func TestServerSyncApiTimeout(t *testing.T) {
+	c := getTestServerAndClient(42529, "")
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		c.SetAck(ctx, fmt.Sprintf("key%v", i), []byte("value"), 0)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.PingAck(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := c.ListKeys(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %v", len(keys))
+	}
+}
+
+// Tests that a msg that can't be decoded closes the
+// connection, failing pending requests
+func TestClientBadMsg(t *testing.T) {
+	conn, server := net.Pipe()
+	go func() {
+		buf := make([]byte, 512)
+		server.Read(buf)
+		server.Write([]byte("bad+END"))
+	}()
+	c := client.NewClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.PingAck(ctx)
+	if err != client.ErrConnClosed {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+}
+
+func TestServerSyncApiConcurrent(t *testing.T) {
+	c := getTestServerAndClient(42513, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			value := []byte(strconv.Itoa(i))
+			err := c.SetAck(ctx, key, value, 0)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			got, _, err := c.GetValue(ctx, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, value) {
+				t.Errorf("expected %q, got %q", value, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Starts up a TCP server that accepts many connections
+//
+// Returns a func that closes all connections accepted so far.
+func getTestServer(port int, authSecret string) func() {
+	addr := fmt.Sprintf(":%s", strconv.Itoa(port))
+	st := getTestStore(8, false)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+	mu := new(sync.Mutex)
+	conns := make([]net.Conn, 0)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			go st.ServeConn(conn, authSecret, 512)
+		}
+	}()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = conns[:0]
+	}
+}
+
+func TestPool(t *testing.T) {
+	closeConns := getTestServer(42514, "test")
+	pool, err := client.NewPool(client.PoolConfig{
+		Network:      "tcp",
+		Address:      ":42514",
+		AuthSecret:   "test",
+		Size:         3,
+		Framing:      protocol.FramingLenPrefix,
+		HealthPeriod: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ctx := context.Background()
+
+	value := []byte("beans")
+	err = pool.SetAck(ctx, "coffee", value, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break every connection, the pool must
+	// re-dial & re-authenticate
+	closeConns()
+	time.Sleep(200 * time.Millisecond)
+
+	for i := 0; i < 6; i++ {
+		got, _, err := pool.GetValue(ctx, "coffee")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("expected %q, got %q", value, got)
+		}
+	}
+}
+
+// Forwards connections to a test server, see getTestProxy
+type testProxy struct {
+	mu       *sync.Mutex
+	conns    []net.Conn
+	frozen   []*int32
+	accepted int
+}
+
+// getTestProxy listens on the port, and forwards
+// each connection to the target address
+func getTestProxy(port int, target string) *testProxy {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
+	if err != nil {
+		panic(err)
+	}
+	tp := &testProxy{mu: new(sync.Mutex)}
+	pipe := func(dst, src net.Conn, frozen *int32) {
+		defer dst.Close()
+		defer src.Close()
+		buf := make([]byte, 4096)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			if atomic.LoadInt32(frozen) == 1 {
+				continue
+			}
+			_, err = dst.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			frozen := new(int32)
+			tp.mu.Lock()
+			tp.conns = append(tp.conns, conn)
+			tp.frozen = append(tp.frozen, frozen)
+			tp.accepted++
+			tp.mu.Unlock()
+			go pipe(upstream, conn, frozen)
+			go pipe(conn, upstream, frozen)
+		}
+	}()
+	return tp
+}
+
+// closeConns closes all connections accepted so far
+func (tp *testProxy) closeConns() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	for _, conn := range tp.conns {
+		conn.Close()
+	}
+}
+
+// freeze drops all bytes of the connections accepted so far,
+// without closing them
+func (tp *testProxy) freeze() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	for _, frozen := range tp.frozen {
+		atomic.StoreInt32(frozen, 1)
+	}
+}
+
+// acceptedConns returns the number of connections accepted
+func (tp *testProxy) acceptedConns() int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.accepted
+}
+
+func TestPoolReplacesDeadConn(t *testing.T) {
+	getTestServer(42535, "")
+	proxy := getTestProxy(42536, ":42535")
+	pool, err := client.NewPool(client.PoolConfig{
+		Network:      "tcp",
+		Address:      ":42536",
+		Size:         1,
+		HealthPeriod: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = pool.SetAck(ctx, "coffee", []byte("beans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a health check, the dead connection
+	// must be re-dialed when next used
+	proxy.closeConns()
+	time.Sleep(50 * time.Millisecond)
+	_, _, err = pool.GetValue(ctx, "coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := proxy.acceptedConns(); n != 2 {
+		t.Fatalf("expected 2 connections, got %v", n)
+	}
+
+	pool.Close()
+	pool.Close()
+	_, _, err = pool.GetValue(ctx, "coffee")
+	if err != client.ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	getTestServer(42537, "")
+	proxy := getTestProxy(42538, ":42537")
+	pool, err := client.NewPool(client.PoolConfig{
+		Network:      "tcp",
+		Address:      ":42538",
+		Size:         1,
+		HealthPeriod: 50 * time.Millisecond,
+		Timeout:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	ctx := context.Background()
+	err = pool.SetAck(ctx, "coffee", []byte("beans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection stays open, but pings fail,
+	// so the health check must replace it
+	proxy.freeze()
+	deadline := time.Now().Add(2 * time.Second)
+	for proxy.acceptedConns() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be replaced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	getCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, _, err = pool.GetValue(getCtx, "coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerCas(t *testing.T) {
+	c := getTestServerAndClient(42515, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.Hello("test")
+	if err != nil {
+		panic(err)
+	}
+	if !c.HasCap(protocol.CapCas) {
+		t.FailNow()
+	}
+
+	v1, err := c.Cas(ctx, "counter", []byte{1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := c.Cas(ctx, "counter", []byte{2}, 0, 0)
+	if err != client.ErrConflict || current != v1 {
+		t.Fatalf("expected conflict at version %v, got %v, %v", v1, current, err)
+	}
+	v2, err := c.Cas(ctx, "counter", []byte{2}, 0, v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := c.GetValue(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Modified != v2 {
+		t.Fatalf("expected version %v, got %v", v2, meta.Modified)
+	}
+}
+
+func TestServerIncrDecr(t *testing.T) {
+	c := getTestServerAndClient(42516, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Minute).Unix()
+	value, err := c.Incr(ctx, "hits", 3, expires)
+	if err != nil || value != 3 {
+		t.Fatalf("expected 3, got %v, %v", value, err)
+	}
+	value, err = c.Decr(ctx, "hits", 1, 0)
+	if err != nil || value != 2 {
+		t.Fatalf("expected 2, got %v, %v", value, err)
+	}
+	_, meta, err := c.GetValue(ctx, "hits")
+	if err != nil || meta.Expires != expires {
+		t.Fatalf("expected expiry to be kept, got %+v, %v", meta, err)
+	}
+
+	err = c.SetAck(ctx, "text", []byte("abc"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Incr(ctx, "text", 1, 0)
+	if err != client.ErrServer {
+		t.Fatalf("expected ErrServer, got %v", err)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	c := getTestServerAndClient(42517, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	versions, err := c.MSet(ctx, []protocol.Entry{
+		{Key: "coffee", Value: []byte("beans")},
+		{Key: "drinks/tea", Value: []byte("leaves")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0] == 0 || versions[1] == 0 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	entries, err := c.MGet(ctx, []string{"coffee", "missing", "drinks/tea"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Status != protocol.StatusOk || string(entries[0].Value) != "beans" ||
+		entries[1].Status != protocol.StatusNotFound ||
+		entries[2].Status != protocol.StatusOk || string(entries[2].Value) != "leaves" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	found, err := c.MDel(ctx, []string{"coffee", "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found[0] || found[1] {
+		t.Fatalf("unexpected results %v", found)
+	}
+}
+
+func TestServerTxn(t *testing.T) {
+	c := getTestServerAndClient(42518, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	results, err := c.Txn(ctx, []protocol.Entry{
+		{Op: protocol.OpCas, Key: "objects/1", Value: []byte("coffee")},
+		{Op: protocol.OpSet, Key: "index/coffee", Value: []byte("objects/1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err = c.Txn(ctx, []protocol.Entry{
+		{Op: protocol.OpGet, Key: "objects/1", Modified: results[0].Modified + 100},
+		{Op: protocol.OpDel, Key: "index/coffee"},
+	})
+	if err != client.ErrConflict {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if results[0].Status != protocol.StatusConflict || results[1].Status != protocol.StatusOk {
+		t.Fatalf("unexpected results %+v", results)
+	}
+
+	_, _, err = c.GetValue(ctx, "index/coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	c := getTestServerAndClient(42519, "")
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := c.Watch(ctx, "config/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.SetAck(ctx, "config/flag", []byte("on"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetAck(ctx, "other", []byte("ignored"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.DelAck(ctx, "config/flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := <-events
+	if e.Op != protocol.OpSet || e.Key != "config/flag" || string(e.Value) != "on" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	e = <-events
+	if e.Op != protocol.OpDel || e.Key != "config/flag" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// events chan must be closed when the watch ends
+	cancel()
+	for range events {
+	}
+
+	// connection must still work
+	err = c.PingAck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerReshard(t *testing.T) {
+	c := getTestServerAndClient(42520, "")
+	defer c.Close()
+	ctx := context.Background()
+
+	_, err := c.ReshardProgress(ctx)
+	if err != client.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = c.SetAck(ctx, "coffee", []byte("beans"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Reshard(ctx, 0)
+	if err != client.ErrServer {
+		t.Fatalf("expected ErrServer, got %v", err)
+	}
+	err = c.Reshard(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		progress, err := c.ReshardProgress(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if progress.Segments != 4 || progress.Total != 64 {
+			t.Fatalf("unexpected progress %+v", progress)
+		}
+		if progress.Done {
+			break
+		}
+		if i == 1000 {
+			t.Fatal("resharding did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	value, _, err := c.GetValue(ctx, "coffee")
+	if err != nil || string(value) != "beans" {
+		t.Fatalf("expected coffee after resharding, got %v", err)
+	}
+}
+
+func TestServerSnapshot(t *testing.T) {
+	conn := getTestServerConn(42521, "")
+	c, err := client.NewClientWithFraming(conn, protocol.FramingLenPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	for i := 0; i < 500; i++ {
+		err = c.SetAck(ctx, fmt.Sprintf("key%v", i), make([]byte, 200), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := new(bytes.Buffer)
+	err = c.Snapshot(ctx, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() <= SNAPSHOT_CHUNK_LEN {
+		t.Fatalf("expected more than one chunk, got %v bytes", buf.Len())
+	}
+	dir := t.TempDir()
+	err = Restore(buf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := loadTestStore(t, dir).Count(""); count != 500 {
+		t.Fatalf("expected 500 keys, got %v", count)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	c := getTestServerAndClient(42522, "")
+	defer c.Close()
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		err := c.SetAck(ctx, fmt.Sprintf("key%v", i), []byte("value"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 10 || stats.Memory != 90 || stats.MaxMemory != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// Tests that a ttl expires the key when intended
+func TestServerTtl(t *testing.T) {
+	c := getTestServerAndClient(42523, "")
+	defer c.Close()
+	ctx := context.Background()
+	err := c.SetAckTtl(ctx, "session", []byte("token"), time.Second)
+	if err == nil {
+		t.Fatal("expected ttl to require protocol version 3")
+	}
+	_, err = c.Hello("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	err = c.SetAckTtl(ctx, "session", []byte("token"), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := c.GetValue(ctx, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Expires < before.Add(50*time.Millisecond).UnixMilli() ||
+		meta.Expires > time.Now().Add(50*time.Millisecond).UnixMilli() {
+		t.Fatalf("expected expiry 50ms after set, got %v", meta.Expires)
+	}
+	time.Sleep(time.Until(time.UnixMilli(meta.Expires)))
+	_, _, err = c.GetValue(ctx, "session")
+	if err != client.ErrNotFound {
+		t.Fatalf("expected session to expire, got %v", err)
+	}
+}
+
+func TestServerExpire(t *testing.T) {
+	c := getTestServerAndClient(42524, "")
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Hello("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Expire(ctx, "missing", time.Minute)
+	if err != client.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = c.SetAck(ctx, "job", []byte("payload"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := c.Ttl(ctx, "job")
+	if err != nil || ttl != client.NoExpiry {
+		t.Fatalf("expected no expiry, got %v, %v", ttl, err)
+	}
+	_, err = c.Expire(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ttl, err = c.Ttl(ctx, "job")
+	if err != nil || ttl <= 59*time.Second || ttl > time.Minute {
+		t.Fatalf("expected ttl of a minute, got %v, %v", ttl, err)
+	}
+	_, err = c.Persist(ctx, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, meta, err := c.GetValue(ctx, "job")
+	if err != nil || string(value) != "payload" || meta.Expires != 0 {
+		t.Fatalf("expected value without expiry, got %q, %+v, %v", value, meta, err)
+	}
+	_, err = c.ExpireAt(ctx, "job", time.Now().Add(-time.Second).UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Ttl(ctx, "job")
+	if err != client.ErrNotFound {
+		t.Fatalf("expected job to have expired, got %v", err)
+	}
+}
+
+func TestServerWatchExpired(t *testing.T) {
+	st := getTestStore(8, false)
+	c := client.NewClient(getTestServerConnWithStore(42525, "", st))
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := c.Hello("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withValue, err := c.WatchExpired(ctx, "jobs/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysOnly, err := c.WatchExpired(ctx, "jobs/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.SetAckTtl(ctx, "jobs/send-email", []byte("payload"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SetAckTtl(ctx, "other", []byte("ignored"), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	for _, part := range st.Parts {
+		for _, b := range part.Blocks {
+			st.expireBlock(b)
+		}
+	}
+
+	e := <-withValue
+	if e.Op != protocol.OpExpired || e.Key != "jobs/send-email" || string(e.Value) != "payload" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	e = <-keysOnly
+	if e.Op != protocol.OpExpired || e.Key != "jobs/send-email" || len(e.Value) != 0 {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	cancel()
+	for e := range withValue {
+		if e.Op != protocol.OpWatchExpired {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+}
+
+// Tests that a Repl msg keeps versions, & is
+// rejected if an entry is not a write or delete
+func TestServerRepl(t *testing.T) {
+	st := getTestStore(8, false)
+	c := client.NewClient(getTestServerConnWithStore(42528, "", st))
+	defer c.Close()
+	_, err := c.Hello("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = c.Replicate(ctx, []protocol.Entry{
+		{Op: protocol.OpSet, Key: "a", Value: []byte("a"), Modified: 7},
+		{Op: protocol.OpGet, Key: "b"},
+	})
+	if err != client.ErrServer {
+		t.Fatalf("expected server error, got %v", err)
+	}
+	err = c.Replicate(ctx, []protocol.Entry{
+		{Op: protocol.OpSet, Key: "a", Value: []byte("a"), Modified: 7},
+		{Op: protocol.OpDel, Key: "b", Modified: 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := c.GetValue(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Modified != 7 {
+		t.Fatalf("expected version 7, got %v", meta.Modified)
+	}
+}
+
+// Tests that a req id can't be watched twice,
+// until the final msg of its watch is sent
+func TestServerWatchSlowReader(t *testing.T) {
+	c := getTestServerAndClient(42534, "")
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := c.Watch(ctx, "w/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// events are not read, other requests must not stall
+	for i := 0; i < 3000; i++ {
+		setCtx, setCancel := context.WithTimeout(ctx, time.Second)
+		err = c.SetAck(setCtx, fmt.Sprintf("w/%v", i), []byte("v"), 0)
+		setCancel()
+		if err != nil {
+			t.Fatalf("set %v: %v", i, err)
+		}
+	}
+
+	// the watch must end with an error once drained
+	var last protocol.Msg
+	n := 0
+	for e := range events {
+		last = e
+		n++
+	}
+	if last.Op != protocol.OpWatch || last.Status != protocol.StatusError {
+		t.Fatalf("expected final msg with status Error, got %+v", last)
+	}
+	if n > 3000 {
+		t.Fatalf("expected dropped events, got %v", n)
+	}
+
+	// connection must still work
+	err = c.PingAck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerWatchReqId(t *testing.T) {
+	c := getTestServerAndClient(42530, "")
+	defer c.Close()
+	watch := &protocol.Msg{Op: protocol.OpWatch, ReqId: 5, Key: "coffee/"}
+	expect := func(reqId uint32, status byte) {
+		m := <-c.Msgs
+		if m.ReqId != reqId || m.Status != status {
+			t.Fatalf("expected status %v for req %v, got %+v", status, reqId, m)
+		}
+	}
+	c.Send(watch)
+	expect(5, protocol.StatusOk)
+	c.Send(watch)
+	expect(5, protocol.StatusConflict)
+
+	unwatch := &protocol.Msg{Op: protocol.OpUnwatch, ReqId: 6, Value: make([]byte, 4)}
+	binary.BigEndian.PutUint32(unwatch.Value, 5)
+	c.Send(unwatch)
+	statuses := make(map[uint32]byte)
+	for i := 0; i < 2; i++ {
+		m := <-c.Msgs
+		statuses[m.ReqId] = m.Status
+	}
+	if statuses[5] != protocol.StatusStreamEnd || statuses[6] != protocol.StatusOk {
+		t.Fatalf("unexpected statuses %v", statuses)
+	}
+	c.Send(watch)
+	expect(5, protocol.StatusOk)
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/intob/rocketkv/util"
+)
+
+const ErrSnapshotResharding = "can't snapshot while resharding"
+const ErrSnapshotEntry = "unexpected entry in snapshot"
+const ErrSnapshotManifest = "snapshot has no manifest before its blocks"
+const ErrRestoreNotEmpty = "dir already contains a dataset"
+
+// Length of the chunks of a streamed snapshot
+const SNAPSHOT_CHUNK_LEN = 1 << 16
+
+// Snapshot writes a consistent, single-file archive of
+// the manifest, all blocks, & the wal records written
+// while archiving, as a tar
+//
+// The archive is spooled to a temp file, then copied to w,
+// so a slow reader doesn't hold up persistence.
+func (s *Store) Snapshot(w io.Writer) error {
+	spool, err := os.CreateTemp("", "rocketkv-snapshot-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	err = s.archive(spool)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, spool)
+	return err
+}
+
+// archive writes the snapshot archive
+//
+// Each block is read-locked in turn. The wal is rotated
+// before & after, so that the records in between bring
+// every block to its state at the end of the snapshot.
+// Without the wal, each block is consistent on its own.
+func (s *Store) archive(w io.Writer) error {
+	// the wal must not be truncated while archiving
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+	if s.resharding() || s.reshard.uncommitted {
+		return errors.New(ErrSnapshotResharding)
+	}
+	var start uint64
+	var err error
+	if s.wal != nil {
+		start, err = s.wal.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+	tw := tar.NewWriter(w)
+	buf := new(bytes.Buffer)
+	err = gob.NewEncoder(buf).Encode(s.getManifest())
+	if err != nil {
+		return err
+	}
+	err = writeTarFile(tw, manifestFileName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, part := range s.Parts {
+		for _, b := range part.Blocks {
+			buf.Reset()
+			b.Mutex.RLock()
+			err = encodeBlockFile(buf, b.Version, b.engine)
+			b.Mutex.RUnlock()
+			if err != nil {
+				return err
+			}
+			err = writeTarFile(tw, util.GetName(b.Id)+blockFileExt, buf.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.wal != nil {
+		end, err := s.wal.Rotate()
+		if err != nil {
+			return err
+		}
+		for seq := start; seq < end; seq++ {
+			data, err := os.ReadFile(s.wal.segmentPath(seq))
+			if err != nil {
+				return err
+			}
+			err = writeTarFile(tw, path.Join(walDirName, path.Base(s.wal.segmentPath(seq))), data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Restore reads a snapshot into dir, which must not
+// already contain a dataset
+//
+// The wal records of the snapshot are applied to the blocks,
+// so the restored dataset is complete without a wal.
+func Restore(r io.Reader, dir string) error {
+	err := ensureNoDataset(dir)
+	if err != nil {
+		return err
+	}
+	st := &Store{Dir: dir, engine: EngineMemory}
+	blocks := make(map[string]*Block)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case hdr.Name == manifestFileName:
+			manifest := make(Manifest, 0)
+			err = gob.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return err
+			}
+			st.Parts = partsFromManifest(manifest, EngineMemory)
+			for _, part := range st.Parts {
+				for _, b := range part.Blocks {
+					blocks[util.GetName(b.Id)] = b
+				}
+			}
+		case path.Dir(hdr.Name) == "." && strings.HasSuffix(hdr.Name, blockFileExt):
+			b, ok := blocks[strings.TrimSuffix(hdr.Name, blockFileExt)]
+			if !ok {
+				return errors.New(ErrSnapshotManifest)
+			}
+			version, slots, err := decodeBlockFile(tr)
+			if err != nil {
+				return fmt.Errorf("failed to decode block %s: %w", hdr.Name, err)
+			}
+			b.Version = version
+			m := &memoryEngine{id: b.Id}
+			m.load(slots)
+			b.engine = m
+		case path.Dir(hdr.Name) == walDirName && strings.HasSuffix(hdr.Name, walExt):
+			if st.Parts == nil {
+				return errors.New(ErrSnapshotManifest)
+			}
+			left := hdr.Size
+			for {
+				rec, err := readWalRecord(tr, left)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read %s: %w", hdr.Name, err)
+				}
+				st.replay(rec)
+				left -= walRecordLen(rec)
+			}
+		default:
+			return fmt.Errorf("%s: %s", ErrSnapshotEntry, hdr.Name)
+		}
+	}
+	if st.Parts == nil {
+		return errors.New(ErrSnapshotManifest)
+	}
+	for _, b := range blocks {
+		b.MustWrite = b.len() > 0
+	}
+	err = st.WriteAllBlocks(dir)
+	if err != nil {
+		return err
+	}
+	// the manifest is written last, so an interrupted
+	// restore is not mistaken for a dataset
+	return writeManifest(dir, st.getManifest())
+}
+
+// ensureNoDataset creates dir if missing, and returns an error
+// if it contains a manifest, block files or a wal
+func ensureNoDataset(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == manifestFileName || name == walDirName || isBlockFile(name) {
+			return errors.New(ErrRestoreNotEmpty)
+		}
+	}
+	return nil
+}
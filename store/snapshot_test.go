@@ -0,0 +1,156 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+// loadTestStore reads the dataset in dir
+func loadTestStore(t *testing.T, dir string) *Store {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := &Store{Dir: dir, Parts: partsFromManifest(manifest, EngineMemory)}
+	err = eachBlock(st.Parts, func(b *Block) error {
+		return b.ReadFromFile(dir)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := getTestStore(4, false)
+	w, err := OpenWal(t.TempDir(), WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s.wal = w
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprintf("ns%v/key%v", i%5, i), Slot{Value: []byte{byte(i)}}, false)
+	}
+	s.Del("ns0/key0")
+
+	buf := new(bytes.Buffer)
+	err = s.Snapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := path.Join(t.TempDir(), "restored")
+	err = Restore(bytes.NewReader(buf.Bytes()), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := loadTestStore(t, dir)
+	if count := restored.Count(""); count != 99 {
+		t.Fatalf("expected 99 keys, got %v", count)
+	}
+	for i := 1; i < 100; i++ {
+		key := fmt.Sprintf("ns%v/key%v", i%5, i)
+		want, _ := s.Get(key)
+		got, found := restored.Get(key)
+		if !found || !bytes.Equal(got.Value, want.Value) || got.Modified != want.Modified {
+			t.Fatalf("expected %s to be restored", key)
+		}
+	}
+
+	// restoring again must not overwrite the dataset
+	err = Restore(bytes.NewReader(buf.Bytes()), dir)
+	if err == nil || err.Error() != ErrRestoreNotEmpty {
+		t.Fatalf("expected %s, got %v", ErrRestoreNotEmpty, err)
+	}
+}
+
+// Tests that wal records in a snapshot are applied on restore
+func TestRestoreAppliesWal(t *testing.T) {
+	s := getTestStore(2, false)
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	manifest := new(bytes.Buffer)
+	gob.NewEncoder(manifest).Encode(s.getManifest())
+	writeTarFile(tw, manifestFileName, manifest.Bytes())
+	rec, _ := encodeWalRecord(walRecord{
+		Op:   protocol.OpSet,
+		Key:  "b",
+		Slot: Slot{Value: []byte("2"), Modified: 5},
+	})
+	writeTarFile(tw, path.Join(walDirName, "0000000000000001"+walExt), rec)
+	tw.Close()
+
+	dir := t.TempDir()
+	err := Restore(buf, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := loadTestStore(t, dir)
+	slot, found := restored.Get("b")
+	if !found || string(slot.Value) != "2" || slot.Modified != 5 {
+		t.Fatal("expected wal record to be applied")
+	}
+	_, err = os.Stat(path.Join(dir, walDirName))
+	if !os.IsNotExist(err) {
+		t.Fatal("expected no wal in restored dir")
+	}
+}
+
+// A writer that blocks until released
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+// Tests that a slow reader of a snapshot
+// doesn't hold up checkpoints
+func TestSnapshotSlowReader(t *testing.T) {
+	s := getTestStore(2, false)
+	w, err := OpenWal(t.TempDir(), WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	s.wal = w
+	s.Set("key", Slot{Value: []byte("value")}, false)
+
+	bw := &blockingWriter{writing: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- s.Snapshot(bw)
+	}()
+	<-bw.writing
+	checkpointed := make(chan struct{})
+	go func() {
+		s.Checkpoint(t.TempDir())
+		close(checkpointed)
+	}()
+	select {
+	case <-checkpointed:
+	case <-time.After(time.Second):
+		t.Fatal("expected checkpoint while the snapshot is read")
+	}
+	close(bw.release)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+}
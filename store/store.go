@@ -2,100 +2,264 @@ package store
 
 import (
 	"bytes"
+	"fmt"
 	"path"
 	"sync"
 	"time"
 
 	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/protocol"
 	"github.com/intob/rocketkv/util"
 	"github.com/spf13/viper"
 )
 
 // Contains a map of Parts
 // and the persistence directory
+//
+// Build is reported to clients in a hello.
+// WatchBuffer is the number of events buffered per watcher.
 type Store struct {
-	Parts map[uint64]*Part
-	Dir   string
+	Parts       map[uint64]*Part
+	Dir         string
+	Build       string
+	WatchBuffer int
+	watch       watchHub
+	wal         *Wal
+	persist     bool
+	engine      string
+	persistMu   sync.Mutex // serialises writing blocks & layouts
+	reshard     reshardState
+	evict       evictor
+	repl        replicator
 }
 
-func NewStore() *Store {
+// NewStore initialises a store from config,
+// reading the block files if persistence is enabled
+//
+// The build is reported to peers in a hello.
+// Returns an error if a block file can't be read,
+// rather than starting without its keys.
+func NewStore(build string) (*Store, error) {
+	persist := viper.GetBool(cfg.PERSIST)
 	st := &Store{
-		Dir: viper.GetString(cfg.DIR),
+		Dir:         viper.GetString(cfg.DIR),
+		Build:       build,
+		WatchBuffer: viper.GetInt(cfg.WATCH_BUFFER),
+		persist:     persist,
+		engine:      viper.GetString(cfg.ENGINE),
+		evict: evictor{
+			maxMemory: viper.GetInt64(cfg.MAX_MEMORY),
+			policy:    viper.GetString(cfg.EVICTION),
+			wake:      make(chan struct{}, 1),
+		},
+		repl: replicator{
+			nodes:  viper.GetStringSlice(cfg.REPL_NODES),
+			auth:   viper.GetString(cfg.REPL_AUTH),
+			period: viper.GetInt(cfg.REPL_PERIOD),
+		},
+	}
+	err := checkEngine(st.engine)
+	if err != nil {
+		return nil, err
+	}
+	err = checkEviction(st.evict.policy)
+	if err != nil {
+		return nil, err
+	}
+	if st.engine == EngineLog && !persist {
+		return nil, fmt.Errorf("%s: %s", ErrEnginePersist, st.engine)
 	}
 	ensureManifest(st)
-	readFromBlockFiles(st)
+	err = readFromBlockFiles(st)
+	if err != nil {
+		return nil, err
+	}
+	if persist {
+		err = resumeReshard(st)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resume resharding: %w", err)
+		}
+	}
+	if persist && viper.GetBool(cfg.WAL) {
+		openWal(st)
+	}
+	segments := viper.GetInt(cfg.SEGMENTS)
+	if persist && len(st.Parts) != segments {
+		err = repartition(st, segments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to repartition: %w", err)
+		}
+	}
+
+	seedVersions(st.Parts)
+	st.trackUsage(st.Parts)
+	st.accountMemory(st.Parts)
+	if st.evict.maxMemory > 0 {
+		go st.evictLoop()
+	}
+
+	st.trackRepl(st.Parts, true)
+	for id := range st.repl.nodes {
+		go st.replicate(uint64(id))
+	}
 
-	sp := viper.GetInt(cfg.SCAN_PERIOD)
-	go scanForExpiredKeys(st, sp)
+	ep := viper.GetInt(cfg.EXPIRY_PERIOD)
+	go expireKeys(st, ep)
 
-	if viper.GetBool(cfg.PERSIST) {
+	if persist {
 		wp := viper.GetInt(cfg.WRITE_PERIOD)
 		dir := viper.GetString(cfg.DIR)
 		go st.Persist(dir, wp)
 	}
 
-	return st
+	return st, nil
+}
+
+// seedVersions raises the version of each block to the
+// current time, in Unix nanoseconds, if lower
+//
+// Versions written since the blocks were last persisted,
+// or all of them without persistence, are lost on a restart.
+// Seeding from the clock keeps the versions of each key
+// increasing, so followers don't skip later writes & deletes
+// as older than the slots they hold.
+func seedVersions(parts map[uint64]*Part) {
+	now := time.Now().UnixNano()
+	for _, part := range parts {
+		for _, b := range part.Blocks {
+			if b.Version < now {
+				b.Version = now
+			}
+		}
+	}
 }
 
 // Get slot for specified key
 // from appropriate partition
 func (s *Store) Get(key string) (*Slot, bool) {
-	ns, name := path.Split(key)
-	h := hashKey(ns, name)
-	block := s.getClosestPart(h).getClosestBlock(h)
-	block.Mutex.RLock()
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locateRead(key)
 	defer block.Mutex.RUnlock()
-	slot, found := block.Slots[name]
+	slot, found := block.get(key)
 	return &slot, found
 }
 
 // Set specified slot in appropriate block
-func (s *Store) Set(key string, slot Slot, repl bool) {
-	ns, name := path.Split(key)
-	h := hashKey(ns, name)
-	block := s.getClosestPart(h).getClosestBlock(h)
-	if repl && block.Slots[name].Modified > slot.Modified {
-		// if key has been modified since, skip it
-		return
-	} else {
-		slot.Modified = time.Now().Unix()
+//
+// Returns the version of the stored slot.
+// If repl is true, the slot's version is kept,
+// unless the stored slot is newer.
+func (s *Store) Set(key string, slot Slot, repl bool) int64 {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
+	block.Mutex.Lock()
+	defer block.Mutex.Unlock()
+	version := block.put(key, slot, repl)
+	if !repl || version == slot.Modified {
+		// slot was stored
+		slot.Modified = version
+		s.commit(protocol.OpSet, key, slot)
 	}
+	return version
+}
+
+// Cas sets the slot only if the current version
+// of the key equals the expected version
+//
+// An expected version of 0 means the key must not exist.
+// Returns the new version & true if the slot was set,
+// otherwise the current version & false.
+func (s *Store) Cas(key string, slot Slot, expected int64) (int64, bool) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
 	block.Mutex.Lock()
-	block.Slots[name] = slot
-	block.MustWrite = true
-
-	// don't re-replicate (for now)
-	// TODO: think more about this, maybe it's better
-	// to re-replicate except to origin of repl.
-	// This would ensure that all replicas arrive at a consistent state,
-	// even if they are not all connected. However, it increases the amount
-	// of work that is done. Maybe we can make this a config option.
-	if !repl {
-		for _, replNodeState := range block.ReplState {
-			if replNodeState != nil {
-				replNodeState.MustSync = true
-			}
-		}
+	defer block.Mutex.Unlock()
+	current, _ := block.get(key)
+	if current.Modified != expected {
+		return current.Modified, false
 	}
-	block.Mutex.Unlock()
+	slot.Modified = block.put(key, slot, false)
+	s.commit(protocol.OpSet, key, slot)
+	return slot.Modified, true
 }
 
 // Remove slot with specified key
 //
-// TODO: add key to list of deletes to replicate
+// If replicating, the delete is synced to followers.
 func (s *Store) Del(key string) {
-	ns, name := path.Split(key)
-	h := hashKey(ns, name)
-	block := s.getClosestPart(h).getClosestBlock(h)
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
 	block.Mutex.Lock()
-	delete(block.Slots, name)
-	block.MustWrite = true
-	for _, replNodeState := range block.ReplState {
-		if replNodeState != nil {
-			replNodeState.MustSync = true
+	defer block.Mutex.Unlock()
+	if block.remove(key) {
+		s.commit(protocol.OpDel, key, Slot{})
+	}
+}
+
+// ReplDel deletes the key, as replicated from a leader,
+// with the given version of the delete
+//
+// The key is kept if its slot is newer than the delete.
+// Returns true if the key was deleted.
+func (s *Store) ReplDel(key string, version int64) bool {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(key)
+	block.Mutex.Lock()
+	defer block.Mutex.Unlock()
+	if version > block.Version {
+		block.Version = version
+	}
+	current, found := block.engine.Get(key)
+	if !found || current.Modified > version {
+		return false
+	}
+	block.drop(key)
+	s.commit(protocol.OpDel, key, Slot{})
+	return true
+}
+
+// commit logs the change to the wal, if enabled,
+// and publishes it to watchers
+//
+// The caller must hold the write lock of the key's block.
+// If the change can't be logged, the server stops,
+// rather than acknowledge a write that may be lost.
+func (s *Store) commit(op byte, key string, slot Slot) {
+	if s.wal != nil {
+		err := s.wal.Append(walRecord{Op: op, Key: key, Slot: slot})
+		if err != nil {
+			fmt.Println("failed to append to wal")
+			panic(err)
+		}
+	}
+	s.publish(op, key, slot)
+	if op == protocol.OpSet {
+		s.evict.notify()
+	}
+}
+
+// commitTxn logs the records of a transaction as one
+// wal record, so it is replayed in full or not at all,
+// then publishes each
+func (s *Store) commitTxn(recs []walRecord) {
+	if s.wal != nil {
+		err := s.wal.AppendTxn(recs)
+		if err != nil {
+			fmt.Println("failed to append to wal")
+			panic(err)
+		}
+	}
+	for _, rec := range recs {
+		s.publish(rec.Op, rec.Key, rec.Slot)
+		if rec.Op == protocol.OpSet {
+			s.evict.notify()
 		}
 	}
-	block.Mutex.Unlock()
 }
 
 // Returns channel for list of matching keys
@@ -103,39 +267,69 @@ func (s *Store) Del(key string) {
 // If a namespace is given only that namespace will be searched
 func (s *Store) List(key string, bufferSize int) <-chan string {
 	output := make(chan string, bufferSize)
+	current, next := s.layouts()
+	if next == nil {
+		go func() {
+			listLayout(current, key, output)
+			close(output)
+		}()
+		return output
+	}
+
+	// while resharding, keys move from the current layout
+	// to the next, so may be listed twice
+	listed := make(chan string, bufferSize)
+	go func() {
+		listLayout(current, key, listed)
+		listLayout(next, key, listed)
+		close(listed)
+	}()
+	go func() {
+		seen := make(map[string]bool)
+		for k := range listed {
+			if !seen[k] {
+				seen[k] = true
+				output <- k
+			}
+		}
+		close(output)
+	}()
+	return output
+}
+
+// listLayout sends the matching keys of the given parts to o
+func listLayout(parts map[uint64]*Part, key string, o chan string) {
 	// split into namespace & path if given a path separator
 	ns, name := path.Split(key)
 
 	if ns == "" {
 		// namespace is empty, search all parts
 		wg := new(sync.WaitGroup)
-		for _, part := range s.Parts {
+		for _, part := range parts {
 			wg.Add(1)
 			go func(part *Part) {
-				part.listKeys(ns, name, output)
+				part.listKeys(key, o)
 				wg.Done()
 			}(part)
 		}
-
-		// close output chan when done
-		go func() {
-			wg.Wait()
-			close(output)
-		}()
+		wg.Wait()
 	} else {
-		go func() {
-			// namespace is given, search only namespace part
-			h := hashKey(ns, name)
-			part := s.getClosestPart(h)
-			part.listKeys(ns, name, output)
-			close(output)
-		}()
+		// namespace is given, search only namespace part
+		h := hashKey(ns, name)
+		closestPart(parts, h).listKeys(key, o)
 	}
-
-	return output
 }
 
 func (s *Store) Count(key string) uint64 {
+	current, next := s.layouts()
+	if next != nil {
+		// while resharding, count unique keys of both layouts
+		var count uint64
+		for range s.List(key, 100) {
+			count++
+		}
+		return count
+	}
 	// split into namespace & path if given a path separator
 	ns, name := path.Split(key)
 	if ns == "" {
@@ -143,10 +337,10 @@ func (s *Store) Count(key string) uint64 {
 		var count uint64
 		mu := new(sync.Mutex)
 		wg := new(sync.WaitGroup)
-		for _, part := range s.Parts {
+		for _, part := range current {
 			wg.Add(1)
 			go func(part *Part) {
-				c := part.countKeys(name)
+				c := part.countKeys(key)
 				mu.Lock()
 				count += c
 				mu.Unlock()
@@ -158,20 +352,69 @@ func (s *Store) Count(key string) uint64 {
 	} else {
 		// search only given namespace
 		h := hashKey(ns, name)
-		part := s.getClosestPart(h)
-		return part.countKeys(name)
+		return closestPart(current, h).countKeys(key)
 	}
 }
 
+// locate returns the block for the key
+//
+// While resharding, the key's block of the current layout
+// is migrated, & its block of the next layout returned.
+// The caller must hold the layout's read lock.
+func (s *Store) locate(key string) *Block {
+	current, next := s.locateBoth(key)
+	if next == nil {
+		return current
+	}
+	s.migrate(current)
+	return next
+}
+
+// locateRead returns the block holding the key, read-locked
+//
+// While resharding, that is the key's block of the current
+// layout until it is migrated, then its block of the next.
+// The caller must hold the layout's read lock.
+func (s *Store) locateRead(key string) *Block {
+	current, next := s.locateBoth(key)
+	current.Mutex.RLock()
+	if next == nil || !current.migrated {
+		return current
+	}
+	current.Mutex.RUnlock()
+	next.Mutex.RLock()
+	return next
+}
+
+// locateBoth returns the key's block of the current layout,
+// and of the next layout if resharding
+//
+// The caller must hold the layout's read lock.
+func (s *Store) locateBoth(key string) (*Block, *Block) {
+	ns, name := path.Split(key)
+	h := hashKey(ns, name)
+	current := closestPart(s.Parts, h).getClosestBlock(h)
+	if s.reshard.next == nil {
+		return current, nil
+	}
+	return current, closestPart(s.reshard.next, h).getClosestBlock(h)
+}
+
 // Returns pointer to part with least Hamming distance
 // from given key hash
 func (s *Store) getClosestPart(keyHash []byte) *Part {
+	return closestPart(s.Parts, keyHash)
+}
+
+// Returns pointer to part with least Hamming distance
+// from given key hash, of the given parts
+func closestPart(parts map[uint64]*Part, keyHash []byte) *Part {
 	var clDist []byte // winning distance
 	var clPart *Part  // winning part
 	dist := make([]byte, util.ID_LEN)
 
 	// range through parts to find closest
-	for _, part := range s.Parts {
+	for _, part := range parts {
 		util.FastXor(dist, keyHash, part.Id)
 		if clDist == nil || bytes.Compare(dist, clDist) < 0 {
 			clPart = part
@@ -2,7 +2,10 @@ package store
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/intob/rocketkv/util"
@@ -10,16 +13,46 @@ import (
 
 func getTestStore(parts int, putSlots bool) *Store {
 	s := &Store{
-		Parts: make(map[uint64]*Part),
+		Parts:  make(map[uint64]*Part),
+		engine: EngineMemory,
 	}
 	// make parts
 	for i := 0; i < parts; i++ {
 		part := getTestPart(parts, putSlots)
 		s.Parts[util.GetNumber(part.Id)] = &part
 	}
+	s.accountMemory(s.Parts)
 	return s
 }
 
+// eachEngine runs fn as a subtest for each engine,
+// with a store of the given number of segments
+func eachEngine(t *testing.T, segments int, fn func(t *testing.T, s *Store)) {
+	for name := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := &Store{
+				Dir:    dir,
+				Parts:  newParts(segments, name),
+				engine: name,
+			}
+			err := eachBlock(s.Parts, func(b *Block) error {
+				return b.ReadFromFile(dir)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.accountMemory(s.Parts)
+			t.Cleanup(func() {
+				eachBlock(s.Parts, func(b *Block) error {
+					return b.engine.Close()
+				})
+			})
+			fn(t, s)
+		})
+	}
+}
+
 // Tests that calling getClosestBlock always returns
 // the same block.
 func TestGetClosestPart(t *testing.T) {
@@ -35,164 +68,374 @@ func TestGetClosestPart(t *testing.T) {
 }
 
 func TestSetAndGet(t *testing.T) {
-	s := getTestStore(8, false)
-	key := "test"
-	value := []byte("coffee")
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "test"
+		value := []byte("coffee")
 
-	s.Set(key, Slot{
-		Value: value,
-	}, false)
+		s.Set(key, Slot{
+			Value: value,
+		}, false)
 
-	got, found := s.Get(key)
+		got, found := s.Get(key)
 
-	if !found {
-		t.FailNow()
-	}
+		if !found {
+			t.FailNow()
+		}
 
-	if !bytes.Equal(got.Value, value) {
-		t.FailNow()
-	}
+		if !bytes.Equal(got.Value, value) {
+			t.FailNow()
+		}
+	})
 }
 
 func TestSetAndGetWithNamespace(t *testing.T) {
-	s := getTestStore(8, false)
-	key := "mynamespace/somecollection/test"
-	value := []byte("coffee")
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "mynamespace/somecollection/test"
+		value := []byte("coffee")
 
-	s.Set(key, Slot{
-		Value: value,
-	}, false)
+		s.Set(key, Slot{
+			Value: value,
+		}, false)
 
-	got, found := s.Get(key)
+		got, found := s.Get(key)
 
-	if !found {
-		t.FailNow()
-	}
+		if !found {
+			t.FailNow()
+		}
 
-	if !bytes.Equal(got.Value, value) {
-		t.FailNow()
-	}
+		if !bytes.Equal(got.Value, value) {
+			t.FailNow()
+		}
+	})
 }
 
 func TestSetAndDel(t *testing.T) {
-	s := getTestStore(8, false)
-	key := "test"
-	value := []byte("coffee")
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "test"
+		value := []byte("coffee")
 
-	s.Set(key, Slot{
-		Value: value,
-	}, false)
+		s.Set(key, Slot{
+			Value: value,
+		}, false)
 
-	s.Del(key)
+		s.Del(key)
 
-	_, found := s.Get(key)
+		_, found := s.Get(key)
 
-	if found {
-		t.FailNow()
-	}
+		if found {
+			t.FailNow()
+		}
+	})
 }
 
 func TestSetAndDelWithNamespace(t *testing.T) {
-	s := getTestStore(8, false)
-	key := "mynamespace/collection/test"
-	value := []byte("coffee")
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "mynamespace/collection/test"
+		value := []byte("coffee")
 
-	s.Set(key, Slot{
-		Value: value,
-	}, false)
+		s.Set(key, Slot{
+			Value: value,
+		}, false)
 
-	s.Del(key)
+		s.Del(key)
 
-	_, found := s.Get(key)
+		_, found := s.Get(key)
 
-	if found {
-		t.FailNow()
-	}
+		if found {
+			t.FailNow()
+		}
+	})
 }
 
 func TestList(t *testing.T) {
-	s := getTestStore(8, false)
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
 
-	count := 1000
-	keyPrefix := "somekeyprefix_"
-	slot := Slot{Value: []byte("test")}
+		count := 1000
+		keyPrefix := "somekeyprefix_"
+		slot := Slot{Value: []byte("test")}
 
-	// populate store with test data
-	for i := 0; i < count; i++ {
-		key := keyPrefix + strconv.Itoa(i)
-		s.Set(key, slot, false)
-	}
+		// populate store with test data
+		for i := 0; i < count; i++ {
+			key := keyPrefix + strconv.Itoa(i)
+			s.Set(key, slot, false)
+		}
 
-	keyChan := s.List(keyPrefix, 1)
+		keyChan := s.List(keyPrefix, 1)
 
-	// tally up keys, expecting count
-	tally := 0
-	for range keyChan {
-		tally++
-	}
+		// tally up keys, expecting count
+		tally := 0
+		for range keyChan {
+			tally++
+		}
 
-	if tally != count {
-		t.FailNow()
-	}
+		if tally != count {
+			t.FailNow()
+		}
+	})
 }
 
 func TestListWithNamespace(t *testing.T) {
-	s := getTestStore(8, false)
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
 
-	count := 1000
-	keyPrefix := "namespace/collectionofthings/somekeyprefix_"
-	slot := Slot{Value: []byte("test")}
+		count := 1000
+		keyPrefix := "namespace/collectionofthings/somekeyprefix_"
+		slot := Slot{Value: []byte("test")}
 
-	// populate store with test data
-	for i := 0; i < count; i++ {
-		key := keyPrefix + strconv.Itoa(i)
-		s.Set(key, slot, false)
-	}
+		// populate store with test data
+		for i := 0; i < count; i++ {
+			key := keyPrefix + strconv.Itoa(i)
+			s.Set(key, slot, false)
+		}
 
-	// tally up keys, expecting count
-	keyChan := s.List(keyPrefix, 1)
-	tally := 0
-	for range keyChan {
-		tally++
-	}
+		// tally up keys, expecting count
+		keyChan := s.List(keyPrefix, 1)
+		tally := 0
+		for range keyChan {
+			tally++
+		}
 
-	if tally != count {
-		t.FailNow()
-	}
+		if tally != count {
+			t.FailNow()
+		}
+	})
 }
 
 func TestCount(t *testing.T) {
-	s := getTestStore(8, false)
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
 
-	count := 1000
-	keyPrefix := "somekeyprefix_"
-	slot := Slot{Value: []byte("test")}
+		count := 1000
+		keyPrefix := "somekeyprefix_"
+		slot := Slot{Value: []byte("test")}
 
-	// populate store with test data
-	for i := 0; i < count; i++ {
-		key := keyPrefix + strconv.Itoa(i)
-		s.Set(key, slot, false)
-	}
+		// populate store with test data
+		for i := 0; i < count; i++ {
+			key := keyPrefix + strconv.Itoa(i)
+			s.Set(key, slot, false)
+		}
 
-	if uint64(count) != s.Count(keyPrefix) {
-		t.FailNow()
-	}
+		if uint64(count) != s.Count(keyPrefix) {
+			t.FailNow()
+		}
+	})
 }
 
 func TestCountWithNamespace(t *testing.T) {
-	s := getTestStore(8, false)
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
 
-	count := 1000
-	keyPrefix := "mynamespace/collection/somekeyprefix_"
-	slot := Slot{Value: []byte("test")}
+		count := 1000
+		keyPrefix := "mynamespace/collection/somekeyprefix_"
+		slot := Slot{Value: []byte("test")}
 
-	// populate store with test data
-	for i := 0; i < count; i++ {
-		key := keyPrefix + strconv.Itoa(i)
-		s.Set(key, slot, false)
-	}
+		// populate store with test data
+		for i := 0; i < count; i++ {
+			key := keyPrefix + strconv.Itoa(i)
+			s.Set(key, slot, false)
+		}
 
-	if uint64(count) != s.Count(keyPrefix) {
-		t.FailNow()
-	}
+		if uint64(count) != s.Count(keyPrefix) {
+			t.FailNow()
+		}
+	})
+}
+
+func TestVersionIncreases(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "test"
+
+		v1 := s.Set(key, Slot{Value: []byte("a")}, false)
+		v2 := s.Set(key, Slot{Value: []byte("b")}, false)
+		s.Del(key)
+		v3 := s.Set(key, Slot{Value: []byte("c")}, false)
+
+		if !(v1 < v2 && v2 < v3) {
+			t.Fatalf("expected increasing versions, got %v, %v, %v", v1, v2, v3)
+		}
+		got, _ := s.Get(key)
+		if got.Modified != v3 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestCas(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "mynamespace/test"
+
+		// must not exist
+		v1, ok := s.Cas(key, Slot{Value: []byte("a")}, 0)
+		if !ok {
+			t.FailNow()
+		}
+		_, ok = s.Cas(key, Slot{Value: []byte("b")}, 0)
+		if ok {
+			t.FailNow()
+		}
+
+		v2, ok := s.Cas(key, Slot{Value: []byte("b")}, v1)
+		if !ok {
+			t.FailNow()
+		}
+
+		// stale version
+		current, ok := s.Cas(key, Slot{Value: []byte("c")}, v1)
+		if ok || current != v2 {
+			t.FailNow()
+		}
+
+		got, _ := s.Get(key)
+		if string(got.Value) != "b" {
+			t.FailNow()
+		}
+	})
+}
+
+func TestIncr(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "ratelimit/client"
+
+		value, _, err := s.Incr(key, 5, 0)
+		if err != nil || value != 5 {
+			t.FailNow()
+		}
+		value, _, err = s.Incr(key, -7, 0)
+		if err != nil || value != -2 {
+			t.FailNow()
+		}
+
+		s.Set("text", Slot{Value: []byte("not a counter")}, false)
+		_, _, err = s.Incr("text", 1, 0)
+		if err == nil {
+			t.FailNow()
+		}
+
+		s.Set("max", Slot{Value: EncodeCounter(math.MaxInt64)}, false)
+		_, _, err = s.Incr("max", 1, 0)
+		if err == nil {
+			t.FailNow()
+		}
+	})
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		key := "counter"
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				s.Incr(key, 1, 0)
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		got, _ := s.Get(key)
+		if int64(binary.BigEndian.Uint64(got.Value)) != 100 {
+			t.FailNow()
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+
+		count := 100
+		keys := make([]string, count)
+		slots := make([]Slot, count)
+		for i := 0; i < count; i++ {
+			keys[i] = "ns" + strconv.Itoa(i%4) + "/key" + strconv.Itoa(i)
+			slots[i] = Slot{Value: []byte(strconv.Itoa(i))}
+		}
+		versions := s.MSet(keys, slots)
+
+		got, found := s.MGet(append(keys, "missing"))
+		for i := 0; i < count; i++ {
+			if !found[i] || !bytes.Equal(got[i].Value, slots[i].Value) ||
+				got[i].Modified != versions[i] {
+				t.FailNow()
+			}
+		}
+		if found[count] {
+			t.FailNow()
+		}
+
+		deleted := s.MDel([]string{keys[0], "missing"})
+		if !deleted[0] || deleted[1] {
+			t.FailNow()
+		}
+		if _, found := s.Get(keys[0]); found {
+			t.FailNow()
+		}
+	})
+}
+
+func TestTxn(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		obj := "objects/1"
+		idx := "index/name/coffee"
+
+		// create object & index entry, neither may exist
+		versions, ok := s.Txn([]TxnStep{
+			{Kind: TxnCas, Key: obj, Slot: Slot{Value: []byte("coffee")}},
+			{Kind: TxnCas, Key: idx, Slot: Slot{Value: []byte(obj)}},
+		})
+		if !ok {
+			t.FailNow()
+		}
+
+		// stale check, nothing must be applied
+		_, ok = s.Txn([]TxnStep{
+			{Kind: TxnCheck, Key: obj, Expected: versions[0] - 1},
+			{Kind: TxnDel, Key: idx},
+			{Kind: TxnSet, Key: "other", Slot: Slot{Value: []byte("x")}},
+		})
+		if ok {
+			t.FailNow()
+		}
+		if _, found := s.Get(idx); !found {
+			t.FailNow()
+		}
+		if _, found := s.Get("other"); found {
+			t.FailNow()
+		}
+
+		// rename, moving the index entry
+		_, ok = s.Txn([]TxnStep{
+			{Kind: TxnCas, Key: obj, Slot: Slot{Value: []byte("tea")}, Expected: versions[0]},
+			{Kind: TxnDel, Key: idx},
+			{Kind: TxnSet, Key: "index/name/tea", Slot: Slot{Value: []byte(obj)}},
+		})
+		if !ok {
+			t.FailNow()
+		}
+		if _, found := s.Get(idx); found {
+			t.FailNow()
+		}
+		got, _ := s.Get("index/name/tea")
+		if string(got.Value) != obj {
+			t.FailNow()
+		}
+	})
+}
+
+// Tests that transactions locking the same blocks
+// in any key order don't deadlock
+func TestTxnConcurrent(t *testing.T) {
+	eachEngine(t, 8, func(t *testing.T, s *Store) {
+		keys := []string{"a/1", "b/2", "c/3", "d/4"}
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				steps := make([]TxnStep, len(keys))
+				for j := range keys {
+					// rotate key order per goroutine
+					key := keys[(i+j)%len(keys)]
+					steps[j] = TxnStep{Kind: TxnSet, Key: key, Slot: Slot{Value: []byte{byte(i)}}}
+				}
+				s.Txn(steps)
+			}(i)
+		}
+		wg.Wait()
+	})
 }
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package store
+
+import "os"
+
+// syncDir syncs the directory, persisting
+// the creation, renaming & removal of files
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
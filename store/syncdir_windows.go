@@ -0,0 +1,8 @@
+package store
+
+// syncDir does nothing on windows, where a directory
+// can't be synced, & renames are persisted by the
+// file system's journal
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+// Kinds of transaction steps
+const (
+	TxnCheck byte = iota // compare version only
+	TxnSet               // set slot
+	TxnCas               // compare version, then set slot
+	TxnDel               // delete key
+)
+
+// A single step of a transaction
+//
+// For TxnCheck & TxnCas, Expected is compared with
+// the key's current version, 0 meaning the key must not exist.
+type TxnStep struct {
+	Kind     byte
+	Key      string
+	Slot     Slot
+	Expected int64
+}
+
+// Txn applies all writes & deletes of the steps,
+// only if every check passes
+//
+// The blocks of all keys are locked in order of block id,
+// so concurrent transactions can't deadlock.
+// All checks see the state before the transaction.
+//
+// Returns a version for each step, and true if applied.
+// If applied, writes have their new version & deletes 0.
+// If not, each step has the key's current version.
+func (s *Store) Txn(steps []TxnStep) ([]int64, bool) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	blocks := make([]*Block, len(steps))
+	unique := make(map[*Block]bool)
+	for i, step := range steps {
+		blocks[i] = s.locate(step.Key)
+		unique[blocks[i]] = true
+	}
+	ordered := make([]*Block, 0, len(unique))
+	for block := range unique {
+		ordered = append(ordered, block)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return bytes.Compare(ordered[i].Id, ordered[j].Id) < 0
+	})
+	for _, block := range ordered {
+		block.Mutex.Lock()
+	}
+	defer func() {
+		for _, block := range ordered {
+			block.Mutex.Unlock()
+		}
+	}()
+
+	versions := make([]int64, len(steps))
+	ok := true
+	for i, step := range steps {
+		current, _ := blocks[i].get(step.Key)
+		versions[i] = current.Modified
+		if step.Kind == TxnCheck || step.Kind == TxnCas {
+			if versions[i] != step.Expected {
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		return versions, false
+	}
+
+	recs := make([]walRecord, 0, len(steps))
+	for i, step := range steps {
+		switch step.Kind {
+		case TxnSet, TxnCas:
+			slot := step.Slot
+			slot.Modified = blocks[i].put(step.Key, slot, false)
+			versions[i] = slot.Modified
+			recs = append(recs, walRecord{Op: protocol.OpSet, Key: step.Key, Slot: slot})
+		case TxnDel:
+			versions[i] = 0
+			if blocks[i].remove(step.Key) {
+				recs = append(recs, walRecord{Op: protocol.OpDel, Key: step.Key})
+			}
+		}
+	}
+	if len(recs) > 0 {
+		s.commitTxn(recs)
+	}
+	return versions, true
+}
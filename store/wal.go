@@ -0,0 +1,479 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intob/rocketkv/cfg"
+	"github.com/intob/rocketkv/protocol"
+	"github.com/spf13/viper"
+)
+
+const ErrWalRecord = "wal record is corrupt"
+const ErrWalTorn = "wal record is torn"
+const ErrWalSync = "unknown wal sync policy"
+const ErrWalSyncPeriod = "wal sync period must be positive"
+
+const walDirName = "wal"
+const walExt = ".log"
+
+// Fixed lengths of a record, excluding key & value
+const walRecordHeadLen = 8
+const walPayloadLenMin = 23
+
+// When the WAL is synced to disk
+const (
+	WalSyncAlways   = "always"   // before each write is acknowledged
+	WalSyncPeriodic = "periodic" // every period
+	WalSyncNever    = "never"    // left to the OS
+)
+
+// Append-only write-ahead log
+//
+// Every mutation is appended before it is acknowledged,
+// so that writes between block persistence ticks
+// survive a crash. The log is split into segments,
+// a new segment is started by Rotate. Once all blocks
+// are written, older segments are removed by Truncate.
+type Wal struct {
+	dir      string
+	sync     string
+	mu       *sync.Mutex
+	file     *os.File
+	seq      uint64 // of current segment
+	dirty    bool   // written since last sync
+	closed   bool
+	readOnly bool // torn records are not truncated
+}
+
+// A single mutation
+//
+// Op is protocol.OpSet, protocol.OpDel, protocol.OpExpired
+// or protocol.OpEvicted. Records of protocol.OpTxn hold the
+// records of a transaction as value, see encodeWalTxn.
+type walRecord struct {
+	Op   byte
+	Key  string
+	Slot Slot
+}
+
+// OpenWal opens the write-ahead log in the given directory,
+// and starts a new segment after any existing ones
+//
+// For WalSyncPeriodic, the log is synced every period,
+// which must be positive.
+func OpenWal(dir, syncPolicy string, period time.Duration) (*Wal, error) {
+	if syncPolicy != WalSyncAlways && syncPolicy != WalSyncPeriodic && syncPolicy != WalSyncNever {
+		return nil, errors.New(ErrWalSync)
+	}
+	if syncPolicy == WalSyncPeriodic && period <= 0 {
+		return nil, errors.New(ErrWalSyncPeriod)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	w := &Wal{
+		dir:  dir,
+		sync: syncPolicy,
+		mu:   new(sync.Mutex),
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1]
+	}
+	_, err = w.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	if syncPolicy == WalSyncPeriodic {
+		go w.syncPeriodically(period)
+	}
+	return w, nil
+}
+
+// Append writes the record to the current segment,
+// and syncs it if the policy is WalSyncAlways
+func (w *Wal) Append(rec walRecord) error {
+	enc, err := encodeWalRecord(rec)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.file.Write(enc)
+	if err != nil {
+		return err
+	}
+	if w.sync == WalSyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// AppendTxn writes the records of a transaction
+// as a single record, so that a crash can't leave
+// the transaction partly logged
+func (w *Wal) AppendTxn(recs []walRecord) error {
+	rec, err := encodeWalTxn(recs)
+	if err != nil {
+		return err
+	}
+	return w.Append(rec)
+}
+
+// Rotate syncs & closes the current segment,
+// and starts a new one
+//
+// Returns the sequence number of the new segment.
+// Every record appended before Rotate returns
+// is in an older segment.
+func (w *Wal) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		err := w.file.Sync()
+		if err != nil {
+			return 0, err
+		}
+		w.file.Close()
+	}
+	w.seq++
+	file, err := os.OpenFile(w.segmentPath(w.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	w.file = file
+	w.dirty = false
+	return w.seq, nil
+}
+
+// Truncate removes all segments older than seq
+//
+// Must only be called once the records of those
+// segments are durably written to block files.
+func (w *Wal) Truncate(seq uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= seq {
+			break
+		}
+		err = os.Remove(w.segmentPath(s))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replay calls fn for each record of all segments
+// older than the current one, in order
+//
+// A torn record at the end of the last segment, as left by
+// a crash during a write, ends the replay, & is truncated, so
+// the segment is whole once newer segments follow it. Any other
+// corrupt record is an error, as skipping it would lose
+// acknowledged writes, while later records still apply. The
+// records of a transaction are replayed only if all of them
+// were logged.
+func (w *Wal) Replay(fn func(rec walRecord)) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	older := make([]uint64, 0, len(segments))
+	for _, s := range segments {
+		if s < w.seq {
+			older = append(older, s)
+		}
+	}
+	for i, s := range older {
+		err = w.replaySegment(s, i == len(older)-1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment calls fn for each record of the segment
+//
+// If last is true, a torn record is truncated, unless
+// the wal is read-only, otherwise it is an error.
+func (w *Wal) replaySegment(seq uint64, last bool, fn func(rec walRecord)) error {
+	flag := os.O_RDWR
+	if w.readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(w.segmentPath(seq), flag, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(file)
+	var offset int64
+	count := 0
+	for {
+		rec, err := readWalRecord(r, info.Size()-offset)
+		if err == io.EOF {
+			break
+		}
+		if last && err != nil && err.Error() == ErrWalTorn && w.readOnly {
+			break
+		}
+		if last && err != nil && err.Error() == ErrWalTorn {
+			fmt.Printf("truncating torn record of wal segment %v at %v\r\n", seq, offset)
+			err = file.Truncate(offset)
+			if err == nil {
+				err = file.Sync()
+			}
+			if err != nil {
+				return err
+			}
+			break
+		}
+		recs := []walRecord{rec}
+		if err == nil && rec.Op == protocol.OpTxn {
+			recs, err = decodeWalTxn(rec)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay wal segment %v at %v: %w", seq, offset, err)
+		}
+		for _, rec := range recs {
+			fn(rec)
+		}
+		offset += walRecordLen(rec)
+		count++
+	}
+	fmt.Printf("replayed %v records from wal segment %v\r\n", count, seq)
+	return nil
+}
+
+// Close syncs & closes the current segment
+func (w *Wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	err := w.file.Sync()
+	if err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *Wal) syncPeriodically(period time.Duration) {
+	for {
+		time.Sleep(period)
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		if w.dirty {
+			err := w.file.Sync()
+			if err != nil {
+				fmt.Printf("failed to sync wal: %s\r\n", err)
+			}
+			w.dirty = false
+		}
+		w.mu.Unlock()
+	}
+}
+
+// segments returns the sequence numbers of
+// all segment files, in ascending order
+func (w *Wal) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]uint64, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, walExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+func (w *Wal) segmentPath(seq uint64) string {
+	return path.Join(w.dir, fmt.Sprintf("%016x%s", seq, walExt))
+}
+
+// encodeWalRecord serializes the record
+//
+// | CRC32 UINT32 | LEN UINT32 | payload |
+// where payload is
+// | OP | KEY LEN UINT16 | EXPIRES INT64 | MODIFIED INT64 | VALUE LEN UINT32 | KEY | VALUE |
+func encodeWalRecord(rec walRecord) ([]byte, error) {
+	if len(rec.Key) > protocol.KEY_LEN_MAX {
+		return nil, errors.New(protocol.ErrMsgKeyTooLong)
+	}
+	payloadLen := walPayloadLenMin + len(rec.Key) + len(rec.Slot.Value)
+	b := make([]byte, walRecordHeadLen+payloadLen)
+	p := b[walRecordHeadLen:]
+	p[0] = rec.Op
+	binary.BigEndian.PutUint16(p[1:], uint16(len(rec.Key)))
+	binary.BigEndian.PutUint64(p[3:], uint64(rec.Slot.Expires))
+	binary.BigEndian.PutUint64(p[11:], uint64(rec.Slot.Modified))
+	binary.BigEndian.PutUint32(p[19:], uint32(len(rec.Slot.Value)))
+	copy(p[23:], rec.Key)
+	copy(p[23+len(rec.Key):], rec.Slot.Value)
+	binary.BigEndian.PutUint32(b, crc32.ChecksumIEEE(p))
+	binary.BigEndian.PutUint32(b[4:], uint32(payloadLen))
+	return b, nil
+}
+
+// readWalRecord reads & verifies the next record,
+// of the given number of bytes left in r
+//
+// Returns io.EOF if there are no more records. A record that
+// is cut short, or fails its checksum & ends the bytes left,
+// is torn, as by a crash during a write. Records claiming to
+// be longer than the bytes left are not read.
+func readWalRecord(r io.Reader, left int64) (walRecord, error) {
+	rec := walRecord{}
+	head := make([]byte, walRecordHeadLen)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		if err == io.EOF {
+			return rec, err
+		}
+		return rec, errors.New(ErrWalTorn)
+	}
+	payloadLen := int64(binary.BigEndian.Uint32(head[4:]))
+	if payloadLen < walPayloadLenMin {
+		return rec, errors.New(ErrWalRecord)
+	}
+	if walRecordHeadLen+payloadLen > left {
+		return rec, errors.New(ErrWalTorn)
+	}
+	p := make([]byte, payloadLen)
+	_, err = io.ReadFull(r, p)
+	if err != nil {
+		return rec, errors.New(ErrWalTorn)
+	}
+	if crc32.ChecksumIEEE(p) != binary.BigEndian.Uint32(head) {
+		if walRecordHeadLen+payloadLen == left {
+			return rec, errors.New(ErrWalTorn)
+		}
+		return rec, errors.New(ErrWalRecord)
+	}
+	keyLen := int(binary.BigEndian.Uint16(p[1:]))
+	valueLen := int(binary.BigEndian.Uint32(p[19:]))
+	if int64(walPayloadLenMin+keyLen+valueLen) != payloadLen {
+		return rec, errors.New(ErrWalRecord)
+	}
+	rec.Op = p[0]
+	rec.Slot.Expires = ExpiresMillis(int64(binary.BigEndian.Uint64(p[3:])))
+	rec.Slot.Modified = int64(binary.BigEndian.Uint64(p[11:]))
+	rec.Key = string(p[23 : 23+keyLen])
+	if valueLen > 0 {
+		rec.Slot.Value = p[23+keyLen:]
+	}
+	return rec, nil
+}
+
+// walRecordLen returns the encoded length of the record
+func walRecordLen(rec walRecord) int64 {
+	return int64(walRecordHeadLen + walPayloadLenMin + len(rec.Key) + len(rec.Slot.Value))
+}
+
+// encodeWalTxn frames the records of a transaction
+// as the value of a single protocol.OpTxn record
+//
+// The value is the encoded records, one after another.
+func encodeWalTxn(recs []walRecord) (walRecord, error) {
+	var value []byte
+	for _, rec := range recs {
+		enc, err := encodeWalRecord(rec)
+		if err != nil {
+			return walRecord{}, err
+		}
+		value = append(value, enc...)
+	}
+	return walRecord{Op: protocol.OpTxn, Slot: Slot{Value: value}}, nil
+}
+
+// decodeWalTxn returns the records framed by encodeWalTxn
+func decodeWalTxn(rec walRecord) ([]walRecord, error) {
+	recs := make([]walRecord, 0)
+	r := bytes.NewReader(rec.Slot.Value)
+	for r.Len() > 0 {
+		step, err := readWalRecord(r, int64(r.Len()))
+		if err != nil {
+			return nil, errors.New(ErrWalRecord)
+		}
+		recs = append(recs, step)
+	}
+	return recs, nil
+}
+
+// openWal opens the store's wal, & replays records
+// that are not yet in the block files
+func openWal(st *Store) {
+	syncPolicy := viper.GetString(cfg.WAL_SYNC)
+	period := time.Duration(viper.GetInt(cfg.WAL_SYNC_PERIOD)) * time.Millisecond
+	w, err := OpenWal(path.Join(st.Dir, walDirName), syncPolicy, period)
+	if err != nil {
+		fmt.Println("failed to open wal")
+		panic(err)
+	}
+	err = w.Replay(st.replay)
+	if err != nil {
+		fmt.Println("failed to replay wal")
+		panic(err)
+	}
+	st.wal = w
+	fmt.Printf("wal enabled, will sync %s\r\n", syncPolicy)
+}
+
+// replay applies the record to the store
+//
+// Records hold the full slot, including its version,
+// so replaying over a newer block file is harmless.
+func (s *Store) replay(rec walRecord) {
+	s.reshard.mu.RLock()
+	defer s.reshard.mu.RUnlock()
+	block := s.locate(rec.Key)
+	block.Mutex.Lock()
+	defer block.Mutex.Unlock()
+	switch rec.Op {
+	case protocol.OpSet:
+		block.put(rec.Key, rec.Slot, true)
+	case protocol.OpDel, protocol.OpExpired, protocol.OpEvicted:
+		block.drop(rec.Key)
+	}
+}
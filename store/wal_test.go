@@ -0,0 +1,285 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+func TestEncodeDecodeWalRecord(t *testing.T) {
+	rec := walRecord{
+		Op:  protocol.OpSet,
+		Key: "ns/key",
+		Slot: Slot{
+			Value:    []byte("value"),
+			Expires:  time.Now().UnixMilli(),
+			Modified: 42,
+		},
+	}
+	enc, err := encodeWalRecord(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := readWalRecord(bytes.NewReader(enc), int64(len(enc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Op != rec.Op || dec.Key != rec.Key ||
+		!bytes.Equal(dec.Slot.Value, rec.Slot.Value) ||
+		dec.Slot.Expires != rec.Slot.Expires ||
+		dec.Slot.Modified != rec.Slot.Modified {
+		t.Fatalf("expected %v, got %v", rec, dec)
+	}
+}
+
+func TestReadWalRecordTorn(t *testing.T) {
+	enc, _ := encodeWalRecord(walRecord{Op: protocol.OpDel, Key: "key"})
+	r := bytes.NewReader(enc[:len(enc)-1])
+	_, err := readWalRecord(r, int64(r.Len()))
+	if err == nil || err.Error() != ErrWalTorn {
+		t.Fatalf("expected %s, got %v", ErrWalTorn, err)
+	}
+	enc[len(enc)-1] ^= 0xFF
+	_, err = readWalRecord(bytes.NewReader(enc), int64(len(enc)))
+	if err == nil || err.Error() != ErrWalTorn {
+		t.Fatalf("expected checksum mismatch of last record, got %v", err)
+	}
+	// followed by another record
+	_, err = readWalRecord(bytes.NewReader(enc), int64(len(enc))+1)
+	if err == nil || err.Error() != ErrWalRecord {
+		t.Fatalf("expected %s, got %v", ErrWalRecord, err)
+	}
+}
+
+// Tests that a record claiming more bytes than are left
+// is not read
+func TestReadWalRecordTooLong(t *testing.T) {
+	enc, _ := encodeWalRecord(walRecord{Op: protocol.OpDel, Key: "key"})
+	enc[4], enc[5], enc[6], enc[7] = 0xFF, 0xFF, 0xFF, 0xFF
+	_, err := readWalRecord(bytes.NewReader(enc), int64(len(enc)))
+	if err == nil || err.Error() != ErrWalTorn {
+		t.Fatalf("expected %s, got %v", ErrWalTorn, err)
+	}
+}
+
+// Tests that writes are recovered by replaying the wal
+// into an empty store, as after a crash
+func TestWalReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := getTestStore(4, false)
+	w, err := OpenWal(dir, WalSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal = w
+	s.Set("a", Slot{Value: []byte("1")}, false)
+	s.Set("ns/b", Slot{Value: []byte("2")}, false)
+	s.Set("ns/c", Slot{Value: []byte("3")}, false)
+	s.Del("ns/b")
+	s.Incr("counter", 5, 0)
+	w.Close()
+
+	recovered := getEmptyCopy(s)
+	w, err = OpenWal(dir, WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	err = w.Replay(recovered.replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "ns/c", "counter"} {
+		want, _ := s.Get(key)
+		got, found := recovered.Get(key)
+		if !found || !bytes.Equal(got.Value, want.Value) || got.Modified != want.Modified {
+			t.Fatalf("expected %s to be recovered", key)
+		}
+	}
+	_, found := recovered.Get("ns/b")
+	if found {
+		t.Fatal("expected ns/b to be deleted")
+	}
+}
+
+// getEmptyCopy returns a store with the layout of s,
+// but none of its keys
+//
+// Ids of test stores are random, so the layout is copied.
+func getEmptyCopy(s *Store) *Store {
+	empty := &Store{Parts: make(map[uint64]*Part)}
+	for id, part := range s.Parts {
+		p := NewPart(part.Id)
+		for blockId, block := range part.Blocks {
+			p.Blocks[blockId] = NewBlock(block.Id)
+		}
+		empty.Parts[id] = &p
+	}
+	return empty
+}
+
+// Tests that a transaction torn between its steps
+// by a crash is not replayed at all
+func TestWalReplayTornTxn(t *testing.T) {
+	dir := t.TempDir()
+	s := getTestStore(4, false)
+	w, err := OpenWal(dir, WalSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal = w
+	s.Set("before", Slot{Value: []byte("1")}, false)
+	_, ok := s.Txn([]TxnStep{
+		{Kind: TxnSet, Key: "a", Slot: Slot{Value: []byte("a")}},
+		{Kind: TxnSet, Key: "b", Slot: Slot{Value: []byte("b")}},
+	})
+	if !ok {
+		t.Fatal("expected txn to be applied")
+	}
+	w.Close()
+
+	// cut the log after the first step of the txn
+	segment := w.segmentPath(w.seq)
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step, _ := encodeWalRecord(walRecord{Op: protocol.OpSet, Key: "b", Slot: Slot{Value: []byte("b")}})
+	err = os.Truncate(segment, info.Size()-int64(len(step)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recovered := getEmptyCopy(s)
+	w, err = OpenWal(dir, WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	err = w.Replay(recovered.replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := recovered.Get("before"); !found {
+		t.Fatal("expected write before the txn to be recovered")
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, found := recovered.Get(key); found {
+			t.Fatalf("expected %s of torn txn not to be recovered", key)
+		}
+	}
+}
+
+// Tests that a corrupt record is an error, unless it is
+// the torn tail of the last segment
+func TestWalReplayCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWal(dir, WalSyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		err = w.Append(walRecord{Op: protocol.OpSet, Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := w.seq
+	_, err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Append(walRecord{Op: protocol.OpSet, Key: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := w.seq
+	w.Close()
+
+	replay := func() ([]string, error) {
+		w, err := OpenWal(dir, WalSyncNever, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		keys := make([]string, 0)
+		err = w.Replay(func(rec walRecord) {
+			keys = append(keys, rec.Key)
+		})
+		return keys, err
+	}
+
+	// torn tail of the last segment, replayed again
+	// once a newer segment follows it
+	corruptByte(t, w.segmentPath(last), -1)
+	for i := 0; i < 2; i++ {
+		keys, err := replay()
+		if err != nil || len(keys) != 2 {
+			t.Fatalf("expected torn record to end the replay, got %v, %v", keys, err)
+		}
+	}
+
+	// middle of an older segment
+	corruptByte(t, w.segmentPath(first), walRecordHeadLen)
+	_, err = replay()
+	if err == nil || !strings.Contains(err.Error(), ErrWalRecord) {
+		t.Fatalf("expected %s, got %v", ErrWalRecord, err)
+	}
+}
+
+// corruptByte flips the byte of the file at the offset,
+// counted from the end if negative
+func corruptByte(t *testing.T, name string, offset int64) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset < 0 {
+		offset += int64(len(data))
+	}
+	data[offset] ^= 0xFF
+	err = os.WriteFile(name, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a periodic sync needs a positive period
+func TestOpenWalSyncPeriod(t *testing.T) {
+	_, err := OpenWal(t.TempDir(), WalSyncPeriodic, 0)
+	if err == nil || err.Error() != ErrWalSyncPeriod {
+		t.Fatalf("expected %s, got %v", ErrWalSyncPeriod, err)
+	}
+}
+
+// Tests that truncating removes only segments older than seq
+func TestWalTruncate(t *testing.T) {
+	dir := t.TempDir()
+	w, err := OpenWal(dir, WalSyncNever, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Append(walRecord{Op: protocol.OpDel, Key: "old"})
+	seq, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append(walRecord{Op: protocol.OpDel, Key: "new"})
+	err = w.Truncate(seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 segment, got %v", len(entries))
+	}
+	segments, _ := w.segments()
+	if segments[0] != seq {
+		t.Fatalf("expected segment %v to remain, got %v", seq, segments[0])
+	}
+}
@@ -0,0 +1,144 @@
+package store
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default number of events buffered per watcher
+const DEFAULT_WATCH_BUFFER = 1000
+
+// A change to a key
+//
+// Op is protocol.OpSet, protocol.OpDel, protocol.OpExpired or
+// protocol.OpEvicted. For deletes & evictions, Slot is empty.
+// For expiry, Slot is the expired slot.
+type Event struct {
+	Op   byte
+	Key  string
+	Slot Slot
+}
+
+// Watcher receives events for keys with its prefix
+//
+// Events are buffered. If the buffer is full, the watcher
+// is dropped: Events is closed & Overflowed returns true.
+// A slow consumer must then watch again, and re-read
+// the keys it is interested in.
+type Watcher struct {
+	Prefix   string
+	Events   chan Event
+	ops      []byte // of events to receive, all if empty
+	overflow bool
+}
+
+// Overflowed returns true if the watcher was dropped
+// because its buffer was full
+//
+// Only valid after Events is closed.
+func (w *Watcher) Overflowed() bool {
+	return w.overflow
+}
+
+// receives returns true if the watcher receives events of the op
+func (w *Watcher) receives(op byte) bool {
+	if len(w.ops) == 0 {
+		return true
+	}
+	for _, o := range w.ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Holds the watchers of a store
+//
+// The zero value is ready to use.
+type watchHub struct {
+	count    int32 // read without lock, to skip publishing
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+// Watch returns a new watcher for keys with the prefix
+//
+// If bufferSize is 0, DEFAULT_WATCH_BUFFER is used.
+func (s *Store) Watch(prefix string, bufferSize int) *Watcher {
+	return s.WatchOps(prefix, bufferSize)
+}
+
+// WatchOps is like Watch, but the watcher only receives
+// events with one of the given ops, or all if none are given
+//
+// For example, protocol.OpExpired for expiry notifications.
+func (s *Store) WatchOps(prefix string, bufferSize int, ops ...byte) *Watcher {
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_WATCH_BUFFER
+	}
+	w := &Watcher{
+		Prefix: prefix,
+		Events: make(chan Event, bufferSize),
+		ops:    ops,
+	}
+	h := &s.watch
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[*Watcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	atomic.AddInt32(&h.count, 1)
+	return w
+}
+
+// Unwatch removes the watcher & closes its Events
+func (s *Store) Unwatch(w *Watcher) {
+	h := &s.watch
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(w)
+}
+
+// drop removes the watcher if present,
+// the caller must hold the lock
+func (h *watchHub) drop(w *Watcher) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+	delete(h.watchers, w)
+	atomic.AddInt32(&h.count, -1)
+	close(w.Events)
+}
+
+// publish sends the event to every watcher with a matching prefix
+//
+// Never blocks, watchers with a full buffer are dropped.
+// Called while holding the lock of the key's block,
+// so events for a key arrive in order.
+func (s *Store) publish(op byte, key string, slot Slot) {
+	h := &s.watch
+	if atomic.LoadInt32(&h.count) == 0 {
+		return
+	}
+	e := Event{
+		Op:   op,
+		Key:  key,
+		Slot: slot,
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		if !strings.HasPrefix(key, w.Prefix) || !w.receives(op) {
+			continue
+		}
+		select {
+		case w.Events <- e:
+		default:
+			w.overflow = true
+			h.drop(w)
+		}
+	}
+}
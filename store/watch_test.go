@@ -0,0 +1,74 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/intob/rocketkv/protocol"
+)
+
+func TestWatch(t *testing.T) {
+	s := getTestStore(8, false)
+	w := s.Watch("config/", 10)
+	defer s.Unwatch(w)
+
+	s.Set("config/a", Slot{Value: []byte("1")}, false)
+	s.Set("other/a", Slot{Value: []byte("2")}, false)
+	s.Del("config/a")
+	// deletes of missing keys publish nothing
+	s.Del("config/a")
+	s.Txn([]TxnStep{{Kind: TxnDel, Key: "config/b"}})
+
+	e := <-w.Events
+	if e.Op != protocol.OpSet || e.Key != "config/a" || string(e.Slot.Value) != "1" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	e = <-w.Events
+	if e.Op != protocol.OpDel || e.Key != "config/a" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	select {
+	case e := <-w.Events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	s := getTestStore(8, false)
+	w := s.Watch("", 2)
+
+	for i := 0; i < 3; i++ {
+		s.Set("key", Slot{Value: []byte{byte(i)}}, false)
+	}
+
+	count := 0
+	for range w.Events {
+		count++
+	}
+	if count != 2 || !w.Overflowed() {
+		t.FailNow()
+	}
+
+	// must not panic
+	s.Unwatch(w)
+}
+
+func TestWatchOps(t *testing.T) {
+	s := getTestStore(8, false)
+	w := s.WatchOps("", 10, protocol.OpExpired)
+	defer s.Unwatch(w)
+
+	s.Set("a", Slot{Value: []byte("1")}, false)
+	s.Del("a")
+	s.publish(protocol.OpExpired, "b", Slot{Value: []byte("2")})
+
+	e := <-w.Events
+	if e.Op != protocol.OpExpired || e.Key != "b" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	select {
+	case e := <-w.Events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}